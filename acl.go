@@ -0,0 +1,115 @@
+package tftp
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+//AccessList lets clients through by the network they're in
+type AccessList struct {
+	//Allow, if not empty, only lets through clients in one of these networks
+	Allow []*net.IPNet
+	//Deny turns away clients in any of these networks, even if they are in an Allow network
+	Deny []*net.IPNet
+}
+
+//Allowed checks if ip is let through the list
+func (l AccessList) Allowed(ip net.IP) bool {
+	for _, n := range l.Deny {
+		if n.Contains(ip) {
+			return false
+		}
+	}
+	if len(l.Allow) == 0 {
+		return true
+	}
+	for _, n := range l.Allow {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+//PathACL applies access lists to requests for filenames starting with Prefix
+type PathACL struct {
+	Prefix string
+	//AccessList applies to reads and writes
+	AccessList
+	Read  AccessList
+	Write AccessList
+}
+
+//ACL controls which clients may read and write which files.  A request has to be let through by every
+//access list that applies to it: the top level list, the list for its operation, and the lists of every
+//PathACL whose prefix matches the filename.
+type ACL struct {
+	//AccessList applies to every request
+	AccessList
+	//Read applies to read requests
+	Read AccessList
+	//Write applies to write requests
+	Write AccessList
+	Paths []PathACL
+	//Drop silently ignores denied requests, instead of replying with an access violation error
+	Drop bool
+}
+
+//Allowed checks if the client at ip may make a request of type op (OpRRQ or OpWRQ) for filename.
+//If not, reason says which list denied it.
+func (a *ACL) Allowed(ip net.IP, op uint16, filename string) (ok bool, reason string) {
+	if a == nil {
+		return true, ""
+	}
+	if !a.AccessList.Allowed(ip) {
+		return false, "denied by acl"
+	}
+	if !opAccessList(op, a.Read, a.Write).Allowed(ip) {
+		return false, "denied by " + Transfer{Op: op}.OpString() + " acl"
+	}
+	for _, p := range a.Paths {
+		if !strings.HasPrefix(filename, p.Prefix) {
+			continue
+		}
+		if !p.AccessList.Allowed(ip) {
+			return false, "denied by acl for " + p.Prefix
+		}
+		if !opAccessList(op, p.Read, p.Write).Allowed(ip) {
+			return false, "denied by " + Transfer{Op: op}.OpString() + " acl for " + p.Prefix
+		}
+	}
+	return true, ""
+}
+
+func opAccessList(op uint16, read AccessList, write AccessList) AccessList {
+	if op == OpWRQ {
+		return write
+	}
+	return read
+}
+
+//ParseNetworks parses CIDRs (10.0.0.0/8, 2001:db8::/32) or single IPs into networks for an AccessList
+func ParseNetworks(networks []string) ([]*net.IPNet, error) {
+	nn := make([]*net.IPNet, 0, len(networks))
+	for _, s := range networks {
+		if !strings.Contains(s, "/") {
+			ip := net.ParseIP(s)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid IP address %s", s)
+			}
+			if ip4 := ip.To4(); ip4 != nil {
+				nn = append(nn, &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)})
+			} else {
+				nn = append(nn, &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)})
+			}
+			continue
+		}
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, err
+		}
+		nn = append(nn, n)
+	}
+	return nn, nil
+}
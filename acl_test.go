@@ -0,0 +1,78 @@
+package tftp
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func mustParseNetworks(networks ...string) []*net.IPNet {
+	nn, err := ParseNetworks(networks)
+	if err != nil {
+		panic(err)
+	}
+	return nn
+}
+
+func TestACL_Allowed(t *testing.T) {
+	acl := &ACL{
+		AccessList: AccessList{
+			Allow: mustParseNetworks("10.0.0.0/8", "2001:db8::/32"),
+			Deny:  mustParseNetworks("10.0.99.0/24"),
+		},
+		Write: AccessList{
+			Allow: mustParseNetworks("10.1.0.0/16"),
+		},
+		Paths: []PathACL{
+			{
+				Prefix: "secret/",
+				Read:   AccessList{Allow: mustParseNetworks("10.2.0.5")},
+			},
+			{
+				Prefix:     "configs/",
+				AccessList: AccessList{Deny: mustParseNetworks("10.1.2.0/24")},
+			},
+		},
+	}
+	tests := []struct {
+		name       string
+		acl        *ACL
+		ip         string
+		op         uint16
+		filename   string
+		wantOk     bool
+		wantReason string
+	}{
+		{name: "no acl", acl: nil, ip: "192.168.1.1", op: OpWRQ, filename: "a", wantOk: true},
+		{name: "allowed read", acl: acl, ip: "10.5.5.5", op: OpRRQ, filename: "kernel", wantOk: true},
+		{name: "allowed ipv6", acl: acl, ip: "2001:db8::5", op: OpRRQ, filename: "kernel", wantOk: true},
+		{name: "ipv4 mapped", acl: acl, ip: "::ffff:10.5.5.5", op: OpRRQ, filename: "kernel", wantOk: true},
+		{name: "not in allow", acl: acl, ip: "192.168.1.1", op: OpRRQ, filename: "kernel", wantReason: "denied by acl"},
+		{name: "denied", acl: acl, ip: "10.0.99.1", op: OpRRQ, filename: "kernel", wantReason: "denied by acl"},
+		{name: "write not allowed", acl: acl, ip: "10.5.5.5", op: OpWRQ, filename: "kernel", wantReason: "denied by put acl"},
+		{name: "write allowed", acl: acl, ip: "10.1.5.5", op: OpWRQ, filename: "kernel", wantOk: true},
+		{name: "path read allowed", acl: acl, ip: "10.2.0.5", op: OpRRQ, filename: "secret/key", wantOk: true},
+		{name: "path read denied", acl: acl, ip: "10.2.0.6", op: OpRRQ, filename: "secret/key", wantReason: "denied by get acl for secret/"},
+		{name: "path denied", acl: acl, ip: "10.1.2.3", op: OpWRQ, filename: "configs/switch1", wantReason: "denied by acl for configs/"},
+		{name: "path other file", acl: acl, ip: "10.1.2.3", op: OpWRQ, filename: "switch1", wantOk: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ok, reason := tt.acl.Allowed(net.ParseIP(tt.ip), tt.op, tt.filename)
+			assert.Equal(t, tt.wantOk, ok)
+			assert.Equal(t, tt.wantReason, reason)
+		})
+	}
+}
+
+func TestParseNetworks(t *testing.T) {
+	nn, err := ParseNetworks([]string{"10.0.0.0/8", "10.1.2.3", "2001:db8::1"})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"10.0.0.0/8", "10.1.2.3/32", "2001:db8::1/128"}, []string{nn[0].String(), nn[1].String(), nn[2].String()})
+
+	_, err = ParseNetworks([]string{"10.0.0.0/33"})
+	assert.Error(t, err)
+	_, err = ParseNetworks([]string{"nope"})
+	assert.Error(t, err)
+}
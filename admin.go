@@ -0,0 +1,191 @@
+package tftp
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//FileInfo describes a stored file in the admin API
+type FileInfo struct {
+	Name     string    `json:"name"`
+	Size     int       `json:"size"`
+	Modified time.Time `json:"modified"`
+	Owner    string    `json:"owner,omitempty"`
+}
+
+func newFileInfo(f File) FileInfo {
+	return FileInfo{Name: f.Filename, Size: len(f.Data), Modified: f.Modified, Owner: f.Owner}
+}
+
+//adminHandler serves the admin API for a TFTPProtocolHandler
+type adminHandler struct {
+	handler *TFTPProtocolHandler
+	token   []byte
+}
+
+//NewAdminHandler returns an HTTP API for managing handler's files and transfers.  Every request must carry
+//"Authorization: Bearer <token>", an empty token refuses everything.
+//
+//	GET    /files                 list files, as JSON
+//	GET    /files/<name>          download a file
+//	PUT    /files/<name>          upload a file, replacing any file with that name
+//	DELETE /files/<name>          delete a file
+//	GET    /transfers             list running transfers, as JSON
+//	DELETE /transfers/<id>        cancel a transfer, the client is sent an error
+//
+//File requests use the default VirtualServer, or the one named by the server query parameter.
+func NewAdminHandler(handler *TFTPProtocolHandler, token string) http.Handler {
+	return &adminHandler{handler: handler, token: []byte(token)}
+}
+
+func (a *adminHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !a.authorized(r) {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="tftpd"`)
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	switch {
+	case r.URL.Path == "/files":
+		a.listFiles(w, r)
+	case strings.HasPrefix(r.URL.Path, "/files/"):
+		a.file(w, r, strings.TrimPrefix(r.URL.Path, "/files/"))
+	case r.URL.Path == "/transfers":
+		if r.Method != http.MethodGet {
+			methodNotAllowed(w, http.MethodGet)
+			return
+		}
+		writeJSON(w, http.StatusOK, a.handler.Transfers.List())
+	case strings.HasPrefix(r.URL.Path, "/transfers/"):
+		a.cancelTransfer(w, r, strings.TrimPrefix(r.URL.Path, "/transfers/"))
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (a *adminHandler) authorized(r *http.Request) bool {
+	if len(a.token) == 0 {
+		return false
+	}
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Bearer ") {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(strings.TrimPrefix(auth, "Bearer ")), a.token) == 1
+}
+
+//server finds the VirtualServer a request is for, answering with a 404 if there isn't one
+func (a *adminHandler) server(w http.ResponseWriter, r *http.Request) (*VirtualServer, bool) {
+	name := r.URL.Query().Get("server")
+	if name == "" {
+		name = DefaultVirtualServer
+	}
+	v, ok := a.handler.VirtualServer(name)
+	if !ok {
+		http.Error(w, "no such server "+name, http.StatusNotFound)
+	}
+	return v, ok
+}
+
+func (a *adminHandler) listFiles(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		methodNotAllowed(w, http.MethodGet)
+		return
+	}
+	v, ok := a.server(w, r)
+	if !ok {
+		return
+	}
+	files := v.Files.List()
+	infos := make([]FileInfo, len(files))
+	for i, f := range files {
+		infos[i] = newFileInfo(f)
+	}
+	writeJSON(w, http.StatusOK, infos)
+}
+
+func (a *adminHandler) file(w http.ResponseWriter, r *http.Request, name string) {
+	if name == "" {
+		http.NotFound(w, r)
+		return
+	}
+	v, ok := a.server(w, r)
+	if !ok {
+		return
+	}
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		f, ok := v.Files.Get(name)
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "application/octet-stream")
+		http.ServeContent(w, r, name, f.Modified, bytes.NewReader(f.Data))
+	case http.MethodPut:
+		//don't race a TFTP upload of the same file
+		if !v.writeTransfers.CanWrite(name) {
+			http.Error(w, "write already in progress for "+name, http.StatusConflict)
+			return
+		}
+		defer v.writeTransfers.Del(name)
+		data, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		status := http.StatusCreated
+		if _, ok := v.Files.Get(name); ok {
+			status = http.StatusOK
+		}
+		f := File{Filename: name, Data: data, Modified: a.handler.clock.Now()}
+		v.Files.Set(f)
+		a.handler.requestLog.Info("file uploaded through the admin api", Fields{
+			"server":   v.Name,
+			"filename": name,
+			"size":     len(data),
+		})
+		writeJSON(w, status, newFileInfo(f))
+	case http.MethodDelete:
+		if !v.Files.Delete(name) {
+			http.NotFound(w, r)
+			return
+		}
+		a.handler.requestLog.Info("file deleted through the admin api", Fields{
+			"server":   v.Name,
+			"filename": name,
+		})
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		methodNotAllowed(w, http.MethodGet, http.MethodHead, http.MethodPut, http.MethodDelete)
+	}
+}
+
+func (a *adminHandler) cancelTransfer(w http.ResponseWriter, r *http.Request, idString string) {
+	if r.Method != http.MethodDelete {
+		methodNotAllowed(w, http.MethodDelete)
+		return
+	}
+	id, err := strconv.ParseUint(idString, 10, 64)
+	if err != nil || !a.handler.Transfers.Cancel(id) {
+		http.NotFound(w, r)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func methodNotAllowed(w http.ResponseWriter, allowed ...string) {
+	w.Header().Set("Allow", strings.Join(allowed, ", "))
+	http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,134 @@
+package tftp
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lienmeat/tftp/udpserver"
+	"github.com/stretchr/testify/assert"
+)
+
+//adminRequest makes a request to the admin API with the test token
+func adminRequest(api http.Handler, method string, target string, body string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, target, strings.NewReader(body))
+	r.Header.Set("Authorization", "Bearer secret")
+	w := httptest.NewRecorder()
+	api.ServeHTTP(w, r)
+	return w
+}
+
+func TestAdminHandler_auth(t *testing.T) {
+	h := NewTFTPProtocolHandler(6000, 6100)
+	tests := []struct {
+		name   string
+		token  string
+		header string
+		want   int
+	}{
+		{name: "no header", token: "secret", want: http.StatusUnauthorized},
+		{name: "wrong token", token: "secret", header: "Bearer nope", want: http.StatusUnauthorized},
+		{name: "not a bearer token", token: "secret", header: "Basic secret", want: http.StatusUnauthorized},
+		{name: "no token configured", header: "Bearer ", want: http.StatusUnauthorized},
+		{name: "right token", token: "secret", header: "Bearer secret", want: http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/files", nil)
+			if tt.header != "" {
+				r.Header.Set("Authorization", tt.header)
+			}
+			w := httptest.NewRecorder()
+			NewAdminHandler(h, tt.token).ServeHTTP(w, r)
+			assert.Equal(t, tt.want, w.Code)
+		})
+	}
+}
+
+func TestAdminHandler_files(t *testing.T) {
+	h := NewTFTPProtocolHandler(6000, 6100)
+	lab, _ := h.NewVirtualServer("lab")
+	api := NewAdminHandler(h, "secret")
+
+	w := adminRequest(api, "PUT", "/files/images/boot.img", "image")
+	assert.Equal(t, http.StatusCreated, w.Code)
+	w = adminRequest(api, "PUT", "/files/images/boot.img", "new image")
+	assert.Equal(t, http.StatusOK, w.Code)
+	w = adminRequest(api, "PUT", "/files/kernel?server=lab", "kernel")
+	assert.Equal(t, http.StatusCreated, w.Code)
+	_, ok := lab.Files.Get("kernel")
+	assert.True(t, ok)
+
+	w = adminRequest(api, "GET", "/files", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	var files []FileInfo
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &files))
+	assert.Len(t, files, 1)
+	assert.Equal(t, "images/boot.img", files[0].Name)
+	assert.Equal(t, 9, files[0].Size)
+	assert.WithinDuration(t, time.Now(), files[0].Modified, time.Minute)
+
+	w = adminRequest(api, "GET", "/files/images/boot.img", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "new image", w.Body.String())
+	assert.Equal(t, "application/octet-stream", w.Header().Get("Content-Type"))
+
+	w = adminRequest(api, "DELETE", "/files/images/boot.img", "")
+	assert.Equal(t, http.StatusNoContent, w.Code)
+	w = adminRequest(api, "DELETE", "/files/images/boot.img", "")
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	w = adminRequest(api, "GET", "/files/images/boot.img", "")
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	w = adminRequest(api, "GET", "/files?server=missing", "")
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	w = adminRequest(api, "POST", "/files/kernel", "")
+	assert.Equal(t, http.StatusMethodNotAllowed, w.Code)
+
+	//uploads wait for TFTP writes to the same file to finish
+	def, _ := h.VirtualServer(DefaultVirtualServer)
+	def.writeTransfers.CanWrite("busy")
+	w = adminRequest(api, "PUT", "/files/busy", "data")
+	assert.Equal(t, http.StatusConflict, w.Code)
+}
+
+func TestAdminHandler_transfers(t *testing.T) {
+	client := &net.UDPAddr{IP: net.ParseIP("10.0.0.1"), Port: 5000}
+	h := NewTFTPProtocolHandler(6000, 6100)
+	h.Files.Set(File{Filename: "test", Data: make([]byte, 2000)})
+	api := NewAdminHandler(h, "secret")
+
+	in, out, done := startTestWorker(h)
+	in <- udpserver.NewUDPPacket(client, (&PacketRequest{Op: OpRRQ, Filename: "test", Mode: "octet"}).Serialize())
+	<-out
+
+	w := adminRequest(api, "GET", "/transfers", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	var transfers []TransferInfo
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &transfers))
+	if assert.Len(t, transfers, 1) {
+		assert.Equal(t, "10.0.0.1:5000", transfers[0].Peer)
+		assert.Equal(t, "test", transfers[0].Filename)
+		assert.Equal(t, "get", transfers[0].Op)
+		assert.Equal(t, DefaultVirtualServer, transfers[0].Server)
+	}
+
+	w = adminRequest(api, "DELETE", "/transfers/"+"12345", "")
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	w = adminRequest(api, "DELETE", "/transfers/nope", "")
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	w = adminRequest(api, "DELETE", "/transfers/1", "")
+	assert.Equal(t, http.StatusNoContent, w.Code)
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("transfer wasn't cancelled")
+	}
+	assert.Equal(t, (&PacketError{Code: 0, Msg: "transfer cancelled"}).Serialize(), (<-out).Data())
+	assert.Empty(t, h.Transfers.List())
+	assert.Equal(t, float64(1), h.Metrics.failed.value("get", "0"))
+}
@@ -0,0 +1,351 @@
+//Package client is a TFTP client, for getting files from and putting files to TFTP servers
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/lienmeat/tftp"
+	"github.com/lienmeat/tftp/clock"
+)
+
+//ErrTimeout is returned when the server stops answering
+var ErrTimeout = errors.New("timed out waiting for the server")
+
+//TFTP error codes, from RFC 1350 and RFC 2347
+const (
+	ErrCodeNotDefined        uint16 = 0
+	ErrCodeFileNotFound      uint16 = 1
+	ErrCodeAccessViolation   uint16 = 2
+	ErrCodeDiskFull          uint16 = 3
+	ErrCodeIllegalOperation  uint16 = 4
+	ErrCodeUnknownTID        uint16 = 5
+	ErrCodeFileExists        uint16 = 6
+	ErrCodeNoSuchUser        uint16 = 7
+	ErrCodeOptionNegotiation uint16 = 8
+)
+
+//Error is an ERROR packet sent by the server
+type Error struct {
+	Code uint16
+	Msg  string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("server error %d: %s", e.Code, e.Msg)
+}
+
+//TraceEvent is a packet sent or received, for Client.Trace
+type TraceEvent struct {
+	//Sent is true for packets sent to the server, false for ones received
+	Sent bool
+	//Retransmit is true for packets sent again because the server didn't answer in time
+	Retransmit bool
+	Peer       net.Addr
+	Packet     tftp.Packet
+}
+
+//Client gets and puts files.  The zero value is ready to use, with no options and octet mode.
+type Client struct {
+	//Mode is octet or netascii, octet if empty
+	Mode string
+	//BlockSize requests the blksize option, 0 uses 512 byte blocks
+	BlockSize int
+	//WindowSize requests the windowsize option (RFC 7440), 0 or 1 sends a block at a time
+	WindowSize int
+	//TransferSize requests the tsize option, so the server says how big files it sends are
+	TransferSize bool
+	//Timeout is how long to wait for the server before resending, default 1s.  If set, it's also requested
+	//from the server with the timeout option, in whole seconds.
+	Timeout time.Duration
+	//Retries is how many times a packet is resent before giving up, default 5
+	Retries int
+	//Progress, if set, is called as data moves with the bytes moved so far and the file size, or -1
+	//if it isn't known
+	Progress func(transferred int64, size int64)
+	//Trace, if set, is called for every packet sent and received
+	Trace func(TraceEvent)
+	//ListenPacket opens the connection for a transfer, by default a UDP socket on a random port
+	ListenPacket func() (net.PacketConn, error)
+	//Clock sets read deadlines, it must be the clock ListenPacket's connections use.  The system clock
+	//if nil.
+	Clock clock.Clock
+}
+
+//DefaultTimeout is how long a Client waits for the server before resending, if Timeout isn't set
+const DefaultTimeout = time.Second
+
+//DefaultRetries is how many times a Client resends a packet, if Retries isn't set
+const DefaultRetries = 5
+
+//Get reads filename from the server at addr into w with a default Client
+func Get(ctx context.Context, addr string, filename string, w io.Writer) (int64, error) {
+	return (&Client{}).Get(ctx, addr, filename, w)
+}
+
+//Put writes r to filename on the server at addr with a default Client
+func Put(ctx context.Context, addr string, filename string, r io.Reader) (int64, error) {
+	return (&Client{}).Put(ctx, addr, filename, r)
+}
+
+//Get reads filename from the server at addr, host:port or just host for port 69, writing it to w.
+//It returns how many bytes were received.
+func (c *Client) Get(ctx context.Context, addr string, filename string, w io.Writer) (int64, error) {
+	t, err := c.start(ctx, addr)
+	if err != nil {
+		return 0, err
+	}
+	defer t.close()
+
+	requested := c.options(0)
+	t.send([]tftp.Packet{&tftp.PacketRequest{Op: tftp.OpRRQ, Filename: filename, Mode: c.mode(), Options: requested}})
+	var out io.Writer = w
+	if c.mode() == "netascii" {
+		decoder := newNetasciiWriter(w)
+		defer decoder.Flush()
+		out = decoder
+	}
+
+	var received int64
+	size := int64(-1)
+	expected := uint16(1)
+	sinceAck := 0
+	started := false
+	for {
+		p, err := t.receive(ctx)
+		if err == errNoAnswer {
+			if err := t.retransmit(); err != nil {
+				return received, err
+			}
+			continue
+		}
+		if err != nil {
+			t.abort(err)
+			return received, err
+		}
+		switch p := p.(type) {
+		case *tftp.PacketOAck:
+			//options are only acknowledged in place of the first block
+			if started {
+				continue
+			}
+			started = true
+			if size, err = t.negotiate(p.Options, requested); err != nil {
+				t.fail(ErrCodeOptionNegotiation, err)
+				return received, err
+			}
+			t.send([]tftp.Packet{&tftp.PacketAck{BlockNum: 0}})
+		case *tftp.PacketData:
+			started = true
+			if p.BlockNum != expected {
+				//a resent or out of order block, ack the last one we have so the server carries on from there
+				t.send([]tftp.Packet{&tftp.PacketAck{BlockNum: expected - 1}})
+				sinceAck = 0
+				continue
+			}
+			t.progressed()
+			if _, err := out.Write(p.Data); err != nil {
+				t.fail(ErrCodeDiskFull, err)
+				return received, err
+			}
+			received += int64(len(p.Data))
+			if c.Progress != nil {
+				c.Progress(received, size)
+			}
+			last := len(p.Data) < t.blockSize
+			sinceAck++
+			if last || sinceAck >= t.windowSize {
+				t.send([]tftp.Packet{&tftp.PacketAck{BlockNum: expected}})
+				sinceAck = 0
+			}
+			expected++
+			if last {
+				return received, nil
+			}
+		case *tftp.PacketError:
+			return received, &Error{Code: p.Code, Msg: p.Msg}
+		}
+	}
+}
+
+//Put writes everything read from r to filename on the server at addr, host:port or just host for port 69.
+//If TransferSize is set and r has a Len or Stat method, like a bytes.Reader or os.File, the size is sent
+//in the tsize option.  It returns how many bytes were sent.
+func (c *Client) Put(ctx context.Context, addr string, filename string, r io.Reader) (int64, error) {
+	t, err := c.start(ctx, addr)
+	if err != nil {
+		return 0, err
+	}
+	defer t.close()
+
+	size := readerSize(r)
+	requested := c.options(size)
+	t.send([]tftp.Packet{&tftp.PacketRequest{Op: tftp.OpWRQ, Filename: filename, Mode: c.mode(), Options: requested}})
+	if c.mode() == "netascii" {
+		r = newNetasciiReader(r)
+		//the size changes as line endings are translated
+		size = -1
+	}
+
+	var sent int64
+	//blocks sent but not acked yet
+	window := []*tftp.PacketData{}
+	next := uint16(1)
+	readAll := false
+	started := false
+	//fill reads blocks until the window is full, then sends every block in it
+	fill := func() error {
+		for len(window) < t.windowSize && !readAll {
+			buf := make([]byte, t.blockSize)
+			n, err := io.ReadFull(r, buf)
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				readAll = true
+			} else if err != nil {
+				return err
+			}
+			window = append(window, &tftp.PacketData{BlockNum: next, Data: buf[:n]})
+			next++
+		}
+		packets := make([]tftp.Packet, len(window))
+		for i, d := range window {
+			packets[i] = d
+		}
+		t.send(packets)
+		return nil
+	}
+	for {
+		p, err := t.receive(ctx)
+		if err == errNoAnswer {
+			if err := t.retransmit(); err != nil {
+				return sent, err
+			}
+			continue
+		}
+		if err != nil {
+			t.abort(err)
+			return sent, err
+		}
+		switch p := p.(type) {
+		case *tftp.PacketOAck:
+			if started {
+				continue
+			}
+			started = true
+			if _, err := t.negotiate(p.Options, requested); err != nil {
+				t.fail(ErrCodeOptionNegotiation, err)
+				return sent, err
+			}
+		case *tftp.PacketAck:
+			if !started {
+				if p.BlockNum != 0 {
+					continue
+				}
+				started = true
+				break
+			}
+			acked := -1
+			for i, d := range window {
+				if d.BlockNum == p.BlockNum {
+					acked = i
+				}
+			}
+			//acks for blocks already acked are ignored, resending for them makes every block go twice
+			if acked < 0 {
+				continue
+			}
+			t.progressed()
+			for _, d := range window[:acked+1] {
+				sent += int64(len(d.Data))
+			}
+			window = window[acked+1:]
+			if c.Progress != nil {
+				c.Progress(sent, size)
+			}
+			if len(window) == 0 && readAll {
+				return sent, nil
+			}
+		case *tftp.PacketError:
+			return sent, &Error{Code: p.Code, Msg: p.Msg}
+		default:
+			continue
+		}
+		if err := fill(); err != nil {
+			t.fail(ErrCodeNotDefined, err)
+			return sent, err
+		}
+	}
+}
+
+func (c *Client) mode() string {
+	if c.Mode == "" {
+		return "octet"
+	}
+	return c.Mode
+}
+
+func (c *Client) timeout() time.Duration {
+	if c.Timeout <= 0 {
+		return DefaultTimeout
+	}
+	return c.Timeout
+}
+
+func (c *Client) clock() clock.Clock {
+	if c.Clock == nil {
+		return clock.Real
+	}
+	return c.Clock
+}
+
+func (c *Client) retries() int {
+	if c.Retries <= 0 {
+		return DefaultRetries
+	}
+	return c.Retries
+}
+
+//options are the options to request, size is sent as tsize if TransferSize is set and it's known
+func (c *Client) options(size int64) map[string]string {
+	options := map[string]string{}
+	if c.BlockSize > 0 {
+		options["blksize"] = strconv.Itoa(c.BlockSize)
+	}
+	if c.WindowSize > 1 {
+		options["windowsize"] = strconv.Itoa(c.WindowSize)
+	}
+	if c.Timeout > 0 {
+		seconds := int(c.Timeout / time.Second)
+		if seconds < 1 {
+			seconds = 1
+		}
+		options["timeout"] = strconv.Itoa(seconds)
+	}
+	if c.TransferSize && size >= 0 {
+		options["tsize"] = strconv.FormatInt(size, 10)
+	}
+	if len(options) == 0 {
+		return nil
+	}
+	return options
+}
+
+//readerSize is how much r has left to read, or -1 if it can't tell
+func readerSize(r io.Reader) int64 {
+	switch r := r.(type) {
+	case interface{ Len() int }:
+		return int64(r.Len())
+	case interface {
+		Stat() (os.FileInfo, error)
+	}:
+		if info, err := r.Stat(); err == nil && info.Mode().IsRegular() {
+			return info.Size()
+		}
+	}
+	return -1
+}
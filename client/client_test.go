@@ -0,0 +1,350 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/lienmeat/tftp"
+	"github.com/lienmeat/tftp/udpserver"
+	"github.com/stretchr/testify/assert"
+)
+
+var (
+	serverOnce sync.Once
+	server     *tftp.TFTPProtocolHandler
+)
+
+//testServer serves a handler on 127.0.0.1:6050, and a read-only server on 127.0.0.1:6051, for the rest of the
+//tests, rather than starting and stopping one on the same ports for each test
+func testServer() *tftp.TFTPProtocolHandler {
+	serverOnce.Do(func() {
+		server = tftp.NewTFTPProtocolHandler(6700, 6800)
+		ro, _ := server.NewVirtualServer("ro")
+		ro.ReadOnly = true
+		health := &udpserver.Health{}
+		go udpserver.ServeWithHealth(context.Background(), []udpserver.Listener{
+			{Address: "127.0.0.1:6050", Handler: server},
+			{Address: "127.0.0.1:6051", Handler: ro},
+		}, health)
+		for i := 0; i < 100 && !health.Alive(); i++ {
+			time.Sleep(time.Millisecond * 10)
+		}
+	})
+	return server
+}
+
+func TestClient_Get(t *testing.T) {
+	handler := testServer()
+	small := []byte("hello\n")
+	big := bytes.Repeat([]byte("0123456789"), 300)
+	handler.Files.Set(tftp.File{Filename: "small", Data: small})
+	handler.Files.Set(tftp.File{Filename: "big", Data: big})
+	handler.Files.Set(tftp.File{Filename: "exact", Data: big[:1024]})
+
+	tests := []struct {
+		name     string
+		client   Client
+		filename string
+		want     []byte
+		wantSize int64
+	}{
+		{"small", Client{}, "small", small, -1},
+		{"several blocks", Client{}, "big", big, -1},
+		{"multiple of the block size", Client{}, "exact", big[:1024], -1},
+		{"blksize and tsize", Client{BlockSize: 1024, TransferSize: true}, "big", big, int64(len(big))},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var progress []int64
+			size := int64(0)
+			tt.client.Progress = func(transferred int64, total int64) {
+				progress = append(progress, transferred)
+				size = total
+			}
+			buf := &bytes.Buffer{}
+			n, err := tt.client.Get(context.Background(), "127.0.0.1:6050", tt.filename, buf)
+			assert.NoError(t, err)
+			assert.Equal(t, int64(len(tt.want)), n)
+			assert.Equal(t, tt.want, buf.Bytes())
+			assert.Equal(t, tt.wantSize, size)
+			if assert.NotEmpty(t, progress) {
+				assert.Equal(t, n, progress[len(progress)-1])
+			}
+		})
+	}
+}
+
+func TestClient_Put(t *testing.T) {
+	handler := testServer()
+	data := bytes.Repeat([]byte("config line\n"), 200)
+
+	tests := []struct {
+		name   string
+		client Client
+		want   []byte
+	}{
+		{"default", Client{}, data},
+		{"blksize and tsize", Client{BlockSize: 1400, TransferSize: true}, data},
+		{"netascii", Client{Mode: "netascii"}, bytes.Replace(data, []byte("\n"), []byte("\r\n"), -1)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := tt.client.Put(context.Background(), "127.0.0.1:6050", "config", bytes.NewReader(data))
+			assert.NoError(t, err)
+			//the server commits the file just after the last ack
+			var f tftp.File
+			for i := 0; i < 100; i++ {
+				if f, _ = handler.Files.Get("config"); bytes.Equal(f.Data, tt.want) {
+					break
+				}
+				time.Sleep(time.Millisecond * 10)
+			}
+			assert.True(t, bytes.Equal(tt.want, f.Data), "got %q", f.Data)
+			handler.Files.Delete("config")
+		})
+	}
+}
+
+func TestClient_errors(t *testing.T) {
+	testServer()
+
+	_, err := Get(context.Background(), "127.0.0.1:6050", "missing", &bytes.Buffer{})
+	assert.Equal(t, &Error{Code: ErrCodeFileNotFound, Msg: "file not found"}, err)
+	assert.EqualError(t, err, "server error 1: file not found")
+
+	_, err = Put(context.Background(), "127.0.0.1:6051", "config", bytes.NewReader([]byte("data")))
+	assert.Equal(t, &Error{Code: ErrCodeAccessViolation, Msg: "access violation"}, err)
+}
+
+func TestClient_timeout(t *testing.T) {
+	//a server that never answers
+	conn, err := net.ListenPacket("udp", "127.0.0.1:6052")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer conn.Close()
+
+	retransmits := 0
+	c := &Client{Timeout: time.Millisecond * 10, Retries: 3, Trace: func(e TraceEvent) {
+		if e.Retransmit {
+			retransmits++
+		}
+	}}
+	_, err = c.Get(context.Background(), "127.0.0.1:6052", "file", &bytes.Buffer{})
+	assert.Equal(t, ErrTimeout, err)
+	assert.Equal(t, 3, retransmits)
+
+	//a cancelled context stops the transfer without waiting for the timeout
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*50)
+	defer cancel()
+	started := time.Now()
+	_, err = (&Client{Timeout: time.Second * 5}).Put(ctx, "127.0.0.1:6052", "file", bytes.NewReader([]byte("data")))
+	assert.Equal(t, context.DeadlineExceeded, err)
+	assert.True(t, time.Since(started) < time.Second)
+}
+
+//fakeServer answers one request on 127.0.0.1:6053 from a new port, running serve with the request and the
+//transfer's connection.  Anything serve returns is sent to errs.
+func fakeServer(t *testing.T, serve func(conn net.PacketConn, client net.Addr, request *tftp.PacketRequest) error) (errs <-chan error) {
+	listener, err := net.ListenPacket("udp", "127.0.0.1:6053")
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := make(chan error, 1)
+	go func() {
+		defer listener.Close()
+		buf := make([]byte, tftp.MaxPacketSize)
+		listener.SetReadDeadline(time.Now().Add(time.Second))
+		n, client, err := listener.ReadFrom(buf)
+		if err != nil {
+			out <- err
+			return
+		}
+		p, err := tftp.ParsePacket(buf[:n])
+		if err != nil {
+			out <- err
+			return
+		}
+		conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			out <- err
+			return
+		}
+		defer conn.Close()
+		out <- serve(conn, client, p.(*tftp.PacketRequest))
+	}()
+	return out
+}
+
+//expect reads the next packet from conn
+func expect(conn net.PacketConn) (tftp.Packet, error) {
+	buf := make([]byte, tftp.MaxPacketSize)
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	n, _, err := conn.ReadFrom(buf)
+	if err != nil {
+		return nil, err
+	}
+	return tftp.ParsePacket(buf[:n])
+}
+
+func TestClient_Get_windowSize(t *testing.T) {
+	blocks := [][]byte{bytes.Repeat([]byte("a"), 512), bytes.Repeat([]byte("b"), 512), []byte("c")}
+	var acks []tftp.Packet
+	errs := fakeServer(t, func(conn net.PacketConn, client net.Addr, request *tftp.PacketRequest) error {
+		assert.Equal(t, map[string]string{"windowsize": "2"}, request.Options)
+		conn.WriteTo((&tftp.PacketOAck{Options: map[string]string{"windowsize": "2"}}).Serialize(), client)
+		p, err := expect(conn)
+		if err != nil {
+			return err
+		}
+		acks = append(acks, p)
+		for i, block := range blocks {
+			conn.WriteTo((&tftp.PacketData{BlockNum: uint16(i + 1), Data: block}).Serialize(), client)
+			if i == 1 || i == 2 {
+				if p, err = expect(conn); err != nil {
+					return err
+				}
+				acks = append(acks, p)
+			}
+		}
+		return nil
+	})
+
+	buf := &bytes.Buffer{}
+	n, err := (&Client{WindowSize: 2}).Get(context.Background(), "127.0.0.1:6053", "file", buf)
+	assert.NoError(t, err)
+	assert.NoError(t, <-errs)
+	assert.Equal(t, int64(1025), n)
+	assert.Equal(t, bytes.Join(blocks, nil), buf.Bytes())
+	//one ack per window, and one for the last block
+	assert.Equal(t, []tftp.Packet{
+		&tftp.PacketAck{BlockNum: 0},
+		&tftp.PacketAck{BlockNum: 2},
+		&tftp.PacketAck{BlockNum: 3},
+	}, acks)
+}
+
+func TestClient_Put_windowSize(t *testing.T) {
+	data := bytes.Repeat([]byte("x"), 1300)
+	var got []byte
+	errs := fakeServer(t, func(conn net.PacketConn, client net.Addr, request *tftp.PacketRequest) error {
+		conn.WriteTo((&tftp.PacketOAck{Options: map[string]string{"windowsize": "2"}}).Serialize(), client)
+		block := uint16(0)
+		for {
+			p, err := expect(conn)
+			if err != nil {
+				return err
+			}
+			d := p.(*tftp.PacketData)
+			block = d.BlockNum
+			got = append(got, d.Data...)
+			if len(d.Data) < 512 || block%2 == 0 {
+				conn.WriteTo((&tftp.PacketAck{BlockNum: block}).Serialize(), client)
+			}
+			if len(d.Data) < 512 {
+				return nil
+			}
+		}
+	})
+
+	n, err := (&Client{WindowSize: 2}).Put(context.Background(), "127.0.0.1:6053", "file", bytes.NewReader(data))
+	assert.NoError(t, err)
+	assert.NoError(t, <-errs)
+	assert.Equal(t, int64(1300), n)
+	assert.Equal(t, data, got)
+}
+
+func TestClient_unknownTID(t *testing.T) {
+	errs := fakeServer(t, func(conn net.PacketConn, client net.Addr, request *tftp.PacketRequest) error {
+		//another port sending into the transfer is told to go away, and doesn't disturb it
+		other, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			return err
+		}
+		defer other.Close()
+		conn.WriteTo((&tftp.PacketData{BlockNum: 1, Data: bytes.Repeat([]byte("a"), 512)}).Serialize(), client)
+		if _, err := expect(conn); err != nil {
+			return err
+		}
+		other.WriteTo((&tftp.PacketData{BlockNum: 2, Data: []byte("wrong")}).Serialize(), client)
+		p, err := expect(other)
+		if err != nil {
+			return err
+		}
+		assert.Equal(t, &tftp.PacketError{Code: ErrCodeUnknownTID, Msg: "unknown transfer id"}, p)
+		conn.WriteTo((&tftp.PacketData{BlockNum: 2, Data: []byte("right")}).Serialize(), client)
+		_, err = expect(conn)
+		return err
+	})
+
+	buf := &bytes.Buffer{}
+	_, err := Get(context.Background(), "127.0.0.1:6053", "file", buf)
+	assert.NoError(t, err)
+	assert.NoError(t, <-errs)
+	assert.Equal(t, "right", string(buf.Bytes()[512:]))
+}
+
+func TestTransfer_negotiate(t *testing.T) {
+	requested := map[string]string{"blksize": "1024", "windowsize": "4", "timeout": "2", "tsize": "0"}
+	tests := []struct {
+		name     string
+		options  map[string]string
+		want     transfer
+		wantSize int64
+		wantErr  string
+	}{
+		{
+			"everything",
+			map[string]string{"blksize": "800", "windowsize": "2", "timeout": "3", "tsize": "5000"},
+			transfer{blockSize: 800, windowSize: 2, timeout: time.Second * 3},
+			5000,
+			"",
+		},
+		{"nothing", map[string]string{}, transfer{blockSize: 512, windowSize: 1, timeout: time.Second}, -1, ""},
+		{"not requested", map[string]string{"multicast": "1"}, transfer{}, -1, "server acknowledged multicast, which wasn't requested"},
+		{"bigger blksize", map[string]string{"blksize": "2048"}, transfer{}, -1, "server sent a bad blksize: 2048"},
+		{"tiny blksize", map[string]string{"blksize": "4"}, transfer{}, -1, "server sent a bad blksize: 4"},
+		{"bigger windowsize", map[string]string{"windowsize": "8"}, transfer{}, -1, "server sent a bad windowsize: 8"},
+		{"not a number", map[string]string{"tsize": "big"}, transfer{}, -1, "server sent a bad tsize: big"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tr := &transfer{blockSize: 512, windowSize: 1, timeout: time.Second, buf: make([]byte, 516)}
+			size, err := tr.negotiate(tt.options, requested)
+			assert.Equal(t, tt.wantSize, size)
+			if tt.wantErr != "" {
+				assert.EqualError(t, err, tt.wantErr)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want.blockSize, tr.blockSize)
+			assert.Equal(t, tt.want.windowSize, tr.windowSize)
+			assert.Equal(t, tt.want.timeout, tr.timeout)
+			assert.True(t, len(tr.buf) >= tr.blockSize+4)
+		})
+	}
+}
+
+func TestClient_options(t *testing.T) {
+	tests := []struct {
+		name   string
+		client Client
+		size   int64
+		want   map[string]string
+	}{
+		{"none", Client{}, 100, nil},
+		{"all", Client{BlockSize: 1428, WindowSize: 4, Timeout: time.Second * 2, TransferSize: true}, 100,
+			map[string]string{"blksize": "1428", "windowsize": "4", "timeout": "2", "tsize": "100"}},
+		{"timeout rounds up to a second", Client{Timeout: time.Millisecond * 10}, 0, map[string]string{"timeout": "1"}},
+		{"unknown size", Client{TransferSize: true}, -1, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, tt.client.options(tt.size))
+		})
+	}
+}
@@ -0,0 +1,148 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	"github.com/lienmeat/tftp"
+	"github.com/lienmeat/tftp/clock"
+	"github.com/lienmeat/tftp/memnet"
+	"github.com/lienmeat/tftp/udpserver"
+	"github.com/stretchr/testify/assert"
+)
+
+//lossyServer serves a handler on 127.0.0.1:69 of a simulated network with conditions.  Time is kept by a fake
+//clock that moves on whenever the network goes quiet, so retransmits happen without waiting for them.
+//The returned client uses the network, and stop shuts it all down.  options are passed on to the handler.
+func lossyServer(conditions memnet.Conditions, seed int64, options ...tftp.Option) (handler *tftp.TFTPProtocolHandler, network *memnet.Network, client Client, stop func()) {
+	fake := clock.NewFake(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+	network = memnet.NewNetwork(fake, seed, conditions)
+	options = append([]tftp.Option{tftp.WithListenPacket(network.ListenUDP), tftp.WithClock(fake)}, options...)
+	handler = tftp.NewTFTPProtocolHandler(1000, 1100, options...)
+	ctx, cancel := context.WithCancel(context.Background())
+	health := &udpserver.Health{}
+	go udpserver.ServeWithHealth(ctx, []udpserver.Listener{{Address: "127.0.0.1:69", Handler: handler}}, health,
+		udpserver.WithListenPacket(network.ListenUDP))
+	for !health.Alive() {
+		time.Sleep(time.Millisecond)
+	}
+	done := make(chan struct{})
+	go network.Drive(fake, done)
+	client = Client{ListenPacket: network.Dial, Clock: fake}
+	return handler, network, client, func() {
+		close(done)
+		cancel()
+	}
+}
+
+func TestClient_lossyNetwork(t *testing.T) {
+	data := bytes.Repeat([]byte("0123456789abcdef"), 600)
+	tests := []struct {
+		name       string
+		conditions memnet.Conditions
+	}{
+		{"perfect", memnet.Conditions{}},
+		{"loss", memnet.Conditions{Loss: 0.1}},
+		{"duplicate", memnet.Conditions{Duplicate: 0.1}},
+		{"reorder", memnet.Conditions{Reorder: 0.1, Delay: time.Millisecond * 10}},
+		{"delay", memnet.Conditions{Delay: time.Millisecond * 200, Jitter: time.Millisecond * 100}},
+		{"everything", memnet.Conditions{Loss: 0.05, Duplicate: 0.05, Reorder: 0.05, Delay: time.Millisecond * 50, Jitter: time.Millisecond * 20}},
+	}
+	clients := []struct {
+		name   string
+		client Client
+	}{
+		{"lockstep", Client{}},
+		{"windowed", Client{BlockSize: 1024, WindowSize: 4}},
+	}
+	for _, tt := range tests {
+		for _, c := range clients {
+			t.Run(tt.name+" "+c.name, func(t *testing.T) {
+				handler, network, client, stop := lossyServer(tt.conditions, 1)
+				defer stop()
+				client.BlockSize = c.client.BlockSize
+				client.WindowSize = c.client.WindowSize
+				handler.Files.Set(tftp.File{Filename: "data", Data: data})
+
+				buf := &bytes.Buffer{}
+				n, err := client.Get(context.Background(), "127.0.0.1:69", "data", buf)
+				assert.NoError(t, err)
+				assert.Equal(t, int64(len(data)), n)
+				assert.True(t, bytes.Equal(data, buf.Bytes()), "got %d bytes", buf.Len())
+
+				_, err = client.Put(context.Background(), "127.0.0.1:69", "upload", bytes.NewReader(data))
+				//the server is done once it has sent the last ack, so if that's lost the client gives up
+				//waiting for it, with the file stored
+				if err != nil {
+					assert.Equal(t, ErrTimeout, err)
+				}
+				var f tftp.File
+				for i := 0; i < 100; i++ {
+					if f, _ = handler.Files.Get("upload"); f.Data != nil {
+						break
+					}
+					time.Sleep(time.Millisecond * 10)
+				}
+				assert.True(t, bytes.Equal(data, f.Data), "stored %d bytes", len(f.Data))
+
+				stats := network.Stats()
+				if tt.conditions.Loss > 0 {
+					assert.NotZero(t, stats.Lost)
+				}
+				if tt.conditions.Duplicate > 0 {
+					assert.NotZero(t, stats.Duplicated)
+				}
+			})
+		}
+	}
+}
+
+func TestClient_corruptingNetwork(t *testing.T) {
+	//udp checksums catch corruption on real networks, and tftp has no checksums of its own, so transfers
+	//over a network that doesn't can fail or deliver the wrong data, but mustn't hang
+	data := bytes.Repeat([]byte("0123456789abcdef"), 600)
+	handler, _, client, stop := lossyServer(memnet.Conditions{Corrupt: 0.05}, 1)
+	defer stop()
+	handler.Files.Set(tftp.File{Filename: "data", Data: data})
+	for i := 0; i < 10; i++ {
+		client.Get(context.Background(), "127.0.0.1:69", "data", &bytes.Buffer{})
+		client.Put(context.Background(), "127.0.0.1:69", "upload", bytes.NewReader(data))
+	}
+}
+
+func TestClient_singlePort(t *testing.T) {
+	data := bytes.Repeat([]byte("0123456789abcdef"), 600)
+	conditions := memnet.Conditions{Loss: 0.05, Duplicate: 0.05, Reorder: 0.05, Delay: time.Millisecond * 50}
+	handler, _, client, stop := lossyServer(conditions, 1, tftp.WithSinglePort(nil))
+	defer stop()
+	handler.Files.Set(tftp.File{Filename: "data", Data: data})
+	//every packet comes from the port the request went to
+	client.Trace = func(e TraceEvent) {
+		if !e.Sent {
+			assert.Equal(t, "127.0.0.1:69", e.Peer.String())
+		}
+	}
+
+	for _, windowSize := range []int{0, 4} {
+		client.WindowSize = windowSize
+		buf := &bytes.Buffer{}
+		_, err := client.Get(context.Background(), "127.0.0.1:69", "data", buf)
+		assert.NoError(t, err)
+		assert.True(t, bytes.Equal(data, buf.Bytes()), "got %d bytes", buf.Len())
+
+		_, err = client.Put(context.Background(), "127.0.0.1:69", "upload", bytes.NewReader(data))
+		if err != nil {
+			assert.Equal(t, ErrTimeout, err)
+		}
+	}
+	var f tftp.File
+	for i := 0; i < 100; i++ {
+		if f, _ = handler.Files.Get("upload"); f.Data != nil {
+			break
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+	assert.True(t, bytes.Equal(data, f.Data), "stored %d bytes", len(f.Data))
+}
@@ -0,0 +1,97 @@
+package client
+
+import (
+	"bufio"
+	"io"
+)
+
+//netasciiReader translates local text to netascii as it's read: LF becomes CR LF, and CR becomes CR NUL
+type netasciiReader struct {
+	r *bufio.Reader
+	//pending is the second byte of a translated pair, waiting to be read
+	pending []byte
+}
+
+func newNetasciiReader(r io.Reader) *netasciiReader {
+	return &netasciiReader{r: bufio.NewReader(r)}
+}
+
+func (n *netasciiReader) Read(p []byte) (int, error) {
+	i := 0
+	for i < len(p) {
+		if len(n.pending) > 0 {
+			p[i] = n.pending[0]
+			n.pending = n.pending[1:]
+			i++
+			continue
+		}
+		b, err := n.r.ReadByte()
+		if err != nil {
+			if i > 0 {
+				return i, nil
+			}
+			return 0, err
+		}
+		switch b {
+		case '\n':
+			p[i] = '\r'
+			n.pending = []byte{'\n'}
+		case '\r':
+			p[i] = '\r'
+			n.pending = []byte{0}
+		default:
+			p[i] = b
+		}
+		i++
+	}
+	return i, nil
+}
+
+//netasciiWriter translates netascii to local text as it's written: CR LF becomes LF, and CR NUL becomes CR.
+//A CR at the end of one write is held until the next, Flush writes it if there isn't one.
+type netasciiWriter struct {
+	w  io.Writer
+	cr bool
+}
+
+func newNetasciiWriter(w io.Writer) *netasciiWriter {
+	return &netasciiWriter{w: w}
+}
+
+func (n *netasciiWriter) Write(p []byte) (int, error) {
+	out := make([]byte, 0, len(p)+1)
+	for _, b := range p {
+		if n.cr {
+			n.cr = false
+			switch b {
+			case '\n':
+				out = append(out, '\n')
+				continue
+			case 0:
+				out = append(out, '\r')
+				continue
+			default:
+				out = append(out, '\r')
+			}
+		}
+		if b == '\r' {
+			n.cr = true
+			continue
+		}
+		out = append(out, b)
+	}
+	if _, err := n.w.Write(out); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+//Flush writes a CR left over from the last write
+func (n *netasciiWriter) Flush() error {
+	if !n.cr {
+		return nil
+	}
+	n.cr = false
+	_, err := n.w.Write([]byte{'\r'})
+	return err
+}
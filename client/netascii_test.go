@@ -0,0 +1,48 @@
+package client
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+	"testing/iotest"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNetascii(t *testing.T) {
+	tests := []struct {
+		name     string
+		local    string
+		netascii string
+	}{
+		{"plain", "hello", "hello"},
+		{"line endings", "one\ntwo\n", "one\r\ntwo\r\n"},
+		{"carriage return", "a\rb", "a\r\x00b"},
+		{"trailing carriage return", "a\r", "a\r\x00"},
+		{"empty", "", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			//one byte at a time, so translated pairs are split across reads
+			got, err := ioutil.ReadAll(newNetasciiReader(iotest.OneByteReader(bytes.NewReader([]byte(tt.local)))))
+			assert.NoError(t, err)
+			assert.Equal(t, tt.netascii, string(got))
+
+			buf := &bytes.Buffer{}
+			w := newNetasciiWriter(buf)
+			for i := range tt.netascii {
+				w.Write([]byte{tt.netascii[i]})
+			}
+			assert.NoError(t, w.Flush())
+			assert.Equal(t, tt.local, buf.String())
+		})
+	}
+
+	//a lone CR at the end of the data is kept
+	buf := &bytes.Buffer{}
+	w := newNetasciiWriter(buf)
+	w.Write([]byte("a\r"))
+	assert.Equal(t, "a", buf.String())
+	w.Flush()
+	assert.Equal(t, "a\r", buf.String())
+}
@@ -0,0 +1,229 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/lienmeat/tftp"
+)
+
+//aLongTimeAgo is a read deadline that has passed by any clock, setting it interrupts a read
+var aLongTimeAgo = time.Unix(1, 0)
+
+//errNoAnswer is a wait for the server that timed out, the last packets are resent
+var errNoAnswer = errors.New("no answer")
+
+//transfer is the connection and state shared by gets and puts
+type transfer struct {
+	client *Client
+	conn   net.PacketConn
+	//server is where the request goes, peer is the server's transfer port (TID) once it answers
+	server *net.UDPAddr
+	peer   net.Addr
+	//last are the packets sent last, resent if the server doesn't answer
+	last    []tftp.Packet
+	retries int
+	//negotiated options
+	blockSize  int
+	windowSize int
+	timeout    time.Duration
+	buf        []byte
+	//closes the connection's deadline when the context is done
+	stop chan struct{}
+}
+
+func (c *Client) start(ctx context.Context, addr string) (*transfer, error) {
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		addr = net.JoinHostPort(addr, "69")
+	}
+	server, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	listen := c.ListenPacket
+	if listen == nil {
+		listen = func() (net.PacketConn, error) {
+			return net.ListenPacket("udp", ":0")
+		}
+	}
+	conn, err := listen()
+	if err != nil {
+		return nil, err
+	}
+	t := &transfer{
+		client:     c,
+		conn:       conn,
+		server:     server,
+		blockSize:  int(tftp.BlockSize),
+		windowSize: 1,
+		timeout:    c.timeout(),
+		buf:        make([]byte, tftp.MaxPacketSize),
+		stop:       make(chan struct{}),
+	}
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.SetReadDeadline(aLongTimeAgo)
+		case <-t.stop:
+		}
+	}()
+	return t, nil
+}
+
+func (t *transfer) close() {
+	close(t.stop)
+	t.conn.Close()
+}
+
+//to is where packets go, the request goes to the server and everything after it to its transfer port
+func (t *transfer) to() net.Addr {
+	if t.peer == nil {
+		return t.server
+	}
+	return t.peer
+}
+
+//send sends packets, remembering them to resend
+func (t *transfer) send(packets []tftp.Packet) {
+	t.last = packets
+	t.write(packets, false)
+}
+
+func (t *transfer) write(packets []tftp.Packet, retransmit bool) {
+	to := t.to()
+	for _, p := range packets {
+		if t.client.Trace != nil {
+			t.client.Trace(TraceEvent{Sent: true, Retransmit: retransmit, Peer: to, Packet: p})
+		}
+		t.conn.WriteTo(p.Serialize(), to)
+	}
+}
+
+//retransmit resends the last packets, or gives up if it has done that too often without an answer
+func (t *transfer) retransmit() error {
+	t.retries++
+	if t.retries > t.client.retries() {
+		t.fail(ErrCodeNotDefined, ErrTimeout)
+		return ErrTimeout
+	}
+	t.write(t.last, true)
+	return nil
+}
+
+//progressed resets the retries once the server moves the transfer along
+func (t *transfer) progressed() {
+	t.retries = 0
+}
+
+//receive waits for the next packet from the server, returning errNoAnswer if none arrives in time
+func (t *transfer) receive(ctx context.Context) (tftp.Packet, error) {
+	for {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		t.conn.SetReadDeadline(t.client.clock().Now().Add(t.timeout))
+		n, from, err := t.conn.ReadFrom(t.buf)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				return nil, errNoAnswer
+			}
+			return nil, err
+		}
+		if t.peer == nil {
+			//the server answers from a new port (TID), but it has to be the server answering
+			if !sameHost(from, t.server) {
+				continue
+			}
+		} else if from.String() != t.peer.String() {
+			//another transfer's packet, or someone else's
+			t.conn.WriteTo((&tftp.PacketError{Code: ErrCodeUnknownTID, Msg: "unknown transfer id"}).Serialize(), from)
+			continue
+		}
+		p, err := tftp.ParsePacket(t.buf[:n])
+		if err != nil {
+			continue
+		}
+		if t.peer == nil {
+			t.peer = from
+		}
+		if t.client.Trace != nil {
+			t.client.Trace(TraceEvent{Peer: from, Packet: p})
+		}
+		return p, nil
+	}
+}
+
+//sameHost is whether a and b have the same IP, or host for addresses that aren't UDP
+func sameHost(a net.Addr, b *net.UDPAddr) bool {
+	if udp, ok := a.(*net.UDPAddr); ok {
+		return udp.IP.Equal(b.IP)
+	}
+	host, _, err := net.SplitHostPort(a.String())
+	return err == nil && host == b.IP.String()
+}
+
+//negotiate applies the options the server acknowledged, returning the transfer size if it sent one or -1.
+//The server may only acknowledge options that were requested, and may only lower sizes.
+func (t *transfer) negotiate(options map[string]string, requested map[string]string) (size int64, err error) {
+	size = -1
+	for name, value := range options {
+		want, ok := requested[name]
+		if !ok {
+			return size, fmt.Errorf("server acknowledged %s, which wasn't requested", name)
+		}
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || n < 0 {
+			return size, fmt.Errorf("server sent a bad %s: %s", name, value)
+		}
+		max, _ := strconv.ParseInt(want, 10, 64)
+		switch name {
+		case "blksize":
+			if n < int64(tftp.MinBlockSize) || n > max {
+				return size, fmt.Errorf("server sent a bad blksize: %s", value)
+			}
+			t.blockSize = int(n)
+			if len(t.buf) < t.blockSize+4 {
+				t.buf = make([]byte, t.blockSize+4)
+			}
+		case "windowsize":
+			if n < 1 || n > max {
+				return size, fmt.Errorf("server sent a bad windowsize: %s", value)
+			}
+			t.windowSize = int(n)
+		case "timeout":
+			if n < 1 {
+				return size, fmt.Errorf("server sent a bad timeout: %s", value)
+			}
+			t.timeout = time.Duration(n) * time.Second
+		case "tsize":
+			size = n
+		}
+	}
+	return size, nil
+}
+
+//fail tells the server the transfer is over because of err
+func (t *transfer) fail(code uint16, err error) {
+	if t.peer == nil {
+		return
+	}
+	p := &tftp.PacketError{Code: code, Msg: err.Error()}
+	if t.client.Trace != nil {
+		t.client.Trace(TraceEvent{Sent: true, Peer: t.peer, Packet: p})
+	}
+	t.conn.WriteTo(p.Serialize(), t.peer)
+}
+
+//abort tells the server the transfer was stopped, if it was stopped on our side
+func (t *transfer) abort(err error) {
+	if err == context.Canceled || err == context.DeadlineExceeded {
+		t.fail(ErrCodeNotDefined, errors.New("transfer cancelled"))
+	}
+}
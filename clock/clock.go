@@ -0,0 +1,200 @@
+//Package clock is a source of time and timers that tests can replace with a Fake one, and move forward
+//by hand instead of waiting
+package clock
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+//Clock tells the time and makes timers
+type Clock interface {
+	Now() time.Time
+	Since(t time.Time) time.Duration
+	After(d time.Duration) <-chan time.Time
+	NewTimer(d time.Duration) Timer
+	//AfterFunc calls f once d has passed
+	AfterFunc(d time.Duration, f func()) Timer
+}
+
+//Timer is a time.Timer from a Clock
+type Timer interface {
+	//C gets the time when the timer fires, it's nil for AfterFunc timers
+	C() <-chan time.Time
+	//Stop stops the timer, returning false if it already fired or was stopped
+	Stop() bool
+	//Reset makes the timer fire after d instead, returning false if it already fired or was stopped
+	Reset(d time.Duration) bool
+}
+
+//Real is the system clock
+var Real Clock = realClock{}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time                         { return time.Now() }
+func (realClock) Since(t time.Time) time.Duration        { return time.Since(t) }
+func (realClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
+
+func (realClock) NewTimer(d time.Duration) Timer {
+	return realTimer{time.NewTimer(d)}
+}
+
+func (realClock) AfterFunc(d time.Duration, f func()) Timer {
+	return realTimer{time.AfterFunc(d, f)}
+}
+
+type realTimer struct {
+	t *time.Timer
+}
+
+func (t realTimer) C() <-chan time.Time        { return t.t.C }
+func (t realTimer) Stop() bool                 { return t.t.Stop() }
+func (t realTimer) Reset(d time.Duration) bool { return t.t.Reset(d) }
+
+//Fake is a Clock whose time only moves when Advance is called.  Timers fire, and AfterFunc functions run,
+//in the order they're due, from the goroutine calling Advance.
+type Fake struct {
+	now    time.Time
+	timers []*fakeTimer
+	sync.Mutex
+}
+
+//NewFake is a Fake clock starting at now
+func NewFake(now time.Time) *Fake {
+	return &Fake{now: now}
+}
+
+func (f *Fake) Now() time.Time {
+	f.Lock()
+	defer f.Unlock()
+	return f.now
+}
+
+func (f *Fake) Since(t time.Time) time.Duration {
+	return f.Now().Sub(t)
+}
+
+func (f *Fake) After(d time.Duration) <-chan time.Time {
+	return f.NewTimer(d).C()
+}
+
+func (f *Fake) NewTimer(d time.Duration) Timer {
+	t := &fakeTimer{clock: f, c: make(chan time.Time, 1)}
+	t.Reset(d)
+	return t
+}
+
+func (f *Fake) AfterFunc(d time.Duration, fn func()) Timer {
+	t := &fakeTimer{clock: f, fn: fn}
+	t.Reset(d)
+	return t
+}
+
+//Pending is how many timers are waiting to fire
+func (f *Fake) Pending() int {
+	f.Lock()
+	defer f.Unlock()
+	return len(f.timers)
+}
+
+//Next is when the next timer fires, false if none are waiting
+func (f *Fake) Next() (time.Time, bool) {
+	f.Lock()
+	defer f.Unlock()
+	if len(f.timers) == 0 {
+		return time.Time{}, false
+	}
+	return f.timers[0].when, true
+}
+
+//Advance moves the time forward by d, firing every timer due by then
+func (f *Fake) Advance(d time.Duration) {
+	f.Lock()
+	end := f.now.Add(d)
+	f.Unlock()
+	for {
+		f.Lock()
+		if len(f.timers) == 0 || f.timers[0].when.After(end) {
+			f.now = end
+			f.Unlock()
+			return
+		}
+		t := f.timers[0]
+		f.timers = f.timers[1:]
+		t.active = false
+		if t.when.After(f.now) {
+			f.now = t.when
+		}
+		now := f.now
+		f.Unlock()
+		//outside the lock, so timers can use the clock
+		t.fire(now)
+	}
+}
+
+//add schedules t, keeping timers sorted by when they fire.  Timers due at the same time fire in the order
+//they were added.
+func (f *Fake) add(t *fakeTimer) {
+	i := sort.Search(len(f.timers), func(i int) bool { return f.timers[i].when.After(t.when) })
+	f.timers = append(f.timers, nil)
+	copy(f.timers[i+1:], f.timers[i:])
+	f.timers[i] = t
+}
+
+func (f *Fake) remove(t *fakeTimer) {
+	for i, other := range f.timers {
+		if other == t {
+			f.timers = append(f.timers[:i], f.timers[i+1:]...)
+			return
+		}
+	}
+}
+
+type fakeTimer struct {
+	clock  *Fake
+	when   time.Time
+	active bool
+	c      chan time.Time
+	fn     func()
+}
+
+func (t *fakeTimer) C() <-chan time.Time {
+	return t.c
+}
+
+func (t *fakeTimer) Stop() bool {
+	t.clock.Lock()
+	defer t.clock.Unlock()
+	wasActive := t.active
+	if t.active {
+		t.clock.remove(t)
+		t.active = false
+	}
+	return wasActive
+}
+
+func (t *fakeTimer) Reset(d time.Duration) bool {
+	t.clock.Lock()
+	defer t.clock.Unlock()
+	wasActive := t.active
+	if t.active {
+		t.clock.remove(t)
+	}
+	t.when = t.clock.now.Add(d)
+	t.active = true
+	t.clock.add(t)
+	return wasActive
+}
+
+func (t *fakeTimer) fire(now time.Time) {
+	if t.fn != nil {
+		t.fn()
+		return
+	}
+	select {
+	case t.c <- now:
+	default:
+	}
+}
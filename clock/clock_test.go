@@ -0,0 +1,80 @@
+package clock
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var start = time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+
+func TestFake_Advance(t *testing.T) {
+	c := NewFake(start)
+	order := []string{}
+	c.AfterFunc(time.Second*2, func() { order = append(order, "2s") })
+	c.AfterFunc(time.Second, func() {
+		order = append(order, "1s")
+		//timers made while firing use the time they fired at
+		c.AfterFunc(time.Millisecond*500, func() { order = append(order, "1.5s") })
+	})
+	late := c.AfterFunc(time.Second*3, func() { order = append(order, "3s") })
+	assert.Equal(t, 3, c.Pending())
+
+	c.Advance(time.Second * 2)
+	assert.Equal(t, []string{"1s", "1.5s", "2s"}, order)
+	assert.Equal(t, start.Add(time.Second*2), c.Now())
+	assert.Equal(t, time.Second, c.Since(start.Add(time.Second)))
+
+	next, ok := c.Next()
+	assert.True(t, ok)
+	assert.Equal(t, start.Add(time.Second*3), next)
+	assert.True(t, late.Stop())
+	assert.False(t, late.Stop())
+	_, ok = c.Next()
+	assert.False(t, ok)
+	c.Advance(time.Second * 5)
+	assert.Equal(t, []string{"1s", "1.5s", "2s"}, order)
+	assert.Equal(t, start.Add(time.Second*7), c.Now())
+}
+
+func TestFake_NewTimer(t *testing.T) {
+	c := NewFake(start)
+	timer := c.NewTimer(time.Second)
+	after := c.After(time.Second * 2)
+	c.Advance(time.Millisecond * 999)
+	select {
+	case <-timer.C():
+		t.Fatal("fired early")
+	default:
+	}
+
+	c.Advance(time.Millisecond)
+	assert.Equal(t, start.Add(time.Second), <-timer.C())
+	assert.False(t, timer.Stop())
+
+	//reset pushes back a timer, firing it again
+	assert.False(t, timer.Reset(time.Second*5))
+	assert.True(t, timer.Reset(time.Second*2))
+	c.Advance(time.Second)
+	assert.Equal(t, start.Add(time.Second*2), <-after)
+	select {
+	case <-timer.C():
+		t.Fatal("reset timer fired early")
+	default:
+	}
+	c.Advance(time.Second)
+	assert.Equal(t, start.Add(time.Second*3), <-timer.C())
+}
+
+func TestReal(t *testing.T) {
+	before := time.Now()
+	assert.False(t, Real.Now().Before(before))
+	assert.True(t, Real.Since(before) >= 0)
+	<-Real.After(time.Millisecond)
+	timer := Real.NewTimer(time.Hour)
+	assert.True(t, timer.Stop())
+	done := make(chan bool)
+	Real.AfterFunc(time.Millisecond, func() { close(done) })
+	<-done
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lienmeat/tftp/client"
+)
+
+//command is one get or put
+type command struct {
+	op     string
+	remote string
+	local  string
+}
+
+//parseCommand parses "get <remote> [local]" or "put <local> [remote]".  Without a second file name, the
+//other end gets the first one's base name.
+func parseCommand(args []string) (command, error) {
+	if len(args) < 2 || len(args) > 3 {
+		return command{}, errors.New("expected get <remote file> [local file] or put <local file> [remote file]")
+	}
+	switch args[0] {
+	case "get":
+		cmd := command{op: "get", remote: args[1], local: path.Base(args[1])}
+		if len(args) == 3 {
+			cmd.local = args[2]
+		}
+		return cmd, nil
+	case "put":
+		cmd := command{op: "put", local: args[1], remote: filepath.Base(args[1])}
+		if len(args) == 3 {
+			cmd.remote = args[2]
+		} else if args[1] == "-" {
+			return command{}, errors.New("put from stdin needs a remote file name")
+		}
+		return cmd, nil
+	}
+	return command{}, fmt.Errorf("unknown command %s, expected get or put", args[0])
+}
+
+//parseBatch parses a get or put on each line of r, skipping blank lines and # comments
+func parseBatch(r io.Reader) ([]command, error) {
+	commands := []command{}
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		cmd, err := parseCommand(fields)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %s", line, err)
+		}
+		commands = append(commands, cmd)
+	}
+	return commands, scanner.Err()
+}
+
+//runner runs commands against one server
+type runner struct {
+	//client is copied for each transfer, with its own Progress and Trace
+	client   client.Client
+	server   string
+	stdin    io.Reader
+	stdout   io.Writer
+	stderr   io.Writer
+	progress bool
+	verbose  bool
+	//live redraws progress lines in place as transfers move, otherwise a line is written as each one ends
+	live bool
+	//stderrLock keeps lines from transfers running at once from mixing
+	stderrLock sync.Mutex
+}
+
+//runAll runs commands, up to parallel at a time, returning each one's error in the same order
+func (r *runner) runAll(ctx context.Context, commands []command, parallel int) []error {
+	errs := make([]error, len(commands))
+	next := make(chan int)
+	wg := sync.WaitGroup{}
+	for i := 0; i < parallel; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range next {
+				errs[i] = r.run(ctx, commands[i])
+			}
+		}()
+	}
+	for i := range commands {
+		next <- i
+	}
+	close(next)
+	wg.Wait()
+	return errs
+}
+
+//run runs cmd, reporting any error on stderr
+func (r *runner) run(ctx context.Context, cmd command) error {
+	c := r.client
+	if r.verbose {
+		c.Trace = r.trace
+	}
+	var p *progress
+	if r.progress {
+		p = &progress{w: r.stderr, lock: &r.stderrLock, name: cmd.remote, live: r.live}
+		c.Progress = p.update
+	}
+	started := time.Now()
+	var n int64
+	var err error
+	if cmd.op == "get" {
+		n, err = r.get(ctx, &c, cmd)
+	} else {
+		n, err = r.put(ctx, &c, cmd)
+	}
+	if p != nil {
+		p.done(n, time.Since(started), err)
+	}
+	if err != nil {
+		r.printf("tftp: %s %s: %s\n", cmd.op, cmd.remote, err)
+	} else if r.verbose {
+		r.printf("%s %s: %d bytes in %s\n", cmd.op, cmd.remote, n, time.Since(started).Round(time.Millisecond))
+	}
+	return err
+}
+
+func (r *runner) get(ctx context.Context, c *client.Client, cmd command) (int64, error) {
+	if cmd.local == "-" {
+		return c.Get(ctx, r.server, cmd.remote, r.stdout)
+	}
+	//download next to the local file and only replace it once the whole file arrived, so a failed get
+	//neither clobbers what was there nor leaves half a file behind
+	f, err := ioutil.TempFile(filepath.Dir(cmd.local), "."+filepath.Base(cmd.local)+".*")
+	if err != nil {
+		return 0, err
+	}
+	n, err := c.Get(ctx, r.server, cmd.remote, f)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		//temp files are only readable by us, keep the mode a file created here would have had
+		mode := os.FileMode(0644)
+		if info, serr := os.Stat(cmd.local); serr == nil {
+			mode = info.Mode().Perm()
+		}
+		if err = os.Chmod(f.Name(), mode); err == nil {
+			err = os.Rename(f.Name(), cmd.local)
+		}
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+	return n, err
+}
+
+func (r *runner) put(ctx context.Context, c *client.Client, cmd command) (int64, error) {
+	if cmd.local == "-" {
+		return c.Put(ctx, r.server, cmd.remote, r.stdin)
+	}
+	f, err := os.Open(cmd.local)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	return c.Put(ctx, r.server, cmd.remote, f)
+}
+
+func (r *runner) printf(format string, args ...interface{}) {
+	r.stderrLock.Lock()
+	defer r.stderrLock.Unlock()
+	fmt.Fprintf(r.stderr, format, args...)
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_parseCommand(t *testing.T) {
+	tests := []struct {
+		name    string
+		args    []string
+		want    command
+		wantErr string
+	}{
+		{"get", []string{"get", "boot/kernel"}, command{op: "get", remote: "boot/kernel", local: "kernel"}, ""},
+		{"get as", []string{"get", "boot/kernel", "/tmp/k"}, command{op: "get", remote: "boot/kernel", local: "/tmp/k"}, ""},
+		{"put", []string{"put", "/etc/motd"}, command{op: "put", remote: "motd", local: "/etc/motd"}, ""},
+		{"put as", []string{"put", "/etc/motd", "banners/motd"}, command{op: "put", remote: "banners/motd", local: "/etc/motd"}, ""},
+		{"put stdin", []string{"put", "-"}, command{}, "put from stdin needs a remote file name"},
+		{"no file", []string{"get"}, command{}, "expected get <remote file> [local file] or put <local file> [remote file]"},
+		{"too many", []string{"get", "a", "b", "c"}, command{}, "expected get <remote file> [local file] or put <local file> [remote file]"},
+		{"unknown", []string{"delete", "a"}, command{}, "unknown command delete, expected get or put"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseCommand(tt.args)
+			if tt.wantErr != "" {
+				assert.EqualError(t, err, tt.wantErr)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func Test_parseBatch(t *testing.T) {
+	got, err := parseBatch(strings.NewReader("# configs\nput switch1.cfg configs/switch1.cfg\n\n  get kernel\n"))
+	assert.NoError(t, err)
+	assert.Equal(t, []command{
+		{op: "put", remote: "configs/switch1.cfg", local: "switch1.cfg"},
+		{op: "get", remote: "kernel", local: "kernel"},
+	}, got)
+
+	_, err = parseBatch(strings.NewReader("get kernel\nmget *\n"))
+	assert.EqualError(t, err, "line 2: unknown command mget, expected get or put")
+}
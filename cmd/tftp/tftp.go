@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/lienmeat/tftp/client"
+)
+
+//Exit codes.  Errors sent by the server exit with exitServerError plus their TFTP error code, so 11 is
+//file not found and 12 an access violation.
+const (
+	exitOK          = 0
+	exitFailed      = 1
+	exitUsage       = 2
+	exitTimeout     = 3
+	exitServerError = 10
+)
+
+const usage = `Usage:
+  tftp [flags] get <server[:port]> <remote file> [local file]
+  tftp [flags] put <server[:port]> <local file> [remote file]
+  tftp [flags] -batch <file> <server[:port]>
+
+A local file of - is stdin or stdout.  Batch files have a get or put on each line, with the same
+arguments minus the server.  Blank lines and lines starting with # are skipped.
+
+Exit codes: 0 ok, 1 local error, 2 usage, 3 timeout, 10 + the TFTP error code for errors from the
+server (11 file not found, 12 access violation, 13 disk full...).  Batches exit with the code of
+the first transfer that failed.
+
+Flags:
+`
+
+func main() {
+	ctx, done := context.WithCancel(context.Background())
+	go func() {
+		sigs := make(chan os.Signal, 1)
+		signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+		<-sigs
+		done()
+	}()
+	os.Exit(run(ctx, os.Args[1:], os.Stdin, os.Stdout, os.Stderr))
+}
+
+//run runs the command line in args, returning the exit code
+func run(ctx context.Context, args []string, stdin io.Reader, stdout io.Writer, stderr io.Writer) int {
+	flags := flag.NewFlagSet("tftp", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	flags.Usage = func() {
+		fmt.Fprint(stderr, usage)
+		flags.PrintDefaults()
+	}
+	mode := flags.String("mode", "octet", "transfer mode, octet or netascii")
+	blksize := flags.Int("blksize", 0, "block size to request with the blksize option, 512 byte blocks without it if 0")
+	windowsize := flags.Int("windowsize", 0, "blocks sent per ack, requested with the windowsize option if more than 1")
+	tsize := flags.Bool("tsize", false, "request the tsize option, so the size of files being got is known")
+	timeout := flags.Duration("timeout", 0, "wait before resending, also requested with the timeout option if set (default 1s)")
+	retries := flags.Int("retries", client.DefaultRetries, "times a packet is resent before giving up")
+	showProgress := flags.Bool("progress", false, "show how far transfers have got on stderr")
+	verbose := flags.Bool("v", false, "trace every packet sent and received on stderr")
+	batch := flags.String("batch", "", "file of gets and puts to run, - for stdin")
+	parallel := flags.Int("parallel", 1, "batch transfers to run at once")
+	if err := flags.Parse(args); err != nil {
+		if err == flag.ErrHelp {
+			return exitOK
+		}
+		return exitUsage
+	}
+	if *mode != "octet" && *mode != "netascii" {
+		fmt.Fprintf(stderr, "unknown mode %s, it must be octet or netascii\n", *mode)
+		return exitUsage
+	}
+	if *parallel < 1 {
+		fmt.Fprintln(stderr, "parallel must be at least 1")
+		return exitUsage
+	}
+
+	var server string
+	var commands []command
+	args = flags.Args()
+	if *batch != "" {
+		if len(args) != 1 {
+			flags.Usage()
+			return exitUsage
+		}
+		server = args[0]
+		in := stdin
+		if *batch != "-" {
+			f, err := os.Open(*batch)
+			if err != nil {
+				fmt.Fprintln(stderr, err)
+				return exitFailed
+			}
+			defer f.Close()
+			in = f
+		}
+		var err error
+		if commands, err = parseBatch(in); err != nil {
+			fmt.Fprintf(stderr, "%s: %s\n", *batch, err)
+			return exitUsage
+		}
+	} else {
+		if len(args) < 2 {
+			flags.Usage()
+			return exitUsage
+		}
+		server = args[1]
+		cmd, err := parseCommand(append([]string{args[0]}, args[2:]...))
+		if err != nil {
+			fmt.Fprintln(stderr, err)
+			flags.Usage()
+			return exitUsage
+		}
+		commands = []command{cmd}
+	}
+
+	r := &runner{
+		client: client.Client{
+			Mode:         *mode,
+			BlockSize:    *blksize,
+			WindowSize:   *windowsize,
+			TransferSize: *tsize,
+			Timeout:      *timeout,
+			Retries:      *retries,
+		},
+		server:   server,
+		stdin:    stdin,
+		stdout:   stdout,
+		stderr:   stderr,
+		progress: *showProgress,
+		verbose:  *verbose,
+		//progress lines are redrawn in place, which only works for one transfer at a time
+		live: *parallel == 1,
+	}
+	errs := r.runAll(ctx, commands, *parallel)
+	for _, err := range errs {
+		if err != nil {
+			return exitCode(err)
+		}
+	}
+	return exitOK
+}
+
+//exitCode is the exit code for a transfer that failed with err
+func exitCode(err error) int {
+	switch err := err.(type) {
+	case nil:
+		return exitOK
+	case *client.Error:
+		return exitServerError + int(err.Code)
+	}
+	if err == client.ErrTimeout {
+		return exitTimeout
+	}
+	return exitFailed
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/lienmeat/tftp"
+	"github.com/lienmeat/tftp/client"
+	"github.com/lienmeat/tftp/udpserver"
+	"github.com/stretchr/testify/assert"
+)
+
+var (
+	serverOnce sync.Once
+	server     *tftp.TFTPProtocolHandler
+)
+
+//testServer serves a handler on 127.0.0.1:6060, and a read-only server on 127.0.0.1:6061, for the rest of the
+//tests, rather than starting and stopping one on the same ports for each test
+func testServer() *tftp.TFTPProtocolHandler {
+	serverOnce.Do(func() {
+		server = tftp.NewTFTPProtocolHandler(6900, 7000)
+		ro, _ := server.NewVirtualServer("ro")
+		ro.ReadOnly = true
+		health := &udpserver.Health{}
+		go udpserver.ServeWithHealth(context.Background(), []udpserver.Listener{
+			{Address: "127.0.0.1:6060", Handler: server},
+			{Address: "127.0.0.1:6061", Handler: ro},
+		}, health)
+		for i := 0; i < 100 && !health.Alive(); i++ {
+			time.Sleep(time.Millisecond * 10)
+		}
+	})
+	return server
+}
+
+func Test_run(t *testing.T) {
+	handler := testServer()
+	dir, err := ioutil.TempDir("", "tftp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	kernel := bytes.Repeat([]byte("kernel"), 200)
+	handler.Files.Set(tftp.File{Filename: "boot/kernel", Data: kernel})
+	config := filepath.Join(dir, "switch1.cfg")
+	ioutil.WriteFile(config, []byte("hostname switch1\n"), 0644)
+	existing := filepath.Join(dir, "existing")
+	ioutil.WriteFile(existing, []byte("mine"), 0600)
+
+	tests := []struct {
+		name       string
+		args       []string
+		stdin      string
+		want       int
+		wantStdout string
+		wantStderr string
+		check      func(t *testing.T)
+	}{
+		{
+			name: "get",
+			args: []string{"get", "127.0.0.1:6060", "boot/kernel", filepath.Join(dir, "kernel")},
+			check: func(t *testing.T) {
+				got, _ := ioutil.ReadFile(filepath.Join(dir, "kernel"))
+				assert.Equal(t, kernel, got)
+			},
+		},
+		{
+			name:       "get to stdout",
+			args:       []string{"-blksize", "1024", "-tsize", "get", "127.0.0.1:6060", "boot/kernel", "-"},
+			wantStdout: string(kernel),
+		},
+		{
+			name: "put",
+			args: []string{"-mode", "netascii", "put", "127.0.0.1:6060", config},
+			check: func(t *testing.T) {
+				var f tftp.File
+				for i := 0; i < 100; i++ {
+					if f, _ = handler.Files.Get("switch1.cfg"); f.Filename != "" {
+						break
+					}
+					time.Sleep(time.Millisecond * 10)
+				}
+				assert.Equal(t, "hostname switch1\r\n", string(f.Data))
+			},
+		},
+		{
+			name:  "put from stdin",
+			args:  []string{"put", "127.0.0.1:6060", "-", "motd"},
+			stdin: "welcome",
+			check: func(t *testing.T) {
+				var f tftp.File
+				for i := 0; i < 100; i++ {
+					if f, _ = handler.Files.Get("motd"); f.Filename != "" {
+						break
+					}
+					time.Sleep(time.Millisecond * 10)
+				}
+				assert.Equal(t, "welcome", string(f.Data))
+			},
+		},
+		{
+			name:       "file not found",
+			args:       []string{"get", "127.0.0.1:6060", "missing", filepath.Join(dir, "missing")},
+			want:       11,
+			wantStderr: "tftp: get missing: server error 1: file not found\n",
+			check: func(t *testing.T) {
+				_, err := os.Stat(filepath.Join(dir, "missing"))
+				assert.True(t, os.IsNotExist(err), "the partial file should be removed")
+			},
+		},
+		{
+			name:       "file not found keeps the local file",
+			args:       []string{"get", "127.0.0.1:6060", "missing", existing},
+			want:       11,
+			wantStderr: "tftp: get missing: server error 1: file not found\n",
+			check: func(t *testing.T) {
+				got, _ := ioutil.ReadFile(existing)
+				assert.Equal(t, "mine", string(got))
+				partial, _ := filepath.Glob(filepath.Join(dir, ".existing.*"))
+				assert.Empty(t, partial)
+			},
+		},
+		{
+			name: "get replaces the local file",
+			args: []string{"get", "127.0.0.1:6060", "boot/kernel", existing},
+			check: func(t *testing.T) {
+				got, _ := ioutil.ReadFile(existing)
+				assert.Equal(t, kernel, got)
+				info, _ := os.Stat(existing)
+				assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+			},
+		},
+		{
+			name:       "access violation",
+			args:       []string{"put", "127.0.0.1:6061", config},
+			want:       12,
+			wantStderr: "tftp: put switch1.cfg: server error 2: access violation\n",
+		},
+		{
+			name:       "local file missing",
+			args:       []string{"put", "127.0.0.1:6060", filepath.Join(dir, "nothing")},
+			want:       1,
+			wantStderr: "tftp: put nothing: open " + filepath.Join(dir, "nothing") + ": no such file or directory\n",
+		},
+		{name: "no server", args: []string{"get"}, want: 2},
+		{name: "unknown command", args: []string{"fetch", "127.0.0.1:6060", "kernel"}, want: 2},
+		{name: "unknown mode", args: []string{"-mode", "mail", "get", "127.0.0.1:6060", "kernel"}, want: 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stdout := &bytes.Buffer{}
+			stderr := &bytes.Buffer{}
+			got := run(context.Background(), tt.args, strings.NewReader(tt.stdin), stdout, stderr)
+			assert.Equal(t, tt.want, got, stderr.String())
+			if tt.wantStdout != "" {
+				assert.Equal(t, tt.wantStdout, stdout.String())
+			}
+			if tt.wantStderr != "" {
+				assert.Equal(t, tt.wantStderr, stderr.String())
+			}
+			if tt.check != nil {
+				tt.check(t)
+			}
+		})
+	}
+}
+
+func Test_run_batch(t *testing.T) {
+	handler := testServer()
+	dir, err := ioutil.TempDir("", "tftp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for _, name := range []string{"a", "b", "c"} {
+		handler.Files.Set(tftp.File{Filename: name, Data: []byte("file " + name)})
+	}
+
+	batch := strings.Join([]string{
+		"# kernels",
+		"get a " + filepath.Join(dir, "a"),
+		"",
+		"get missing " + filepath.Join(dir, "missing"),
+		"get b " + filepath.Join(dir, "b"),
+		"get c " + filepath.Join(dir, "c"),
+	}, "\n")
+	stderr := &bytes.Buffer{}
+	got := run(context.Background(), []string{"-batch", "-", "-parallel", "2", "-progress", "127.0.0.1:6060"},
+		strings.NewReader(batch), &bytes.Buffer{}, stderr)
+	//every transfer runs, and the exit code is the failure's
+	assert.Equal(t, 11, got)
+	for _, name := range []string{"a", "b", "c"} {
+		data, _ := ioutil.ReadFile(filepath.Join(dir, name))
+		assert.Equal(t, "file "+name, string(data))
+	}
+	assert.Contains(t, stderr.String(), "missing 0 B failed\n")
+	assert.Contains(t, stderr.String(), "tftp: get missing: server error 1: file not found\n")
+
+	got = run(context.Background(), []string{"-batch", "-", "127.0.0.1:6060"}, strings.NewReader("get"), &bytes.Buffer{}, stderr)
+	assert.Equal(t, 2, got)
+}
+
+func Test_run_timeout(t *testing.T) {
+	//a server that never answers
+	conn, err := net.ListenPacket("udp", "127.0.0.1:6062")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer conn.Close()
+
+	stderr := &bytes.Buffer{}
+	got := run(context.Background(), []string{"-v", "-timeout", "10ms", "-retries", "1", "get", "127.0.0.1:6062", "kernel", "-"},
+		nil, &bytes.Buffer{}, stderr)
+	assert.Equal(t, 3, got)
+	assert.Equal(t, strings.Join([]string{
+		`sent     RRQ "kernel" octet timeout=1 to 127.0.0.1:6062`,
+		`resent   RRQ "kernel" octet timeout=1 to 127.0.0.1:6062`,
+		`tftp: get kernel: timed out waiting for the server`,
+		``,
+	}, "\n"), stderr.String())
+}
+
+func Test_exitCode(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want int
+	}{
+		{"ok", nil, 0},
+		{"not defined", &client.Error{Code: client.ErrCodeNotDefined}, 10},
+		{"disk full", &client.Error{Code: client.ErrCodeDiskFull}, 13},
+		{"option negotiation", &client.Error{Code: client.ErrCodeOptionNegotiation}, 18},
+		{"timeout", client.ErrTimeout, 3},
+		{"local", errors.New("permission denied"), 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, exitCode(tt.err))
+		})
+	}
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lienmeat/tftp"
+	"github.com/lienmeat/tftp/client"
+)
+
+//trace writes a packet sent or received to stderr
+func (r *runner) trace(e client.TraceEvent) {
+	direction := "received"
+	preposition := "from"
+	if e.Sent {
+		direction = "sent"
+		preposition = "to"
+		if e.Retransmit {
+			direction = "resent"
+		}
+	}
+	r.printf("%-8s %s %s %s\n", direction, describe(e.Packet), preposition, e.Peer)
+}
+
+//describe is a one line summary of p
+func describe(p tftp.Packet) string {
+	switch p := p.(type) {
+	case *tftp.PacketRequest:
+		op := "RRQ"
+		if p.Op == tftp.OpWRQ {
+			op = "WRQ"
+		}
+		return strings.TrimSpace(fmt.Sprintf("%s %q %s %s", op, p.Filename, p.Mode, describeOptions(p.Options)))
+	case *tftp.PacketData:
+		return fmt.Sprintf("DATA block %d, %d bytes", p.BlockNum, len(p.Data))
+	case *tftp.PacketAck:
+		return fmt.Sprintf("ACK block %d", p.BlockNum)
+	case *tftp.PacketError:
+		return fmt.Sprintf("ERROR %d %q", p.Code, p.Msg)
+	case *tftp.PacketOAck:
+		return strings.TrimSpace("OACK " + describeOptions(p.Options))
+	}
+	return fmt.Sprintf("%T", p)
+}
+
+//describeOptions lists options as name=value, sorted by name
+func describeOptions(options map[string]string) string {
+	names := make([]string, 0, len(options))
+	for name := range options {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for i, name := range names {
+		names[i] = name + "=" + options[name]
+	}
+	return strings.Join(names, " ")
+}
+
+//progressInterval is how often a live progress line is redrawn
+const progressInterval = time.Millisecond * 100
+
+//progress shows how far a transfer has got
+type progress struct {
+	w    io.Writer
+	lock *sync.Mutex
+	name string
+	//live redraws the line as the transfer moves, otherwise it's only written when the transfer ends
+	live  bool
+	size  int64
+	drawn time.Time
+}
+
+func (p *progress) update(transferred int64, size int64) {
+	p.size = size
+	if !p.live || time.Since(p.drawn) < progressInterval {
+		return
+	}
+	p.drawn = time.Now()
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	fmt.Fprintf(p.w, "\r%s", p.line(transferred))
+}
+
+func (p *progress) done(transferred int64, took time.Duration, err error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	status := "in " + took.Round(time.Millisecond).String()
+	if err != nil {
+		status = "failed"
+	}
+	if p.live {
+		fmt.Fprint(p.w, "\r")
+	}
+	fmt.Fprintf(p.w, "%s %s\n", p.line(transferred), status)
+}
+
+//line is the name, bytes moved, and the size and percentage done if the size is known
+func (p *progress) line(transferred int64) string {
+	if p.size <= 0 {
+		return fmt.Sprintf("%s %s", p.name, formatBytes(transferred))
+	}
+	return fmt.Sprintf("%s %s / %s %3d%%", p.name, formatBytes(transferred), formatBytes(p.size), transferred*100/p.size)
+}
+
+//formatBytes is n in B, KiB, MiB or GiB
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	value := float64(n) / unit
+	for _, suffix := range []string{"KiB", "MiB"} {
+		if value < unit {
+			return fmt.Sprintf("%.1f %s", value, suffix)
+		}
+		value /= unit
+	}
+	return fmt.Sprintf("%.1f GiB", value)
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/lienmeat/tftp"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_describe(t *testing.T) {
+	tests := []struct {
+		name string
+		p    tftp.Packet
+		want string
+	}{
+		{"rrq", &tftp.PacketRequest{Op: tftp.OpRRQ, Filename: "kernel", Mode: "octet"}, `RRQ "kernel" octet`},
+		{
+			"wrq with options",
+			&tftp.PacketRequest{Op: tftp.OpWRQ, Filename: "a b", Mode: "netascii", Options: map[string]string{"tsize": "10", "blksize": "1024"}},
+			`WRQ "a b" netascii blksize=1024 tsize=10`,
+		},
+		{"data", &tftp.PacketData{BlockNum: 3, Data: make([]byte, 512)}, "DATA block 3, 512 bytes"},
+		{"ack", &tftp.PacketAck{BlockNum: 3}, "ACK block 3"},
+		{"error", &tftp.PacketError{Code: 1, Msg: "file not found"}, `ERROR 1 "file not found"`},
+		{"oack", &tftp.PacketOAck{Options: map[string]string{"windowsize": "4"}}, "OACK windowsize=4"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, describe(tt.p))
+		})
+	}
+}
+
+func Test_progress(t *testing.T) {
+	buf := &bytes.Buffer{}
+	p := &progress{w: buf, lock: &sync.Mutex{}, name: "kernel", live: true}
+	p.update(512, 2048)
+	//too soon to redraw
+	p.update(1024, 2048)
+	p.done(2048, time.Millisecond*1500, nil)
+	assert.Equal(t, "\rkernel 512 B / 2.0 KiB  25%\rkernel 2.0 KiB / 2.0 KiB 100% in 1.5s\n", buf.String())
+
+	buf.Reset()
+	p = &progress{w: buf, lock: &sync.Mutex{}, name: "config"}
+	p.update(100, -1)
+	p.done(100, time.Second, errors.New("timed out"))
+	assert.Equal(t, "config 100 B failed\n", buf.String())
+}
+
+func Test_formatBytes(t *testing.T) {
+	assert.Equal(t, "0 B", formatBytes(0))
+	assert.Equal(t, "1023 B", formatBytes(1023))
+	assert.Equal(t, "1.5 KiB", formatBytes(1536))
+	assert.Equal(t, "10.0 MiB", formatBytes(10*1024*1024))
+	assert.Equal(t, "3.0 GiB", formatBytes(3*1024*1024*1024))
+}
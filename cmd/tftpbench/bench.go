@@ -0,0 +1,292 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"math/rand"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/lienmeat/tftp"
+	"github.com/lienmeat/tftp/client"
+	"github.com/lienmeat/tftp/udpserver"
+)
+
+//result is how one transfer went
+type result struct {
+	put         bool
+	bytes       int64
+	took        time.Duration
+	retransmits int
+	err         error
+}
+
+//bench runs transfers and collects their results
+type bench struct {
+	cfg benchConfig
+	//data is the content of a file of each size, read by puts and compared against by gets
+	data map[int64][]byte
+	//next is the number of the next transfer to start
+	next int64
+}
+
+func newBench(cfg benchConfig) *bench {
+	b := &bench{cfg: cfg, data: map[int64][]byte{}}
+	for _, size := range cfg.Sizes {
+		b.data[size] = benchData(size)
+	}
+	return b
+}
+
+//benchData is size bytes of a repeating pattern
+func benchData(size int64) []byte {
+	pattern := []byte("0123456789abcdefghijklmnopqrstuvwxyz\n")
+	data := bytes.Repeat(pattern, int(size)/len(pattern)+1)
+	return data[:size]
+}
+
+//benchFile is the name of the file gets of size read
+func benchFile(size int64) string {
+	return "tftpbench-" + strconv.FormatInt(size, 10)
+}
+
+//serve runs an in-memory server on cfg.Address, with the files gets read already in it
+func serve(ctx context.Context, cfg benchConfig) (stop func(), err error) {
+	ctx, stop = context.WithCancel(ctx)
+	handler := tftp.NewTFTPProtocolHandler(int32(cfg.MinPort), int32(cfg.MaxPort))
+	for _, size := range cfg.Sizes {
+		handler.Files.Set(tftp.File{Filename: benchFile(size), Data: benchData(size), Modified: time.Now()})
+	}
+	health := &udpserver.Health{}
+	go udpserver.ServeWithHealth(ctx, []udpserver.Listener{{Address: cfg.Address, Handler: handler}}, health)
+	for i := 0; i < 100 && !health.Alive(); i++ {
+		time.Sleep(time.Millisecond * 10)
+	}
+	if !health.Alive() {
+		stop()
+		return nil, fmt.Errorf("couldn't listen on %s", cfg.Address)
+	}
+	return stop, nil
+}
+
+//setup puts a file of each size on the server for gets to read
+func (b *bench) setup(ctx context.Context) error {
+	c := &client.Client{Timeout: b.cfg.Timeout, Retries: b.cfg.Retries}
+	for _, size := range b.cfg.Sizes {
+		if _, err := c.Put(ctx, b.cfg.Address, benchFile(size), bytes.NewReader(b.data[size])); err != nil {
+			return fmt.Errorf("put %s: %s", benchFile(size), err)
+		}
+	}
+	return nil
+}
+
+//run runs transfers until enough are done or time is up, and reports on them
+func (b *bench) run(ctx context.Context) *report {
+	if b.cfg.Duration > 0 {
+		var cancel func()
+		ctx, cancel = context.WithTimeout(ctx, b.cfg.Duration)
+		defer cancel()
+	}
+	results := make(chan result, b.cfg.Concurrency)
+	wg := sync.WaitGroup{}
+	started := time.Now()
+	for worker := 0; worker < b.cfg.Concurrency; worker++ {
+		wg.Add(1)
+		go func(worker int) {
+			defer wg.Done()
+			for ctx.Err() == nil {
+				n := atomic.AddInt64(&b.next, 1) - 1
+				if b.cfg.Requests > 0 && n >= int64(b.cfg.Requests) {
+					return
+				}
+				r := b.transfer(ctx, n, worker)
+				//transfers cut off by the end of the run aren't counted
+				if ctx.Err() != nil && r.err == ctx.Err() {
+					return
+				}
+				results <- r
+			}
+		}(worker)
+	}
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+	all := []result{}
+	for r := range results {
+		all = append(all, r)
+	}
+	return newReport(all, time.Since(started))
+}
+
+//transfer runs transfer n.  What it does, and which packets are lost, only depend on n and the seed.
+func (b *bench) transfer(ctx context.Context, n int64, worker int) result {
+	rnd := rand.New(rand.NewSource(b.cfg.Seed + n))
+	put := rnd.Float64() < b.cfg.Puts
+	size := b.cfg.Sizes[rnd.Intn(len(b.cfg.Sizes))]
+	blockSize := b.cfg.BlockSizes[rnd.Intn(len(b.cfg.BlockSizes))]
+	lossSeed := rnd.Int63()
+
+	r := result{put: put}
+	c := &client.Client{
+		WindowSize: b.cfg.WindowSize,
+		Timeout:    b.cfg.Timeout,
+		Retries:    b.cfg.Retries,
+		Trace: func(e client.TraceEvent) {
+			if e.Retransmit {
+				r.retransmits++
+			}
+		},
+	}
+	if blockSize != int(tftp.BlockSize) {
+		c.BlockSize = blockSize
+	}
+	if b.cfg.Loss > 0 {
+		c.ListenPacket = func() (net.PacketConn, error) {
+			conn, err := net.ListenPacket("udp", ":0")
+			if err != nil {
+				return nil, err
+			}
+			return newLossyConn(conn, b.cfg.Loss, lossSeed), nil
+		}
+	}
+
+	started := time.Now()
+	if put {
+		//each worker puts to its own file, so puts never wait on each other's write locks
+		r.bytes, r.err = c.Put(ctx, b.cfg.Address, fmt.Sprintf("tftpbench-put-%d", worker), bytes.NewReader(b.data[size]))
+	} else {
+		buf := &bytes.Buffer{}
+		r.bytes, r.err = c.Get(ctx, b.cfg.Address, benchFile(size), buf)
+		if r.err == nil && !bytes.Equal(buf.Bytes(), b.data[size]) {
+			r.err = fmt.Errorf("got %d bytes of %s that don't match what was expected", buf.Len(), benchFile(size))
+		}
+	}
+	r.took = time.Since(started)
+	return r
+}
+
+//lossyConn drops a fraction of the packets sent and received on a connection
+type lossyConn struct {
+	net.PacketConn
+	loss float64
+	rnd  *rand.Rand
+	lock sync.Mutex
+}
+
+func newLossyConn(conn net.PacketConn, loss float64, seed int64) *lossyConn {
+	return &lossyConn{PacketConn: conn, loss: loss, rnd: rand.New(rand.NewSource(seed))}
+}
+
+func (c *lossyConn) drop() bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.rnd.Float64() < c.loss
+}
+
+func (c *lossyConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	for {
+		n, addr, err := c.PacketConn.ReadFrom(p)
+		if err != nil || !c.drop() {
+			return n, addr, err
+		}
+	}
+}
+
+func (c *lossyConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	if c.drop() {
+		//lost on the way, as far as the sender can tell it was sent
+		return len(p), nil
+	}
+	return c.PacketConn.WriteTo(p, addr)
+}
+
+//sizeList is a comma separated list of sizes, in bytes or with a KB, MB or GB suffix
+type sizeList []int64
+
+func (l *sizeList) String() string {
+	parts := make([]string, len(*l))
+	for i, size := range *l {
+		parts[i] = formatSize(size)
+	}
+	return strings.Join(parts, ",")
+}
+
+func (l *sizeList) Set(s string) error {
+	sizes := sizeList{}
+	for _, part := range strings.Split(s, ",") {
+		size, err := parseSize(part)
+		if err != nil {
+			return err
+		}
+		sizes = append(sizes, size)
+	}
+	*l = sizes
+	return nil
+}
+
+var sizeUnits = []struct {
+	suffix string
+	size   int64
+}{
+	{"GB", 1 << 30},
+	{"MB", 1 << 20},
+	{"KB", 1 << 10},
+	{"B", 1},
+}
+
+func parseSize(size string) (int64, error) {
+	s := strings.ToUpper(strings.TrimSpace(size))
+	mult := int64(1)
+	for _, u := range sizeUnits {
+		if strings.HasSuffix(s, u.suffix) {
+			s = strings.TrimSpace(strings.TrimSuffix(s, u.suffix))
+			mult = u.size
+			break
+		}
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size %q", strings.TrimSpace(size))
+	}
+	return n * mult, nil
+}
+
+//formatSize is size with the largest unit it's a whole number of
+func formatSize(size int64) string {
+	for _, u := range sizeUnits {
+		if size >= u.size && size%u.size == 0 {
+			return strconv.FormatInt(size/u.size, 10) + u.suffix
+		}
+	}
+	return strconv.FormatInt(size, 10) + "B"
+}
+
+//intList is a comma separated list of numbers
+type intList []int
+
+func (l *intList) String() string {
+	parts := make([]string, len(*l))
+	for i, n := range *l {
+		parts[i] = strconv.Itoa(n)
+	}
+	return strings.Join(parts, ",")
+}
+
+func (l *intList) Set(s string) error {
+	ns := intList{}
+	for _, part := range strings.Split(s, ",") {
+		n, err := strconv.Atoi(strings.TrimSpace(part))
+		if err != nil {
+			return fmt.Errorf("invalid number %q", part)
+		}
+		ns = append(ns, n)
+	}
+	*l = ns
+	return nil
+}
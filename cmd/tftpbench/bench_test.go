@@ -0,0 +1,83 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_sizeList(t *testing.T) {
+	l := sizeList{}
+	assert.NoError(t, l.Set("512, 1KB,64kb,1MB,1536"))
+	assert.Equal(t, sizeList{512, 1024, 64 << 10, 1 << 20, 1536}, l)
+	assert.Equal(t, "512B,1KB,64KB,1MB,1536B", l.String())
+	assert.EqualError(t, l.Set("1KB,lots"), `invalid size "lots"`)
+	assert.EqualError(t, l.Set("-1"), `invalid size "-1"`)
+}
+
+func Test_intList(t *testing.T) {
+	l := intList{}
+	assert.NoError(t, l.Set("512,1428"))
+	assert.Equal(t, intList{512, 1428}, l)
+	assert.Equal(t, "512,1428", l.String())
+	assert.EqualError(t, l.Set("512,big"), `invalid number "big"`)
+}
+
+func Test_benchData(t *testing.T) {
+	assert.Equal(t, "0123", string(benchData(4)))
+	assert.Len(t, benchData(100000), 100000)
+	assert.Equal(t, "tftpbench-1024", benchFile(1024))
+}
+
+func Test_lossyConn(t *testing.T) {
+	server, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	lossy := newLossyConn(conn, 0.5, 1)
+	defer lossy.Close()
+
+	//sends are dropped about half the time, the same ones for the same seed
+	sent := 0
+	for i := 0; i < 100; i++ {
+		lossy.WriteTo([]byte{byte(i)}, server.LocalAddr())
+	}
+	buf := make([]byte, 10)
+	for {
+		server.SetReadDeadline(time.Now().Add(time.Millisecond * 50))
+		if _, _, err := server.ReadFrom(buf); err != nil {
+			break
+		}
+		sent++
+	}
+	assert.True(t, sent > 25 && sent < 75, "%d of 100 sent", sent)
+	again := newLossyConn(conn, 0.5, 1)
+	drops := 0
+	for i := 0; i < 100; i++ {
+		if again.drop() {
+			drops++
+		}
+	}
+	assert.Equal(t, 100-sent, drops)
+
+	//so are packets received
+	received := 0
+	for i := 0; i < 100; i++ {
+		server.WriteTo([]byte{byte(i)}, conn.LocalAddr())
+	}
+	for {
+		lossy.SetReadDeadline(time.Now().Add(time.Millisecond * 50))
+		if _, _, err := lossy.ReadFrom(buf); err != nil {
+			break
+		}
+		received++
+	}
+	assert.True(t, received > 25 && received < 75, "%d of 100 received", received)
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"time"
+)
+
+//report sums up a run's results
+type report struct {
+	Transfers   int     `json:"transfers"`
+	Gets        int     `json:"gets"`
+	Puts        int     `json:"puts"`
+	Failed      int     `json:"failed"`
+	Bytes       int64   `json:"bytes"`
+	Seconds     float64 `json:"seconds"`
+	BytesPerSec float64 `json:"bytesPerSecond"`
+	PerSec      float64 `json:"transfersPerSecond"`
+	Retransmits int     `json:"retransmits"`
+	//Latency percentiles of transfers that succeeded, in milliseconds
+	Latency map[string]float64 `json:"latencyMs"`
+	//Failures counts failed transfers by error
+	Failures map[string]int `json:"failures,omitempty"`
+}
+
+//percentiles are the latency percentiles reported
+var percentiles = []struct {
+	name string
+	p    float64
+}{
+	{"p50", 50},
+	{"p90", 90},
+	{"p99", 99},
+	{"max", 100},
+}
+
+func newReport(results []result, took time.Duration) *report {
+	r := &report{
+		Transfers: len(results),
+		Seconds:   took.Seconds(),
+		Latency:   map[string]float64{},
+		Failures:  map[string]int{},
+	}
+	durations := []time.Duration{}
+	for _, result := range results {
+		if result.put {
+			r.Puts++
+		} else {
+			r.Gets++
+		}
+		r.Bytes += result.bytes
+		r.Retransmits += result.retransmits
+		if result.err != nil {
+			r.Failed++
+			r.Failures[result.err.Error()]++
+			continue
+		}
+		durations = append(durations, result.took)
+	}
+	if r.Seconds > 0 {
+		r.BytesPerSec = float64(r.Bytes) / r.Seconds
+		r.PerSec = float64(r.Transfers) / r.Seconds
+	}
+	sort.Slice(durations, func(i, j int) bool { return durations[i] < durations[j] })
+	for _, p := range percentiles {
+		r.Latency[p.name] = float64(percentile(durations, p.p)) / float64(time.Millisecond)
+	}
+	return r
+}
+
+//percentile is the nearest rank p percentile of sorted durations, 0 if there are none
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	rank := int(p/100*float64(len(sorted))+0.5) - 1
+	if rank < 0 {
+		rank = 0
+	}
+	if rank >= len(sorted) {
+		rank = len(sorted) - 1
+	}
+	return sorted[rank]
+}
+
+func (r *report) write(w io.Writer) {
+	fmt.Fprintf(w, "transfers    %d (%d gets, %d puts), %d failed\n", r.Transfers, r.Gets, r.Puts, r.Failed)
+	fmt.Fprintf(w, "duration     %.2fs\n", r.Seconds)
+	fmt.Fprintf(w, "throughput   %.2f MiB/s, %.1f transfers/s\n", r.BytesPerSec/(1<<20), r.PerSec)
+	fmt.Fprint(w, "latency     ")
+	for _, p := range percentiles {
+		fmt.Fprintf(w, " %s %.1fms", p.name, r.Latency[p.name])
+	}
+	fmt.Fprintln(w)
+	fmt.Fprintf(w, "retransmits  %d\n", r.Retransmits)
+	errs := make([]string, 0, len(r.Failures))
+	for err := range r.Failures {
+		errs = append(errs, err)
+	}
+	sort.Strings(errs)
+	for _, err := range errs {
+		fmt.Fprintf(w, "failures     %d: %s\n", r.Failures[err], err)
+	}
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_percentile(t *testing.T) {
+	sorted := []time.Duration{}
+	for i := 1; i <= 100; i++ {
+		sorted = append(sorted, time.Duration(i)*time.Millisecond)
+	}
+	tests := []struct {
+		name   string
+		sorted []time.Duration
+		p      float64
+		want   time.Duration
+	}{
+		{"median", sorted, 50, time.Millisecond * 50},
+		{"p99", sorted, 99, time.Millisecond * 99},
+		{"max", sorted, 100, time.Millisecond * 100},
+		{"min", sorted, 0, time.Millisecond},
+		{"one", sorted[:1], 90, time.Millisecond},
+		{"none", nil, 50, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, percentile(tt.sorted, tt.p))
+		})
+	}
+}
+
+func Test_report(t *testing.T) {
+	timeout := errors.New("timed out waiting for the server")
+	r := newReport([]result{
+		{put: true, bytes: 1 << 20, took: time.Millisecond * 10, retransmits: 1},
+		{bytes: 1 << 20, took: time.Millisecond * 20},
+		{bytes: 512, took: time.Second, retransmits: 5, err: timeout},
+		{put: true, took: time.Second, retransmits: 5, err: timeout},
+	}, time.Second)
+	assert.Equal(t, 4, r.Transfers)
+	assert.Equal(t, 2, r.Gets)
+	assert.Equal(t, 2, r.Puts)
+	assert.Equal(t, 2, r.Failed)
+	assert.Equal(t, 11, r.Retransmits)
+	assert.Equal(t, map[string]int{"timed out waiting for the server": 2}, r.Failures)
+	//failed transfers aren't in the latencies
+	assert.Equal(t, map[string]float64{"p50": 10, "p90": 20, "p99": 20, "max": 20}, r.Latency)
+
+	buf := &bytes.Buffer{}
+	r.write(buf)
+	assert.Equal(t, `transfers    4 (2 gets, 2 puts), 2 failed
+duration     1.00s
+throughput   2.00 MiB/s, 4.0 transfers/s
+latency      p50 10.0ms p90 20.0ms p99 20.0ms max 20.0ms
+retransmits  11
+failures     2: timed out waiting for the server
+`, buf.String())
+}
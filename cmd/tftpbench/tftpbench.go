@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/lienmeat/tftp"
+)
+
+const usage = `Usage:
+  tftpbench [flags]
+
+Runs a mix of concurrent gets and puts against a TFTP server and reports throughput, latency
+percentiles, retransmits and failures.  Unless -setup=false, a file of each size is put first, for
+the gets to read.  With -serve, the server is run in process on -address, so results only depend on
+this machine.  Picks and packet loss are seeded, so runs with the same flags do the same transfers.
+
+Flags:
+`
+
+func main() {
+	ctx, done := context.WithCancel(context.Background())
+	go func() {
+		sigs := make(chan os.Signal, 1)
+		signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+		<-sigs
+		done()
+	}()
+	os.Exit(run(ctx, os.Args[1:], os.Stdout, os.Stderr))
+}
+
+//run runs the benchmark described by args, returning the exit code
+func run(ctx context.Context, args []string, stdout io.Writer, stderr io.Writer) int {
+	cfg := defaultBenchConfig()
+	flags := flag.NewFlagSet("tftpbench", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	flags.Usage = func() {
+		fmt.Fprint(stderr, usage)
+		flags.PrintDefaults()
+	}
+	flags.StringVar(&cfg.Address, "address", cfg.Address, "server to benchmark, host:port")
+	flags.BoolVar(&cfg.Serve, "serve", cfg.Serve, "run an in-memory server on -address to benchmark")
+	flags.IntVar(&cfg.MinPort, "minPort", cfg.MinPort, "lowest transfer port for the -serve server")
+	flags.IntVar(&cfg.MaxPort, "maxPort", cfg.MaxPort, "highest transfer port for the -serve server")
+	flags.BoolVar(&cfg.Setup, "setup", cfg.Setup, "put the files the gets read before starting")
+	flags.IntVar(&cfg.Concurrency, "concurrency", cfg.Concurrency, "transfers to run at once")
+	flags.IntVar(&cfg.Requests, "requests", cfg.Requests, "transfers to run, 0 to run until -duration is up")
+	flags.DurationVar(&cfg.Duration, "duration", cfg.Duration, "longest to run for, 0 for no limit")
+	flags.Float64Var(&cfg.Puts, "puts", cfg.Puts, "fraction of transfers that are puts, 0 to 1")
+	flags.Var(&cfg.Sizes, "sizes", "comma separated file sizes to pick from, like 1KB,64KB,1MB")
+	flags.Var(&cfg.BlockSizes, "blksize", "comma separated block sizes to pick from, 512 is sent without the blksize option")
+	flags.IntVar(&cfg.WindowSize, "windowsize", cfg.WindowSize, "blocks per ack, requested with the windowsize option if more than 1")
+	flags.Float64Var(&cfg.Loss, "loss", cfg.Loss, "fraction of packets dropped in each direction, 0 to 1")
+	flags.DurationVar(&cfg.Timeout, "timeout", cfg.Timeout, "how long the client waits before resending")
+	flags.IntVar(&cfg.Retries, "retries", cfg.Retries, "times the client resends a packet before giving up")
+	flags.Int64Var(&cfg.Seed, "seed", cfg.Seed, "seed for picking transfers and dropping packets")
+	asJSON := flags.Bool("json", false, "write the report as JSON")
+	if err := flags.Parse(args); err != nil {
+		if err == flag.ErrHelp {
+			return 0
+		}
+		return 2
+	}
+	if err := cfg.validate(); err != nil {
+		fmt.Fprintln(stderr, err)
+		return 2
+	}
+
+	if cfg.Serve {
+		stop, err := serve(ctx, cfg)
+		if err != nil {
+			fmt.Fprintln(stderr, err)
+			return 1
+		}
+		defer stop()
+	}
+	b := newBench(cfg)
+	if cfg.Setup {
+		if err := b.setup(ctx); err != nil {
+			fmt.Fprintf(stderr, "setup failed: %s\n", err)
+			return 1
+		}
+	}
+	report := b.run(ctx)
+	if *asJSON {
+		enc := json.NewEncoder(stdout)
+		enc.SetIndent("", "  ")
+		enc.Encode(report)
+	} else {
+		report.write(stdout)
+	}
+	if report.Failed > 0 {
+		return 1
+	}
+	return 0
+}
+
+//benchConfig describes a benchmark run
+type benchConfig struct {
+	Address     string
+	Serve       bool
+	MinPort     int
+	MaxPort     int
+	Setup       bool
+	Concurrency int
+	Requests    int
+	Duration    time.Duration
+	Puts        float64
+	Sizes       sizeList
+	BlockSizes  intList
+	WindowSize  int
+	Loss        float64
+	Timeout     time.Duration
+	Retries     int
+	Seed        int64
+}
+
+func defaultBenchConfig() benchConfig {
+	return benchConfig{
+		Address:     "127.0.0.1:69",
+		MinPort:     6000,
+		MaxPort:     9000,
+		Setup:       true,
+		Concurrency: 10,
+		Requests:    1000,
+		Puts:        0.5,
+		Sizes:       sizeList{1 << 10, 64 << 10, 1 << 20},
+		BlockSizes:  intList{512},
+		Timeout:     time.Second,
+		Retries:     5,
+		Seed:        1,
+	}
+}
+
+func (c benchConfig) validate() error {
+	switch {
+	case c.Concurrency < 1:
+		return errors.New("concurrency must be at least 1")
+	case c.Requests < 0:
+		return errors.New("requests can't be negative")
+	case c.Requests == 0 && c.Duration <= 0:
+		return errors.New("requests or duration must be set")
+	case c.Puts < 0 || c.Puts > 1:
+		return errors.New("puts must be between 0 and 1")
+	case c.Loss < 0 || c.Loss >= 1:
+		return errors.New("loss must be at least 0 and less than 1")
+	case len(c.Sizes) == 0:
+		return errors.New("sizes can't be empty")
+	case len(c.BlockSizes) == 0:
+		return errors.New("blksize can't be empty")
+	case c.Serve && (c.MinPort < 1 || c.MaxPort > 65535 || c.MinPort > c.MaxPort):
+		return errors.New("minPort and maxPort must be a range of ports")
+	}
+	for _, b := range c.BlockSizes {
+		if b < int(tftp.MinBlockSize) || b > int(tftp.MaxBlockSize) {
+			return fmt.Errorf("blksize %d isn't between %d and %d", b, tftp.MinBlockSize, tftp.MaxBlockSize)
+		}
+	}
+	return nil
+}
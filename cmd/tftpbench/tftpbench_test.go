@@ -0,0 +1,55 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_run(t *testing.T) {
+	stdout := &bytes.Buffer{}
+	stderr := &bytes.Buffer{}
+	got := run(context.Background(), []string{
+		"-serve", "-address", "127.0.0.1:6070", "-minPort", "7100", "-maxPort", "7200",
+		"-requests", "50", "-concurrency", "5", "-sizes", "1KB,10000B", "-blksize", "512,1024", "-json",
+	}, stdout, stderr)
+	assert.Equal(t, 0, got, stderr.String())
+
+	r := report{}
+	if assert.NoError(t, json.Unmarshal(stdout.Bytes(), &r)) {
+		assert.Equal(t, 50, r.Transfers)
+		assert.Equal(t, 50, r.Gets+r.Puts)
+		assert.Equal(t, 0, r.Failed)
+		assert.True(t, r.Bytes >= 50*1024)
+		assert.True(t, r.Latency["max"] >= r.Latency["p50"])
+	}
+}
+
+func Test_run_usage(t *testing.T) {
+	tests := []struct {
+		name    string
+		args    []string
+		wantErr string
+	}{
+		{"concurrency", []string{"-concurrency", "0"}, "concurrency must be at least 1\n"},
+		{"nothing to run", []string{"-requests", "0"}, "requests or duration must be set\n"},
+		{"puts", []string{"-puts", "2"}, "puts must be between 0 and 1\n"},
+		{"loss", []string{"-loss", "1"}, "loss must be at least 0 and less than 1\n"},
+		{"blksize", []string{"-blksize", "512,70000"}, "blksize 70000 isn't between 8 and 65464\n"},
+		{"ports", []string{"-serve", "-minPort", "9000", "-maxPort", "8000"}, "minPort and maxPort must be a range of ports\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stderr := &bytes.Buffer{}
+			assert.Equal(t, 2, run(context.Background(), tt.args, &bytes.Buffer{}, stderr))
+			assert.Equal(t, tt.wantErr, stderr.String())
+		})
+	}
+
+	stderr := &bytes.Buffer{}
+	assert.Equal(t, 2, run(context.Background(), []string{"-sizes", "1XB"}, &bytes.Buffer{}, stderr))
+	assert.Contains(t, stderr.String(), `invalid value "1XB" for flag -sizes: invalid size "1XB"`)
+}
@@ -0,0 +1,934 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lienmeat/tftp"
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v3"
+)
+
+//Config holds every setting tftpd can be started with.  Values come from defaults, then an optional
+//YAML config file, then any flags that were explicitly set on the command line.
+type Config struct {
+	//the default server, the only one configurable by flags
+	ServerConfig `yaml:",inline"`
+	//more virtual servers, each with their own files and policies
+	Servers []NamedServerConfig `yaml:"servers,omitempty"`
+	//ACL applies to every server
+	ACL ACLConfig `yaml:"acl,omitempty"`
+	//Limits caps how many transfers clients can run, across every server
+	Limits LimitsConfig `yaml:"limits"`
+	//Protection guards against reflection attacks and abusive clients, across every server
+	Protection ProtectionConfig `yaml:"protection"`
+	MinPort    int              `yaml:"minPort"`
+	MaxPort    int              `yaml:"maxPort"`
+	//EphemeralPorts lets the kernel pick a transfer's port when none between minPort and maxPort can be used
+	EphemeralPorts bool `yaml:"ephemeralPorts,omitempty"`
+	//SinglePort serves transfers from the listen port instead of a port between minPort and maxPort each,
+	//except to TIDClients, networks of clients that need a port of their own
+	SinglePort      bool       `yaml:"singlePort,omitempty"`
+	TIDClients      stringList `yaml:"tidClients,omitempty"`
+	LogLevel        string     `yaml:"logLevel"`
+	LogFile         string     `yaml:"logFile"`
+	RequestsLogFile string     `yaml:"requestsLogFile"`
+	TraceFile       string     `yaml:"traceFile"`
+	//RequestLog sets the requests log's format and when it's rotated
+	RequestLog RequestLogConfig `yaml:"requestLog"`
+	//Webhooks are sent transfer events
+	Webhooks WebhooksConfig `yaml:"webhooks,omitempty"`
+	//MetricsAddress is where Prometheus metrics are served over HTTP, at /metrics.  Empty turns it off.
+	MetricsAddress string `yaml:"metricsAddress,omitempty"`
+	//AdminAddress is where the admin HTTP API is served, protected by AdminToken.  Empty turns it off.
+	AdminAddress string `yaml:"adminAddress,omitempty"`
+	AdminToken   string `yaml:"adminToken,omitempty"`
+	//Health configures the liveness and readiness endpoints and the -healthcheck probe
+	Health HealthConfig `yaml:"health"`
+	//DrainTimeout is how long running transfers get to finish after a SIGTERM or SIGINT
+	DrainTimeout time.Duration `yaml:"drainTimeout"`
+}
+
+//RequestLogConfig configures the format and rotation of the requests log, 0 turns a rotation setting off
+type RequestLogConfig struct {
+	//Format is json, logfmt or w3c, logfmt if empty
+	Format      string        `yaml:"format,omitempty"`
+	MaxSize     byteSize      `yaml:"maxSize,omitempty"`
+	RotateEvery time.Duration `yaml:"rotateEvery,omitempty"`
+	MaxBackups  int           `yaml:"maxBackups,omitempty"`
+	MaxAge      time.Duration `yaml:"maxAge,omitempty"`
+}
+
+func (c RequestLogConfig) rotate() tftp.RotateOptions {
+	return tftp.RotateOptions{
+		MaxSize:    int64(c.MaxSize),
+		Every:      c.RotateEvery,
+		MaxBackups: c.MaxBackups,
+		MaxAge:     c.MaxAge,
+	}
+}
+
+func (c RequestLogConfig) validate(fail func(msg string, path ...string) error) error {
+	if _, err := tftp.RequestLogFormatter(c.Format); err != nil {
+		return fail(err.Error(), "requestLog", "format")
+	}
+	for _, v := range []struct {
+		name  string
+		value int64
+	}{
+		{"maxSize", int64(c.MaxSize)},
+		{"rotateEvery", int64(c.RotateEvery)},
+		{"maxBackups", int64(c.MaxBackups)},
+		{"maxAge", int64(c.MaxAge)},
+	} {
+		if v.value < 0 {
+			return fail("can't be negative", "requestLog", v.name)
+		}
+	}
+	return nil
+}
+
+//WebhooksConfig configures a tftp.WebhookDispatcher, 0 uses the default
+type WebhooksConfig struct {
+	Hooks       []WebhookConfig `yaml:"hooks,omitempty"`
+	QueueSize   int             `yaml:"queueSize,omitempty"`
+	MaxAttempts int             `yaml:"maxAttempts,omitempty"`
+	Backoff     time.Duration   `yaml:"backoff,omitempty"`
+	Timeout     time.Duration   `yaml:"timeout,omitempty"`
+}
+
+//WebhookConfig is a URL to send events to, for the events and files it lists, or all of them if it doesn't
+type WebhookConfig struct {
+	URL       string     `yaml:"url"`
+	Events    stringList `yaml:"events,omitempty"`
+	Filenames stringList `yaml:"filenames,omitempty"`
+	Secret    string     `yaml:"secret,omitempty"`
+}
+
+func (c WebhooksConfig) webhooks() ([]tftp.Webhook, tftp.WebhookOptions) {
+	hooks := make([]tftp.Webhook, len(c.Hooks))
+	for i, h := range c.Hooks {
+		hooks[i] = tftp.Webhook{URL: h.URL, Filenames: h.Filenames, Secret: h.Secret}
+		for _, e := range h.Events {
+			t, _ := tftp.ParseEventType(e)
+			hooks[i].Events = append(hooks[i].Events, t)
+		}
+	}
+	return hooks, tftp.WebhookOptions{
+		QueueSize:   c.QueueSize,
+		MaxAttempts: c.MaxAttempts,
+		Backoff:     c.Backoff,
+		Timeout:     c.Timeout,
+	}
+}
+
+func (c WebhooksConfig) validate(fail func(msg string, path ...string) error) error {
+	for _, v := range []struct {
+		name  string
+		value int64
+	}{
+		{"queueSize", int64(c.QueueSize)},
+		{"maxAttempts", int64(c.MaxAttempts)},
+		{"backoff", int64(c.Backoff)},
+		{"timeout", int64(c.Timeout)},
+	} {
+		if v.value < 0 {
+			return fail("can't be negative", "webhooks", v.name)
+		}
+	}
+	for i, h := range c.Hooks {
+		idx := strconv.Itoa(i)
+		u, err := url.Parse(h.URL)
+		if err != nil {
+			return fail(err.Error(), "webhooks", "hooks", idx, "url")
+		}
+		if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fail("must be an http or https URL", "webhooks", "hooks", idx, "url")
+		}
+		for j, e := range h.Events {
+			if _, err := tftp.ParseEventType(e); err != nil {
+				return fail(err.Error(), "webhooks", "hooks", idx, "events", strconv.Itoa(j))
+			}
+		}
+		for j, f := range h.Filenames {
+			if _, err := path.Match(f, ""); err != nil {
+				return fail(err.Error(), "webhooks", "hooks", idx, "filenames", strconv.Itoa(j))
+			}
+		}
+	}
+	return nil
+}
+
+//HealthConfig configures health checks
+type HealthConfig struct {
+	//Address is where /healthz and /readyz are served over HTTP.  Empty turns them off.
+	Address string `yaml:"address,omitempty"`
+	//ProbeFile is the file tftpd -healthcheck reads.  It's added to the default server if it isn't there.
+	ProbeFile string `yaml:"probeFile,omitempty"`
+	//ProbeAddress is where tftpd -healthcheck sends its request, by default localhost on the port of the
+	//default server's first address
+	ProbeAddress string        `yaml:"probeAddress,omitempty"`
+	ProbeTimeout time.Duration `yaml:"probeTimeout"`
+}
+
+//probeAddress works out where tftpd -healthcheck should send its request
+func (c *Config) probeAddress() (string, error) {
+	if c.Health.ProbeAddress != "" {
+		return c.Health.ProbeAddress, nil
+	}
+	if len(c.Address) == 0 {
+		return "", errors.New("health.probeAddress is required when the default server has no address")
+	}
+	host, port, err := net.SplitHostPort(c.Address[0])
+	if err != nil {
+		return "", err
+	}
+	//a server listening on every address can be reached on localhost
+	if ip := net.ParseIP(host); host == "" || (ip != nil && ip.IsUnspecified()) {
+		host = "127.0.0.1"
+		if ip != nil && ip.To4() == nil {
+			host = "::1"
+		}
+	}
+	return net.JoinHostPort(host, port), nil
+}
+
+//ServerConfig configures a virtual server: the addresses it listens on, the files it serves and its policies
+type ServerConfig struct {
+	Address stringList `yaml:"address"`
+	//directory to load into the server's in-memory store at startup
+	Root     string        `yaml:"root,omitempty"`
+	ReadOnly bool          `yaml:"readOnly"`
+	Options  OptionsConfig `yaml:"options"`
+	//largest file a client may upload, 0 means no limit
+	MaxUploadSize byteSize     `yaml:"maxUploadSize"`
+	Quotas        QuotasConfig `yaml:"quotas,omitempty"`
+}
+
+//QuotasConfig configures tftp.Quotas
+type QuotasConfig struct {
+	PerClient byteSize          `yaml:"perClient,omitempty"`
+	Paths     []PathQuotaConfig `yaml:"paths,omitempty"`
+}
+
+//PathQuotaConfig configures a tftp.PathQuota
+type PathQuotaConfig struct {
+	Prefix string   `yaml:"prefix"`
+	Bytes  byteSize `yaml:"bytes"`
+}
+
+//NamedServerConfig is a virtual server other than the default one
+type NamedServerConfig struct {
+	Name         string `yaml:"name"`
+	ServerConfig `yaml:",inline"`
+	//ACL applies to this server, on top of the top level acl
+	ACL ACLConfig `yaml:"acl,omitempty"`
+}
+
+//LimitsConfig configures tftp.Limits, 0 means no limit
+type LimitsConfig struct {
+	MaxTransfers          int           `yaml:"maxTransfers"`
+	MaxTransfersPerClient int           `yaml:"maxTransfersPerClient"`
+	RequestRate           float64       `yaml:"requestRate"`
+	RequestBurst          int           `yaml:"requestBurst"`
+	Queue                 int           `yaml:"queue"`
+	QueueTimeout          time.Duration `yaml:"queueTimeout"`
+	Drop                  bool          `yaml:"drop"`
+	//transfers breaking these are aborted, minThroughput is in bytes per second
+	MaxDuration     time.Duration `yaml:"maxDuration"`
+	MaxIdle         time.Duration `yaml:"maxIdle"`
+	MinThroughput   byteSize      `yaml:"minThroughput"`
+	ThroughputGrace time.Duration `yaml:"throughputGrace"`
+	MaxBlockRetries int           `yaml:"maxBlockRetries"`
+}
+
+func (c LimitsConfig) limits() tftp.Limits {
+	return tftp.Limits{
+		MaxTransfers:          c.MaxTransfers,
+		MaxTransfersPerClient: c.MaxTransfersPerClient,
+		RequestRate:           c.RequestRate,
+		RequestBurst:          c.RequestBurst,
+		Queue:                 c.Queue,
+		QueueTimeout:          c.QueueTimeout,
+		Drop:                  c.Drop,
+		MaxDuration:           c.MaxDuration,
+		MaxIdle:               c.MaxIdle,
+		MinThroughput:         int64(c.MinThroughput),
+		ThroughputGrace:       c.ThroughputGrace,
+		MaxBlockRetries:       c.MaxBlockRetries,
+	}
+}
+
+func (c LimitsConfig) validate(fail func(msg string, path ...string) error) error {
+	for _, v := range []struct {
+		name  string
+		value float64
+	}{
+		{"maxTransfers", float64(c.MaxTransfers)},
+		{"maxTransfersPerClient", float64(c.MaxTransfersPerClient)},
+		{"requestRate", c.RequestRate},
+		{"requestBurst", float64(c.RequestBurst)},
+		{"queue", float64(c.Queue)},
+		{"queueTimeout", float64(c.QueueTimeout)},
+		{"maxDuration", float64(c.MaxDuration)},
+		{"maxIdle", float64(c.MaxIdle)},
+		{"minThroughput", float64(c.MinThroughput)},
+		{"throughputGrace", float64(c.ThroughputGrace)},
+		{"maxBlockRetries", float64(c.MaxBlockRetries)},
+	} {
+		if v.value < 0 {
+			return fail("can't be negative", "limits", v.name)
+		}
+	}
+	if c.Queue > 0 && c.QueueTimeout == 0 {
+		return fail("is required when queue is set", "limits", "queueTimeout")
+	}
+	return nil
+}
+
+//ProtectionConfig configures tftp.Protection, 0 turns a protection off or uses its default
+type ProtectionConfig struct {
+	MaxUnverifiedBytes byteSize      `yaml:"maxUnverifiedBytes"`
+	Untrusted          stringList    `yaml:"untrusted,omitempty"`
+	CookieWindow       time.Duration `yaml:"cookieWindow,omitempty"`
+	VerifiedFor        time.Duration `yaml:"verifiedFor,omitempty"`
+	AbuseThreshold     int           `yaml:"abuseThreshold"`
+	AbuseDecay         time.Duration `yaml:"abuseDecay,omitempty"`
+	BlockFor           time.Duration `yaml:"blockFor,omitempty"`
+}
+
+func (c ProtectionConfig) protection() (p tftp.Protection, err error) {
+	p = tftp.Protection{
+		MaxUnverifiedBytes: int64(c.MaxUnverifiedBytes),
+		CookieWindow:       c.CookieWindow,
+		VerifiedFor:        c.VerifiedFor,
+		AbuseThreshold:     c.AbuseThreshold,
+		AbuseDecay:         c.AbuseDecay,
+		BlockFor:           c.BlockFor,
+	}
+	p.Untrusted, err = tftp.ParseNetworks(c.Untrusted)
+	return p, err
+}
+
+func (c ProtectionConfig) validate(fail func(msg string, path ...string) error) error {
+	for _, v := range []struct {
+		name  string
+		value int64
+	}{
+		{"cookieWindow", int64(c.CookieWindow)},
+		{"verifiedFor", int64(c.VerifiedFor)},
+		{"abuseThreshold", int64(c.AbuseThreshold)},
+		{"abuseDecay", int64(c.AbuseDecay)},
+		{"blockFor", int64(c.BlockFor)},
+	} {
+		if v.value < 0 {
+			return fail("can't be negative", "protection", v.name)
+		}
+	}
+	for i, n := range c.Untrusted {
+		if _, err := tftp.ParseNetworks([]string{n}); err != nil {
+			return fail(err.Error(), "protection", "untrusted", strconv.Itoa(i))
+		}
+	}
+	return nil
+}
+
+//AccessListConfig lists the networks allowed or denied access, as CIDRs or single IPs
+type AccessListConfig struct {
+	Allow stringList `yaml:"allow,omitempty"`
+	Deny  stringList `yaml:"deny,omitempty"`
+}
+
+//ACLConfig configures a tftp.ACL
+type ACLConfig struct {
+	AccessListConfig `yaml:",inline"`
+	Read             AccessListConfig `yaml:"read,omitempty"`
+	Write            AccessListConfig `yaml:"write,omitempty"`
+	Paths            []PathACLConfig  `yaml:"paths,omitempty"`
+	//Drop silently ignores denied requests instead of replying with an error
+	Drop bool `yaml:"drop,omitempty"`
+}
+
+//PathACLConfig configures a tftp.PathACL
+type PathACLConfig struct {
+	Prefix           string `yaml:"prefix"`
+	AccessListConfig `yaml:",inline"`
+	Read             AccessListConfig `yaml:"read,omitempty"`
+	Write            AccessListConfig `yaml:"write,omitempty"`
+}
+
+func (c AccessListConfig) accessList() (l tftp.AccessList, err error) {
+	if l.Allow, err = tftp.ParseNetworks(c.Allow); err != nil {
+		return l, err
+	}
+	l.Deny, err = tftp.ParseNetworks(c.Deny)
+	return l, err
+}
+
+//acl builds the tftp.ACL, or nil if nothing is configured
+func (c ACLConfig) acl() (*tftp.ACL, error) {
+	if c.empty() {
+		return nil, nil
+	}
+	acl := &tftp.ACL{Drop: c.Drop}
+	var err error
+	if acl.AccessList, err = c.AccessListConfig.accessList(); err != nil {
+		return nil, err
+	}
+	if acl.Read, err = c.Read.accessList(); err != nil {
+		return nil, err
+	}
+	if acl.Write, err = c.Write.accessList(); err != nil {
+		return nil, err
+	}
+	for _, pc := range c.Paths {
+		p := tftp.PathACL{Prefix: pc.Prefix}
+		if p.AccessList, err = pc.AccessListConfig.accessList(); err != nil {
+			return nil, err
+		}
+		if p.Read, err = pc.Read.accessList(); err != nil {
+			return nil, err
+		}
+		if p.Write, err = pc.Write.accessList(); err != nil {
+			return nil, err
+		}
+		acl.Paths = append(acl.Paths, p)
+	}
+	return acl, nil
+}
+
+func (c AccessListConfig) empty() bool {
+	return len(c.Allow) == 0 && len(c.Deny) == 0
+}
+
+func (c ACLConfig) empty() bool {
+	return c.AccessListConfig.empty() && c.Read.empty() && c.Write.empty() && len(c.Paths) == 0
+}
+
+//validate checks every network in the ACL parses, pointing at the bad one
+func (c ACLConfig) validate(fail func(msg string, path ...string) error) error {
+	type list struct {
+		path []string
+		l    AccessListConfig
+	}
+	lists := []list{{nil, c.AccessListConfig}, {[]string{"read"}, c.Read}, {[]string{"write"}, c.Write}}
+	for i, p := range c.Paths {
+		idx := strconv.Itoa(i)
+		if p.Prefix == "" {
+			return fail("is required", "paths", idx, "prefix")
+		}
+		lists = append(lists,
+			list{[]string{"paths", idx}, p.AccessListConfig},
+			list{[]string{"paths", idx, "read"}, p.Read},
+			list{[]string{"paths", idx, "write"}, p.Write},
+		)
+	}
+	for _, list := range lists {
+		for _, networks := range []struct {
+			name string
+			nn   stringList
+		}{{"allow", list.l.Allow}, {"deny", list.l.Deny}} {
+			for i, n := range networks.nn {
+				if _, err := tftp.ParseNetworks([]string{n}); err != nil {
+					path := append(append([]string{}, list.path...), networks.name, strconv.Itoa(i))
+					return fail(err.Error(), path...)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+//OptionsConfig limits the TFTP options (blksize, timeout, tsize) negotiated with clients
+type OptionsConfig struct {
+	Disabled     bool `yaml:"disabled"`
+	MaxBlockSize uint `yaml:"maxBlockSize"`
+	MaxTimeout   uint `yaml:"maxTimeout"`
+}
+
+//apply configures v and loads its files
+func (c ServerConfig) apply(v *tftp.VirtualServer) error {
+	v.ReadOnly = c.ReadOnly
+	v.Options = tftp.OptionLimits{
+		Disabled:     c.Options.Disabled,
+		MaxBlockSize: c.Options.MaxBlockSize,
+		MaxTimeout:   c.Options.MaxTimeout,
+	}
+	v.MaxUploadSize = int64(c.MaxUploadSize)
+	v.Quotas = tftp.Quotas{PerClient: int64(c.Quotas.PerClient)}
+	for _, q := range c.Quotas.Paths {
+		v.Quotas.Paths = append(v.Quotas.Paths, tftp.PathQuota{Prefix: q.Prefix, Bytes: int64(q.Bytes)})
+	}
+	if c.Root != "" {
+		n, err := v.Files.LoadDir(c.Root)
+		if err != nil {
+			return fmt.Errorf("err loading %s for server %s: %s", c.Root, v.Name, err.Error())
+		}
+		log.Infof("loaded %d files from %s for server %s", n, c.Root, v.Name)
+	}
+	return nil
+}
+
+func defaultConfig() Config {
+	return Config{
+		MinPort:         6000,
+		MaxPort:         9000,
+		LogLevel:        "info",
+		RequestsLogFile: "tftp_requests.log",
+		DrainTimeout:    time.Second * 30,
+		Health: HealthConfig{
+			ProbeTimeout: time.Second * 5,
+		},
+	}
+}
+
+//ConfigError is a validation error for a single config setting.  Line is the line in the config file the
+//setting was read from, or 0 if it came from a default or a flag.
+type ConfigError struct {
+	File  string
+	Line  int
+	Field string
+	Msg   string
+}
+
+func (e *ConfigError) Error() string {
+	if e.Line > 0 {
+		return fmt.Sprintf("%s:%d: %s: %s", e.File, e.Line, e.Field, e.Msg)
+	}
+	return fmt.Sprintf("%s: %s", e.Field, e.Msg)
+}
+
+//registerFlags binds every config setting to a flag on fs, writing into cfg
+func registerFlags(fs *flag.FlagSet, cfg *Config) {
+	fs.Var(&cfg.Address, "address", "IP address and port to use (ex: 0.0.0.0:69), may be repeated to listen on several")
+	fs.StringVar(&cfg.Root, "root", cfg.Root, "directory to load files from at startup")
+	fs.BoolVar(&cfg.ReadOnly, "readOnly", cfg.ReadOnly, "refuse all write requests")
+	fs.Var(&cfg.MaxUploadSize, "maxUploadSize", "largest file a client may upload (ex: 64MB), 0 means no limit")
+	fs.IntVar(&cfg.MinPort, "minPort", cfg.MinPort, "minimum port to use for transfers (TIDs)")
+	fs.IntVar(&cfg.MaxPort, "maxPort", cfg.MaxPort, "maximum port to use for transfers (TIDs)")
+	fs.BoolVar(&cfg.EphemeralPorts, "ephemeralPorts", cfg.EphemeralPorts, "let the kernel pick transfer ports when none between minPort and maxPort are free")
+	fs.BoolVar(&cfg.SinglePort, "singlePort", cfg.SinglePort, "serve transfers from the listen port instead of a new port (TID) each")
+	fs.StringVar(&cfg.LogLevel, "logLevel", cfg.LogLevel, "logging level (trace, debug, info, warn, error, panic, fatal)")
+	fs.StringVar(&cfg.LogFile, "logFile", cfg.LogFile, "log file, if not set, will log to stdOut")
+	fs.StringVar(&cfg.RequestsLogFile, "requestsLogFile", cfg.RequestsLogFile, "requests log file, if not set, will log to tftp_requests.log")
+	fs.StringVar(&cfg.RequestLog.Format, "requestLogFormat", cfg.RequestLog.Format, "requests log format (json, logfmt, w3c)")
+	fs.StringVar(&cfg.TraceFile, "traceFile", cfg.TraceFile, "trace execution to file")
+	fs.StringVar(&cfg.MetricsAddress, "metricsAddress", cfg.MetricsAddress, "address to serve Prometheus metrics on, at /metrics")
+	fs.StringVar(&cfg.AdminAddress, "adminAddress", cfg.AdminAddress, "address to serve the admin HTTP API on")
+	fs.StringVar(&cfg.Health.Address, "healthAddress", cfg.Health.Address, "address to serve /healthz and /readyz on")
+	fs.StringVar(&cfg.Health.ProbeFile, "probeFile", cfg.Health.ProbeFile, "file to read with -healthcheck")
+}
+
+//configSource remembers where the config was read from so validation errors can point at a line
+type configSource struct {
+	filename string
+	root     *yaml.Node
+	//top-level settings that were overridden by flags, and so didn't come from the file
+	flags map[string]bool
+}
+
+//line returns the line in the config file a setting came from, or 0 if it didn't come from the file
+func (s *configSource) line(path ...string) int {
+	if s == nil || s.flags[path[0]] {
+		return 0
+	}
+	//nested settings' flags are named like healthAddress for health.address
+	name := path[0]
+	for _, p := range path[1:] {
+		if p != "" {
+			name += strings.ToUpper(p[:1]) + p[1:]
+		}
+	}
+	if s.flags[name] {
+		return 0
+	}
+	return lineOf(s.root, path...)
+}
+
+//loadConfig parses args with fs (which must already have the config's flags registered via registerFlags),
+//merges in configFile if it is set, then re-applies any flags set explicitly so they win over the file.
+func loadConfig(fs *flag.FlagSet, cfg *Config, configFile *string, args []string) (*configSource, error) {
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+	if *configFile == "" {
+		return nil, nil
+	}
+
+	set := map[string]string{}
+	fs.Visit(func(f *flag.Flag) {
+		set[f.Name] = f.Value.String()
+	})
+
+	root, err := readConfigFile(*configFile, cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	src := &configSource{filename: *configFile, root: root, flags: map[string]bool{}}
+	for name, value := range set {
+		//list flags replace what the file set rather than adding to it
+		if l, ok := fs.Lookup(name).Value.(*stringList); ok {
+			*l = nil
+		}
+		if err = fs.Set(name, value); err != nil {
+			return nil, err
+		}
+		src.flags[name] = true
+	}
+	return src, nil
+}
+
+//readConfigFile decodes filename over the top of cfg, rejecting unknown settings.  The parsed document is
+//returned so that validation errors can be reported with line numbers.
+func readConfigFile(filename string, cfg *Config) (*yaml.Node, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("err reading config file %s: %s", filename, err.Error())
+	}
+
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	if err := dec.Decode(cfg); err != nil && err != io.EOF {
+		return nil, fmt.Errorf("%s: %s", filename, err.Error())
+	}
+
+	root := &yaml.Node{}
+	if err := yaml.Unmarshal(data, root); err != nil {
+		return nil, fmt.Errorf("%s: %s", filename, err.Error())
+	}
+	return root, nil
+}
+
+//Validate checks the merged config.  src is used to point errors at the line in the config file the bad
+//setting came from, and may be nil if no config file was used.
+func (c *Config) Validate(src *configSource) error {
+	fail := func(msg string, path ...string) error {
+		e := &ConfigError{Line: src.line(path...), Field: fieldName(path), Msg: msg}
+		if src != nil {
+			e.File = src.filename
+		}
+		return e
+	}
+
+	if len(c.Address) == 0 && len(c.Servers) == 0 {
+		return fail("is required", "address")
+	}
+	addresses := map[string]bool{}
+	if err := c.ServerConfig.validate(fail, addresses); err != nil {
+		return err
+	}
+	if err := c.Limits.validate(fail); err != nil {
+		return err
+	}
+	if err := c.Protection.validate(fail); err != nil {
+		return err
+	}
+	if err := c.RequestLog.validate(fail); err != nil {
+		return err
+	}
+	if err := c.Webhooks.validate(fail); err != nil {
+		return err
+	}
+	if err := c.ACL.validate(func(msg string, path ...string) error {
+		return fail(msg, append([]string{"acl"}, path...)...)
+	}); err != nil {
+		return err
+	}
+	names := map[string]bool{tftp.DefaultVirtualServer: true}
+	for i, s := range c.Servers {
+		idx := strconv.Itoa(i)
+		if s.Name == "" {
+			return fail("is required", "servers", idx, "name")
+		}
+		if names[s.Name] {
+			return fail("must be unique, "+s.Name+" is already used", "servers", idx, "name")
+		}
+		names[s.Name] = true
+		if len(s.Address) == 0 {
+			return fail("is required", "servers", idx, "address")
+		}
+		serverFail := func(msg string, path ...string) error {
+			return fail(msg, append([]string{"servers", idx}, path...)...)
+		}
+		if err := s.ServerConfig.validate(serverFail, addresses); err != nil {
+			return err
+		}
+		if err := s.ACL.validate(func(msg string, path ...string) error {
+			return serverFail(msg, append([]string{"acl"}, path...)...)
+		}); err != nil {
+			return err
+		}
+	}
+	if c.MetricsAddress != "" {
+		if _, _, err := net.SplitHostPort(c.MetricsAddress); err != nil {
+			return fail(err.Error(), "metricsAddress")
+		}
+	}
+	if c.AdminAddress != "" {
+		if _, _, err := net.SplitHostPort(c.AdminAddress); err != nil {
+			return fail(err.Error(), "adminAddress")
+		}
+		if c.AdminToken == "" {
+			return fail("is required when adminAddress is set", "adminToken")
+		}
+	}
+	if c.Health.Address != "" {
+		if _, _, err := net.SplitHostPort(c.Health.Address); err != nil {
+			return fail(err.Error(), "health", "address")
+		}
+	}
+	if c.Health.ProbeAddress != "" {
+		if _, _, err := net.SplitHostPort(c.Health.ProbeAddress); err != nil {
+			return fail(err.Error(), "health", "probeAddress")
+		}
+	}
+	if c.Health.ProbeTimeout <= 0 {
+		return fail("must be positive", "health", "probeTimeout")
+	}
+	if c.DrainTimeout < 0 {
+		return fail("can't be negative", "drainTimeout")
+	}
+	if c.MinPort <= 0 || c.MinPort > 65535 {
+		return fail("must be between 1 and 65535", "minPort")
+	}
+	if c.MaxPort <= 0 || c.MaxPort > 65535 {
+		return fail("must be between 1 and 65535", "maxPort")
+	}
+	if c.MaxPort <= c.MinPort {
+		return fail("must be greater than minPort", "maxPort")
+	}
+	for i, n := range c.TIDClients {
+		if _, err := tftp.ParseNetworks([]string{n}); err != nil {
+			return fail(err.Error(), "tidClients", strconv.Itoa(i))
+		}
+	}
+	if _, err := log.ParseLevel(c.LogLevel); err != nil {
+		return fail(err.Error(), "logLevel")
+	}
+	return nil
+}
+
+//fieldName formats a path to a setting for error messages, ex: address[1]
+func fieldName(path []string) string {
+	name := ""
+	for _, p := range path {
+		if _, err := strconv.Atoi(p); err == nil {
+			name += "[" + p + "]"
+		} else if name == "" {
+			name = p
+		} else {
+			name += "." + p
+		}
+	}
+	return name
+}
+
+//stringList is a setting that can be given more than once as a flag, as a comma separated list,
+//or as either a single value or a list in the config file
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(value string) error {
+	for _, v := range strings.Split(value, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			*l = append(*l, v)
+		}
+	}
+	return nil
+}
+
+func (l *stringList) UnmarshalYAML(value *yaml.Node) error {
+	if value.Kind == yaml.ScalarNode {
+		*l = stringList{value.Value}
+		return nil
+	}
+	var list []string
+	if err := value.Decode(&list); err != nil {
+		return err
+	}
+	*l = list
+	return nil
+}
+
+func (l stringList) MarshalYAML() (interface{}, error) {
+	if len(l) == 1 {
+		return l[0], nil
+	}
+	return []string(l), nil
+}
+
+//validate checks a server's settings.  addresses collects every address seen so far so they can't
+//be listened on twice.
+func (c ServerConfig) validate(fail func(msg string, path ...string) error, addresses map[string]bool) error {
+	for i, a := range c.Address {
+		if _, err := net.ResolveUDPAddr("udp", a); err != nil {
+			return fail(err.Error(), "address", strconv.Itoa(i))
+		}
+		if addresses[a] {
+			return fail("already used by another server", "address", strconv.Itoa(i))
+		}
+		addresses[a] = true
+	}
+	if c.Root != "" {
+		if info, err := os.Stat(c.Root); err != nil {
+			return fail(err.Error(), "root")
+		} else if !info.IsDir() {
+			return fail("must be a directory", "root")
+		}
+	}
+	if c.Options.MaxBlockSize != 0 && (c.Options.MaxBlockSize < tftp.MinBlockSize || c.Options.MaxBlockSize > tftp.MaxBlockSize) {
+		return fail(fmt.Sprintf("must be between %d and %d", tftp.MinBlockSize, tftp.MaxBlockSize), "options", "maxBlockSize")
+	}
+	if c.Options.MaxTimeout > tftp.MaxTimeout {
+		return fail(fmt.Sprintf("must be between 1 and %d", tftp.MaxTimeout), "options", "maxTimeout")
+	}
+	for i, q := range c.Quotas.Paths {
+		if q.Prefix == "" {
+			return fail("is required", "quotas", "paths", strconv.Itoa(i), "prefix")
+		}
+		if q.Bytes <= 0 {
+			return fail("must be greater than 0", "quotas", "paths", strconv.Itoa(i), "bytes")
+		}
+	}
+	return nil
+}
+
+//byteSize is a number of bytes, which can be given with a unit: 512, 64KB, 10MB, 1GB (powers of 1024)
+type byteSize int64
+
+var byteUnits = []struct {
+	suffix string
+	size   int64
+}{
+	{"TB", 1 << 40},
+	{"GB", 1 << 30},
+	{"MB", 1 << 20},
+	{"KB", 1 << 10},
+	{"B", 1},
+}
+
+func parseByteSize(s string) (byteSize, error) {
+	s = strings.ToUpper(strings.TrimSpace(s))
+	mult := int64(1)
+	for _, u := range byteUnits {
+		if strings.HasSuffix(s, u.suffix) {
+			s = strings.TrimSpace(strings.TrimSuffix(s, u.suffix))
+			mult = u.size
+			break
+		}
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	return byteSize(n * mult), nil
+}
+
+func (b *byteSize) String() string {
+	for _, u := range byteUnits {
+		if *b != 0 && int64(*b)%u.size == 0 {
+			return strconv.FormatInt(int64(*b)/u.size, 10) + u.suffix
+		}
+	}
+	return "0"
+}
+
+func (b *byteSize) Set(value string) (err error) {
+	*b, err = parseByteSize(value)
+	return err
+}
+
+func (b *byteSize) UnmarshalYAML(value *yaml.Node) (err error) {
+	if *b, err = parseByteSize(value.Value); err != nil {
+		return fmt.Errorf("line %d: %s", value.Line, err.Error())
+	}
+	return nil
+}
+
+func (b byteSize) MarshalYAML() (interface{}, error) {
+	return b.String(), nil
+}
+
+//redacted stands in for secrets in the printed config
+const redacted = "***"
+
+//String renders the config as YAML, the same format it is read in, with secrets redacted
+func (c Config) String() string {
+	if c.AdminToken != "" {
+		c.AdminToken = redacted
+	}
+	//hooks are copied, so the config itself keeps its secrets
+	hooks := make([]WebhookConfig, len(c.Webhooks.Hooks))
+	for i, h := range c.Webhooks.Hooks {
+		if h.Secret != "" {
+			h.Secret = redacted
+		}
+		hooks[i] = h
+	}
+	if len(hooks) > 0 {
+		c.Webhooks.Hooks = hooks
+	}
+	out, err := yaml.Marshal(c)
+	if err != nil {
+		return err.Error()
+	}
+	return string(out)
+}
+
+//lineOf finds the line a setting was defined on in a parsed config file.  path is a list of mapping keys
+//or sequence indexes leading to the setting.  If the setting isn't in the file, the line of the closest
+//enclosing setting is used, so a missing setting is reported where it should have been.  Returns 0 if
+//none of the path is in the file.
+func lineOf(root *yaml.Node, path ...string) int {
+	if root == nil {
+		return 0
+	}
+	n := root
+	if n.Kind == yaml.DocumentNode && len(n.Content) > 0 {
+		n = n.Content[0]
+	}
+	line := 0
+	for _, p := range path {
+		switch n.Kind {
+		case yaml.MappingNode:
+			var next *yaml.Node
+			for i := 0; i+1 < len(n.Content); i += 2 {
+				if n.Content[i].Value == p {
+					line = n.Content[i].Line
+					next = n.Content[i+1]
+					break
+				}
+			}
+			if next == nil {
+				return line
+			}
+			n = next
+		case yaml.SequenceNode:
+			i, err := strconv.Atoi(p)
+			if err != nil || i < 0 || i >= len(n.Content) {
+				return line
+			}
+			n = n.Content[i]
+			line = n.Line
+		default:
+			//a single value where a list was allowed
+			return line
+		}
+	}
+	return line
+}
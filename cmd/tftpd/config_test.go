@@ -0,0 +1,491 @@
+package main
+
+import (
+	"flag"
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lienmeat/tftp"
+	"github.com/stretchr/testify/assert"
+)
+
+var configDir string
+
+func TestMain(m *testing.M) {
+	var err error
+	if configDir, err = ioutil.TempDir("", "tftpd-config"); err != nil {
+		panic(err)
+	}
+	code := m.Run()
+	os.RemoveAll(configDir)
+	os.Exit(code)
+}
+
+func writeConfig(t *testing.T, contents string) string {
+	f, err := ioutil.TempFile(configDir, "*.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err := f.WriteString(contents); err != nil {
+		t.Fatal(err)
+	}
+	return f.Name()
+}
+
+func parseTestConfig(args ...string) (Config, *configSource, error) {
+	cfg := defaultConfig()
+	fs := flag.NewFlagSet("tftpd", flag.ContinueOnError)
+	registerFlags(fs, &cfg)
+	configFile := fs.String("config", "", "")
+	src, err := loadConfig(fs, &cfg, configFile, args)
+	return cfg, src, err
+}
+
+func TestLoadConfig(t *testing.T) {
+	filename := writeConfig(t, "address: 0.0.0.0:69\nminPort: 7000\nlogLevel: debug\n")
+	listFile := writeConfig(t, "address:\n  - 0.0.0.0:69\n  - \"[::]:69\"\n")
+	requestLogFile := writeConfig(t, "address: 0.0.0.0:69\nrequestLog:\n  format: w3c\n  maxSize: 10MB\n  rotateEvery: 24h\n  maxBackups: 7\n")
+
+	tests := []struct {
+		name    string
+		args    []string
+		want    Config
+		wantErr bool
+	}{
+		{
+			name: "flags only",
+			args: []string{"-address", "127.0.0.1:69"},
+			want: Config{ServerConfig: ServerConfig{Address: stringList{"127.0.0.1:69"}}, MinPort: 6000, MaxPort: 9000, LogLevel: "info", RequestsLogFile: "tftp_requests.log", DrainTimeout: time.Second * 30, Health: HealthConfig{ProbeTimeout: time.Second * 5}},
+		},
+		{
+			name: "file over defaults",
+			args: []string{"-config", filename},
+			want: Config{ServerConfig: ServerConfig{Address: stringList{"0.0.0.0:69"}}, MinPort: 7000, MaxPort: 9000, LogLevel: "debug", RequestsLogFile: "tftp_requests.log", DrainTimeout: time.Second * 30, Health: HealthConfig{ProbeTimeout: time.Second * 5}},
+		},
+		{
+			name: "flags over file",
+			args: []string{"-minPort", "8000", "-config", filename, "-maxPort", "8500"},
+			want: Config{ServerConfig: ServerConfig{Address: stringList{"0.0.0.0:69"}}, MinPort: 8000, MaxPort: 8500, LogLevel: "debug", RequestsLogFile: "tftp_requests.log", DrainTimeout: time.Second * 30, Health: HealthConfig{ProbeTimeout: time.Second * 5}},
+		},
+		{
+			name: "repeated flags",
+			args: []string{"-address", "127.0.0.1:69", "-address", "[::1]:69"},
+			want: Config{ServerConfig: ServerConfig{Address: stringList{"127.0.0.1:69", "[::1]:69"}}, MinPort: 6000, MaxPort: 9000, LogLevel: "info", RequestsLogFile: "tftp_requests.log", DrainTimeout: time.Second * 30, Health: HealthConfig{ProbeTimeout: time.Second * 5}},
+		},
+		{
+			name: "list in file replaced by flag",
+			args: []string{"-config", listFile, "-address", "10.0.0.1:69"},
+			want: Config{ServerConfig: ServerConfig{Address: stringList{"10.0.0.1:69"}}, MinPort: 6000, MaxPort: 9000, LogLevel: "info", RequestsLogFile: "tftp_requests.log", DrainTimeout: time.Second * 30, Health: HealthConfig{ProbeTimeout: time.Second * 5}},
+		},
+		{
+			name: "list in file",
+			args: []string{"-config", listFile},
+			want: Config{ServerConfig: ServerConfig{Address: stringList{"0.0.0.0:69", "[::]:69"}}, MinPort: 6000, MaxPort: 9000, LogLevel: "info", RequestsLogFile: "tftp_requests.log", DrainTimeout: time.Second * 30, Health: HealthConfig{ProbeTimeout: time.Second * 5}},
+		},
+		{
+			name: "request log",
+			args: []string{"-config", requestLogFile, "-requestLogFormat", "json"},
+			want: Config{ServerConfig: ServerConfig{Address: stringList{"0.0.0.0:69"}}, MinPort: 6000, MaxPort: 9000, LogLevel: "info", RequestsLogFile: "tftp_requests.log", RequestLog: RequestLogConfig{Format: "json", MaxSize: 10 << 20, RotateEvery: time.Hour * 24, MaxBackups: 7}, DrainTimeout: time.Second * 30, Health: HealthConfig{ProbeTimeout: time.Second * 5}},
+		},
+		{
+			name:    "missing file",
+			args:    []string{"-config", filename + ".missing"},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, _, err := parseTestConfig(tt.args...)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("loadConfig() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr {
+				assert.Equal(t, tt.want, cfg)
+			}
+		})
+	}
+}
+
+func TestConfigErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		file    string
+		args    []string
+		wantErr string
+	}{
+		{
+			name:    "unknown setting",
+			file:    "address: 0.0.0.0:69\nport: 69\n",
+			wantErr: "line 2: field port not found",
+		},
+		{
+			name:    "wrong type",
+			file:    "address: 0.0.0.0:69\n\nminPort: lots\n",
+			wantErr: "line 3: cannot unmarshal !!str `lots` into int",
+		},
+		{
+			name:    "invalid value",
+			file:    "address: 0.0.0.0:69\nminPort: 7000\nmaxPort: 6000\n",
+			wantErr: ":3: maxPort: must be greater than minPort",
+		},
+		{
+			name:    "invalid value from flag has no line",
+			file:    "address: 0.0.0.0:69\nmaxPort: 9000\n",
+			args:    []string{"-maxPort", "10"},
+			wantErr: "maxPort: must be greater than minPort",
+		},
+		{
+			name:    "bad address in list",
+			file:    "address:\n  - 0.0.0.0:69\n  - nope\n",
+			wantErr: ":3: address[1]: address nope: missing port in address",
+		},
+		{
+			name:    "servers need names",
+			file:    "servers:\n  - address: 0.0.0.0:69\n",
+			wantErr: ":2: servers[0].name: is required",
+		},
+		{
+			name:    "server names are unique",
+			file:    "servers:\n  - name: lab\n    address: 10.0.0.1:69\n  - name: lab\n    address: 10.0.0.2:69\n",
+			wantErr: ":4: servers[1].name: must be unique, lab is already used",
+		},
+		{
+			name:    "addresses are unique",
+			file:    "address: 10.0.0.1:69\nservers:\n  - name: lab\n    address: [10.0.0.2:69, 10.0.0.1:69]\n",
+			wantErr: ":4: servers[0].address[1]: already used by another server",
+		},
+		{
+			name:    "bad option limit",
+			file:    "servers:\n  - name: lab\n    address: 10.0.0.1:69\n    options:\n      maxBlockSize: 4\n",
+			wantErr: ":5: servers[0].options.maxBlockSize: must be between 8 and 65464",
+		},
+		{
+			name:    "missing root",
+			file:    "address: 10.0.0.1:69\nroot: /does/not/exist\n",
+			wantErr: ":2: root: stat /does/not/exist",
+		},
+		{
+			name:    "bad acl network",
+			file:    "address: 10.0.0.1:69\nacl:\n  paths:\n    - prefix: configs/\n      write:\n        allow: [10.0.0.0/8, 10.0.0.0/40]\n",
+			wantErr: ":6: acl.paths[0].write.allow[1]: invalid CIDR address: 10.0.0.0/40",
+		},
+		{
+			name:    "queue needs a timeout",
+			file:    "address: 10.0.0.1:69\nlimits:\n  maxTransfers: 10\n  queue: 5\n",
+			wantErr: ":2: limits.queueTimeout: is required when queue is set",
+		},
+		{
+			name:    "bad untrusted network",
+			file:    "address: 10.0.0.1:69\nprotection:\n  untrusted:\n    - 10.0.0.0/8\n    - lab\n",
+			wantErr: ":5: protection.untrusted[1]: invalid IP address lab",
+		},
+		{
+			name:    "bad tid client network",
+			file:    "address: 10.0.0.1:69\nsinglePort: true\ntidClients: [lab]\n",
+			wantErr: ":3: tidClients[0]: invalid IP address lab",
+		},
+		{
+			name:    "negative abuse threshold",
+			file:    "address: 10.0.0.1:69\nprotection:\n  abuseThreshold: -1\n",
+			wantErr: ":3: protection.abuseThreshold: can't be negative",
+		},
+		{
+			name:    "negative block retries",
+			file:    "address: 10.0.0.1:69\nlimits:\n  maxBlockRetries: -1\n",
+			wantErr: ":3: limits.maxBlockRetries: can't be negative",
+		},
+		{
+			name:    "bad metrics address",
+			file:    "address: 10.0.0.1:69\nmetricsAddress: 9100\n",
+			wantErr: ":2: metricsAddress: address 9100: missing port in address",
+		},
+		{
+			name:    "admin api needs a token",
+			file:    "address: 10.0.0.1:69\nadminAddress: 127.0.0.1:8080\n",
+			wantErr: "adminToken: is required when adminAddress is set",
+		},
+		{
+			name:    "bad request log format",
+			file:    "address: 10.0.0.1:69\nrequestLog:\n  format: xml\n",
+			wantErr: ":3: requestLog.format: unknown request log format xml, must be json, logfmt or w3c",
+		},
+		{
+			name:    "negative request log backups",
+			file:    "address: 10.0.0.1:69\nrequestLog:\n  maxBackups: -1\n",
+			wantErr: ":3: requestLog.maxBackups: can't be negative",
+		},
+		{
+			name:    "bad webhook url",
+			file:    "address: 10.0.0.1:69\nwebhooks:\n  hooks:\n    - url: inventory/hooks\n",
+			wantErr: ":4: webhooks.hooks[0].url: must be an http or https URL",
+		},
+		{
+			name:    "bad webhook event",
+			file:    "address: 10.0.0.1:69\nwebhooks:\n  hooks:\n    - url: http://inventory/hooks\n      events: [completed, finished]\n",
+			wantErr: ":5: webhooks.hooks[0].events[1]: unknown event type finished",
+		},
+		{
+			name:    "bad webhook filename",
+			file:    "address: 10.0.0.1:69\nwebhooks:\n  hooks:\n    - url: http://inventory/hooks\n      filenames: [\"configs/[\"]\n",
+			wantErr: ":5: webhooks.hooks[0].filenames[0]: syntax error in pattern",
+		},
+		{
+			name:    "bad probe timeout",
+			file:    "address: 10.0.0.1:69\nhealth:\n  probeTimeout: 0s\n",
+			wantErr: ":3: health.probeTimeout: must be positive",
+		},
+		{
+			name:    "bad health address from flag",
+			file:    "address: 10.0.0.1:69\nhealth:\n  address: 127.0.0.1:8086\n",
+			args:    []string{"-healthAddress", "8086"},
+			wantErr: "health.address: address 8086: missing port in address",
+		},
+		{
+			name:    "bad size",
+			file:    "address: 10.0.0.1:69\nmaxUploadSize: lots\n",
+			wantErr: "line 2: invalid size \"LOTS\"",
+		},
+		{
+			name:    "missing address",
+			file:    "minPort: 7000\n",
+			wantErr: "address: is required",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			filename := writeConfig(t, tt.file)
+			cfg, src, err := parseTestConfig(append([]string{"-config", filename}, tt.args...)...)
+			if err == nil {
+				err = cfg.Validate(src)
+			}
+			if err == nil {
+				t.Fatal("expected an error")
+			}
+			assert.Contains(t, err.Error(), tt.wantErr)
+			if tt.args != nil {
+				//errors in settings from flags have no line to point at
+				assert.Equal(t, tt.wantErr, err.Error())
+			}
+		})
+	}
+}
+
+func TestConfig_servers(t *testing.T) {
+	filename := writeConfig(t, `
+address: 0.0.0.0:69
+servers:
+  - name: lab
+    address: 10.0.0.1:69
+    readOnly: false
+    options:
+      maxBlockSize: 1468
+  - name: prod
+    address: [10.0.1.1:69, "[2001:db8::1]:69"]
+    readOnly: true
+`)
+	cfg, src, err := parseTestConfig("-config", filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.NoError(t, cfg.Validate(src))
+	assert.Equal(t, []NamedServerConfig{
+		{Name: "lab", ServerConfig: ServerConfig{Address: stringList{"10.0.0.1:69"}, Options: OptionsConfig{MaxBlockSize: 1468}}},
+		{Name: "prod", ServerConfig: ServerConfig{Address: stringList{"10.0.1.1:69", "[2001:db8::1]:69"}, ReadOnly: true}},
+	}, cfg.Servers)
+}
+
+func TestConfig_acl(t *testing.T) {
+	filename := writeConfig(t, `
+address: 0.0.0.0:69
+acl:
+  allow: 10.0.0.0/8
+  write:
+    deny: [10.0.5.0/24]
+  paths:
+    - prefix: configs/
+      write:
+        allow: 10.9.0.0/16
+servers:
+  - name: pxe
+    address: 10.0.1.1:69
+    acl:
+      allow: [10.0.1.0/24]
+      drop: true
+`)
+	cfg, src, err := parseTestConfig("-config", filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.NoError(t, cfg.Validate(src))
+
+	acl, err := cfg.ACL.acl()
+	assert.NoError(t, err)
+	ok, _ := acl.Allowed(net.ParseIP("10.9.0.1"), tftp.OpWRQ, "configs/switch")
+	assert.True(t, ok)
+	ok, reason := acl.Allowed(net.ParseIP("10.8.0.1"), tftp.OpWRQ, "configs/switch")
+	assert.False(t, ok)
+	assert.Equal(t, "denied by put acl for configs/", reason)
+
+	acl, err = cfg.Servers[0].ACL.acl()
+	assert.NoError(t, err)
+	assert.True(t, acl.Drop)
+	ok, _ = acl.Allowed(net.ParseIP("10.0.2.1"), tftp.OpRRQ, "kernel")
+	assert.False(t, ok)
+
+	acl, err = ACLConfig{}.acl()
+	assert.NoError(t, err)
+	assert.Nil(t, acl)
+}
+
+func TestConfig_limits(t *testing.T) {
+	filename := writeConfig(t, "address: 0.0.0.0:69\nlimits:\n  maxTransfers: 100\n  maxTransfersPerClient: 4\n  requestRate: 2.5\n  requestBurst: 5\n  queue: 10\n  queueTimeout: 5s\n"+
+		"  maxDuration: 10m\n  maxIdle: 30s\n  minThroughput: 8KB\n  throughputGrace: 20s\n  maxBlockRetries: 8\n")
+	cfg, src, err := parseTestConfig("-config", filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.NoError(t, cfg.Validate(src))
+	assert.Equal(t, tftp.Limits{
+		MaxTransfers:          100,
+		MaxTransfersPerClient: 4,
+		RequestRate:           2.5,
+		RequestBurst:          5,
+		Queue:                 10,
+		QueueTimeout:          time.Second * 5,
+		MaxDuration:           time.Minute * 10,
+		MaxIdle:               time.Second * 30,
+		MinThroughput:         8 << 10,
+		ThroughputGrace:       time.Second * 20,
+		MaxBlockRetries:       8,
+	}, cfg.Limits.limits())
+}
+
+func TestConfig_protection(t *testing.T) {
+	filename := writeConfig(t, "address: 0.0.0.0:69\nprotection:\n  maxUnverifiedBytes: 64KB\n  untrusted: 0.0.0.0/0\n  cookieWindow: 10s\n  abuseThreshold: 20\n  blockFor: 1h\n")
+	cfg, src, err := parseTestConfig("-config", filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.NoError(t, cfg.Validate(src))
+	p, err := cfg.Protection.protection()
+	assert.NoError(t, err)
+	assert.Equal(t, tftp.Protection{
+		MaxUnverifiedBytes: 64 << 10,
+		Untrusted:          []*net.IPNet{{IP: net.IPv4zero.To4(), Mask: net.CIDRMask(0, 32)}},
+		CookieWindow:       time.Second * 10,
+		AbuseThreshold:     20,
+		BlockFor:           time.Hour,
+	}, p)
+}
+
+func TestConfig_singlePort(t *testing.T) {
+	filename := writeConfig(t, "address: 0.0.0.0:69\nsinglePort: true\ntidClients: [10.1.0.0/16]\n")
+	cfg, src, err := parseTestConfig("-config", filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.NoError(t, cfg.Validate(src))
+	assert.True(t, cfg.SinglePort)
+	assert.Equal(t, stringList{"10.1.0.0/16"}, cfg.TIDClients)
+
+	cfg, _, err = parseTestConfig("-singlePort", "-ephemeralPorts")
+	assert.NoError(t, err)
+	assert.True(t, cfg.SinglePort)
+	assert.True(t, cfg.EphemeralPorts)
+}
+
+func TestConfig_webhooks(t *testing.T) {
+	filename := writeConfig(t, "address: 0.0.0.0:69\nwebhooks:\n  maxAttempts: 3\n  hooks:\n    - url: https://inventory/hooks/tftp\n      events: write_committed\n      filenames: [\"configs/*\"]\n      secret: s3cret\n")
+	cfg, src, err := parseTestConfig("-config", filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.NoError(t, cfg.Validate(src))
+	hooks, options := cfg.Webhooks.webhooks()
+	assert.Equal(t, []tftp.Webhook{{
+		URL:       "https://inventory/hooks/tftp",
+		Events:    []tftp.EventType{tftp.EventWriteCommitted},
+		Filenames: []string{"configs/*"},
+		Secret:    "s3cret",
+	}}, hooks)
+	assert.Equal(t, tftp.WebhookOptions{MaxAttempts: 3}, options)
+}
+
+func Test_parseByteSize(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    byteSize
+		wantErr bool
+	}{
+		{in: "0", want: 0},
+		{in: "512", want: 512},
+		{in: "512B", want: 512},
+		{in: "64KB", want: 64 << 10},
+		{in: "10 mb", want: 10 << 20},
+		{in: "2GB", want: 2 << 30},
+		{in: "1TB", want: 1 << 40},
+		{in: "-1", wantErr: true},
+		{in: "1.5GB", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			got, err := parseByteSize(tt.in)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseByteSize() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			assert.Equal(t, tt.want, got)
+		})
+	}
+	b := byteSize(64 << 20)
+	assert.Equal(t, "64MB", b.String())
+	b = byteSize(1536)
+	assert.Equal(t, "1536B", b.String())
+}
+
+func TestConfig_quotas(t *testing.T) {
+	filename := writeConfig(t, "address: 0.0.0.0:69\nmaxUploadSize: 64MB\nquotas:\n  perClient: 1GB\n  paths:\n    - prefix: configs/\n      bytes: 10MB\n")
+	cfg, src, err := parseTestConfig("-config", filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.NoError(t, cfg.Validate(src))
+
+	h := tftp.NewTFTPProtocolHandler(6000, 6100)
+	v, _ := h.VirtualServer(tftp.DefaultVirtualServer)
+	assert.NoError(t, cfg.ServerConfig.apply(v))
+	assert.Equal(t, int64(64<<20), v.MaxUploadSize)
+	assert.Equal(t, tftp.Quotas{PerClient: 1 << 30, Paths: []tftp.PathQuota{{Prefix: "configs/", Bytes: 10 << 20}}}, v.Quotas)
+}
+
+func TestConfig_String(t *testing.T) {
+	cfg, _, err := parseTestConfig("-address", "0.0.0.0:69")
+	if err != nil {
+		t.Fatal(err)
+	}
+	//printed config must be loadable as a config file and give back the same config
+	reloaded, _, err := parseTestConfig("-config", writeConfig(t, cfg.String()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, cfg, reloaded)
+
+	//but not with secrets in it
+	cfg, _, err = parseTestConfig("-config", writeConfig(t, "address: 0.0.0.0:69\nadminAddress: 127.0.0.1:8080\nadminToken: s3cret\n"+
+		"webhooks:\n  hooks:\n    - url: https://inventory/hooks/tftp\n      secret: hmac-s3cret\n    - url: https://audit/hooks/tftp\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	printed := cfg.String()
+	assert.NotContains(t, printed, "s3cret")
+	assert.Contains(t, printed, `adminToken: '***'`)
+	assert.Contains(t, printed, `secret: '***'`)
+	//hooks without a secret don't get one
+	assert.Equal(t, 1, strings.Count(printed, "secret:"))
+	assert.Equal(t, "s3cret", cfg.AdminToken)
+	assert.Equal(t, "hmac-s3cret", cfg.Webhooks.Hooks[0].Secret)
+}
@@ -0,0 +1,20 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"time"
+
+	"github.com/lienmeat/tftp/client"
+)
+
+//probeData is what the probe file is filled with when tftpd adds it to the default server
+var probeData = []byte("ok\n")
+
+//healthcheck reads the probe file from the server at address, returning its size
+func healthcheck(address string, filename string, timeout time.Duration) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	size, err := client.Get(ctx, address, filename, ioutil.Discard)
+	return int(size), err
+}
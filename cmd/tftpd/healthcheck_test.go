@@ -0,0 +1,79 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/lienmeat/tftp"
+	"github.com/lienmeat/tftp/udpserver"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_healthcheck(t *testing.T) {
+	ctx, done := context.WithCancel(context.Background())
+	defer done()
+	handler := tftp.NewTFTPProtocolHandler(6500, 6600)
+	handler.Files.Set(tftp.File{Filename: "health", Data: probeData})
+	handler.Files.Set(tftp.File{Filename: "big", Data: bytes.Repeat([]byte("a"), 1300)})
+	health := &udpserver.Health{}
+	go udpserver.ServeWithHealth(ctx, []udpserver.Listener{{Address: "127.0.0.1:6040", Handler: handler}}, health)
+	for i := 0; i < 100 && !health.Alive(); i++ {
+		time.Sleep(time.Millisecond * 10)
+	}
+
+	size, err := healthcheck("127.0.0.1:6040", "health", time.Second)
+	assert.NoError(t, err)
+	assert.Equal(t, len(probeData), size)
+
+	size, err = healthcheck("127.0.0.1:6040", "big", time.Second)
+	assert.NoError(t, err)
+	assert.Equal(t, 1300, size)
+
+	_, err = healthcheck("127.0.0.1:6040", "missing", time.Second)
+	assert.EqualError(t, err, "server error 1: file not found")
+
+	//nothing listening
+	_, err = healthcheck("127.0.0.1:6041", "health", time.Millisecond*100)
+	assert.Error(t, err)
+}
+
+func TestConfig_probeAddress(t *testing.T) {
+	tests := []struct {
+		name    string
+		cfg     Config
+		want    string
+		wantErr bool
+	}{
+		{"explicit", Config{Health: HealthConfig{ProbeAddress: "10.0.0.1:69"}}, "10.0.0.1:69", false},
+		{"wildcard", Config{ServerConfig: ServerConfig{Address: stringList{"0.0.0.0:69"}}}, "127.0.0.1:69", false},
+		{"no host", Config{ServerConfig: ServerConfig{Address: stringList{":6969"}}}, "127.0.0.1:6969", false},
+		{"ipv6 wildcard", Config{ServerConfig: ServerConfig{Address: stringList{"[::]:69"}}}, "[::1]:69", false},
+		{"specific address", Config{ServerConfig: ServerConfig{Address: stringList{"10.0.0.1:69", "10.0.0.2:69"}}}, "10.0.0.1:69", false},
+		{"no address", Config{}, "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.cfg.probeAddress()
+			assert.Equal(t, tt.wantErr, err != nil)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func Test_drain(t *testing.T) {
+	handler := tftp.NewTFTPProtocolHandler(6000, 6100)
+	finished := make(chan struct{})
+	go func() {
+		drain(handler, time.Minute, make(chan os.Signal))
+		close(finished)
+	}()
+	select {
+	case <-finished:
+	case <-time.After(time.Second):
+		t.Fatal("drain waited with no transfers running")
+	}
+	assert.True(t, handler.Draining())
+}
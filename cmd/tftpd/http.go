@@ -0,0 +1,31 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+
+	log "github.com/sirupsen/logrus"
+)
+
+//serveHTTP serves handler on address until ctx is done.  Binding happens before it returns, so a bad
+//address is reported at startup.
+func serveHTTP(ctx context.Context, address string, handler http.Handler) error {
+	l, err := net.Listen("tcp", address)
+	if err != nil {
+		return err
+	}
+	srv := &http.Server{Handler: handler}
+	go func() {
+		<-ctx.Done()
+		srv.Close()
+	}()
+	go func() {
+		if err := srv.Serve(l); err != nil && err != http.ErrServerClosed {
+			log.WithFields(log.Fields{
+				"addr": address,
+			}).Error("http server stopped: " + err.Error())
+		}
+	}()
+	return nil
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_serveHTTP(t *testing.T) {
+	ctx, done := context.WithCancel(context.Background())
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	})
+	assert.NoError(t, serveHTTP(ctx, "127.0.0.1:9108", handler))
+	//the address is taken now
+	assert.Error(t, serveHTTP(ctx, "127.0.0.1:9108", handler))
+
+	resp, err := http.Get("http://127.0.0.1:9108/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.Equal(t, "ok", string(body))
+
+	done()
+	time.Sleep(time.Millisecond * 10)
+	_, err = http.Get("http://127.0.0.1:9108/")
+	assert.Error(t, err)
+}
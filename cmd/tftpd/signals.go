@@ -0,0 +1,14 @@
+// +build !windows
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+//statusSignals make tftpd dump its status to stderr
+var statusSignals = []os.Signal{syscall.SIGUSR1}
+
+//reopenSignals make tftpd reopen its log files
+var reopenSignals = []os.Signal{syscall.SIGHUP}
@@ -0,0 +1,86 @@
+// +build !windows
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/lienmeat/tftp"
+	"github.com/stretchr/testify/assert"
+)
+
+//syncBuffer is a bytes.Buffer that can be written and read from different goroutines
+type syncBuffer struct {
+	buf bytes.Buffer
+	sync.Mutex
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.Lock()
+	defer b.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.Lock()
+	defer b.Unlock()
+	return b.buf.String()
+}
+
+func Test_dumpStatus(t *testing.T) {
+	ctx, done := context.WithCancel(context.Background())
+	defer done()
+	handler := tftp.NewTFTPProtocolHandler(6000, 6100)
+	out := &syncBuffer{}
+	go dumpStatus(ctx, handler, out)
+	//give signal.Notify a moment to be set up
+	time.Sleep(time.Millisecond * 10)
+
+	syscall.Kill(syscall.Getpid(), syscall.SIGUSR1)
+	for i := 0; i < 100 && !strings.Contains(out.String(), "TIDs in use"); i++ {
+		time.Sleep(time.Millisecond * 10)
+	}
+	assert.Contains(t, out.String(), "tftpd status at ")
+	assert.Contains(t, out.String(), "0 transfers running, 0/100 TIDs in use\n")
+}
+
+func Test_reopenLogs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tftpd-log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	name := filepath.Join(dir, "requests.log")
+	f, err := tftp.OpenRotatingFile(name, tftp.RotateOptions{})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer f.Close()
+
+	ctx, done := context.WithCancel(context.Background())
+	defer done()
+	go reopenLogs(ctx, []*tftp.RotatingFile{f})
+	time.Sleep(time.Millisecond * 10)
+
+	os.Rename(name, name+".1")
+	syscall.Kill(syscall.Getpid(), syscall.SIGHUP)
+	for i := 0; i < 100; i++ {
+		if _, err := os.Stat(name); err == nil {
+			break
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+	f.Write([]byte("after\n"))
+	data, err := ioutil.ReadFile(name)
+	assert.NoError(t, err)
+	assert.Equal(t, "after\n", string(data))
+}
@@ -0,0 +1,9 @@
+package main
+
+import "os"
+
+//statusSignals make tftpd dump its status to stderr, there's no SIGUSR1 on windows
+var statusSignals = []os.Signal{}
+
+//reopenSignals make tftpd reopen its log files, there's no SIGHUP on windows
+var reopenSignals = []os.Signal{}
@@ -4,8 +4,12 @@ import (
 	"context"
 	"flag"
 	"fmt"
+	"io"
+	"net/http"
 	"os"
+	"os/signal"
 	"runtime/trace"
+	"syscall"
 	"time"
 
 	"github.com/lienmeat/tftp"
@@ -14,29 +18,41 @@ import (
 )
 
 func main() {
-	address := flag.String("address", "", "IP address and port to use (ex: 0.0.0.0:69)")
-	minPort := flag.Int("minPort", 6000, "minimum port to use for transfers (TIDs)")
-	maxPort := flag.Int("maxPort", 9000, "maximum port to use for transfers (TIDs)")
-	logLevel := flag.String("logLevel", "info", "logging level (trace, debug, info, warn, error, panic, fatal)")
-	logFile := flag.String("logFile", "", "log file, if not set, will log to stdOut")
-	requestLogFile := flag.String("requestsLogFile", "tftp_requests.log", "requests log file, if not set, will log to tftp_requests.log")
-	traceFile := flag.String("traceFile", "", "trace execution to file")
-	flag.Parse()
-
-	if *address == "" || *minPort == 0 || *maxPort == 0 {
-		flag.Usage()
+	cfg := defaultConfig()
+	registerFlags(flag.CommandLine, &cfg)
+	configFile := flag.String("config", "", "YAML config file, flags set on the command line override values in it")
+	printConfig := flag.Bool("print-config", false, "print the effective config (defaults, config file and flags merged) and exit")
+	healthcheckOnly := flag.Bool("healthcheck", false, "read the probe file from the running server, exiting non-zero if that fails")
+
+	src, err := loadConfig(flag.CommandLine, &cfg, configFile, os.Args[1:])
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	if err := cfg.Validate(src); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		if src == nil {
+			flag.Usage()
+		}
+		os.Exit(2)
+	}
+	if *printConfig {
+		fmt.Print(cfg.String())
 		return
 	}
+	if *healthcheckOnly {
+		os.Exit(runHealthcheck(cfg))
+	}
 
 	ctx, done := context.WithCancel(context.Background())
 
-	if *traceFile != "" {
+	if cfg.TraceFile != "" {
 		//do a 90 second trace
 		go func() {
 			<-time.After(time.Second * 90)
 			done()
 		}()
-		tfh, err := os.OpenFile(*traceFile, os.O_WRONLY|os.O_CREATE, 0775)
+		tfh, err := os.OpenFile(cfg.TraceFile, os.O_WRONLY|os.O_CREATE, 0775)
 		if err != nil {
 			panic("err opening trace file: " + err.Error())
 		}
@@ -44,32 +60,233 @@ func main() {
 		defer trace.Stop()
 	}
 
-	if lvl, err := log.ParseLevel(*logLevel); err == nil {
+	if lvl, err := log.ParseLevel(cfg.LogLevel); err == nil {
 		log.SetFormatter(&log.JSONFormatter{})
 		log.SetLevel(lvl)
 	} else {
 		log.SetLevel(log.InfoLevel)
 	}
 
-	if *logFile != "" {
-		if lfh, err := os.OpenFile(*logFile, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0775); err == nil {
+	//log files are reopened on SIGHUP, so they can be rotated by logrotate
+	logFiles := []*tftp.RotatingFile{}
+	if cfg.LogFile != "" {
+		if lfh, err := tftp.OpenRotatingFile(cfg.LogFile, tftp.RotateOptions{}); err == nil {
 			defer lfh.Close()
 			log.SetOutput(lfh)
+			logFiles = append(logFiles, lfh)
 		} else {
 			panic("err opening log file: " + err.Error())
 		}
 	}
 
-	if *requestLogFile == "" {
-		*requestLogFile = "tftp_requests.log"
+	if cfg.RequestsLogFile == "" {
+		cfg.RequestsLogFile = "tftp_requests.log"
 	}
-	rlf, err := tftp.SetupRequestLog(*requestLogFile)
+	requestLog, rlf, err := tftp.OpenRequestLog(cfg.RequestsLogFile, cfg.RequestLog.Format, cfg.RequestLog.rotate())
 	if err != nil {
-		panic(fmt.Sprintf("couldn't open %s: %s", *requestLogFile, err.Error()))
+		panic(fmt.Sprintf("couldn't open %s: %s", cfg.RequestsLogFile, err.Error()))
 	}
 	defer rlf.Close()
+	logFiles = append(logFiles, rlf)
+	go reopenLogs(ctx, logFiles)
+
+	protection, err := cfg.Protection.protection()
+	if err != nil {
+		panic(err)
+	}
+	logger := tftp.LogrusLogger(log.StandardLogger())
+	options := []tftp.Option{tftp.WithLimits(cfg.Limits.limits()), tftp.WithProtection(protection),
+		tftp.WithRequestLogger(requestLog), tftp.WithLogger(logger)}
+	if cfg.EphemeralPorts {
+		options = append(options, tftp.WithEphemeralPorts())
+	}
+	if cfg.SinglePort {
+		tidClients, err := tftp.ParseNetworks(cfg.TIDClients)
+		if err != nil {
+			panic(err)
+		}
+		options = append(options, tftp.WithSinglePort(tidClients))
+	}
+	handler := tftp.NewTFTPProtocolHandler(int32(cfg.MinPort), int32(cfg.MaxPort), options...)
+	listeners, err := buildServers(cfg, handler)
+	if err != nil {
+		panic(err)
+	}
+
+	if cfg.Health.ProbeFile != "" {
+		def, _ := handler.VirtualServer(tftp.DefaultVirtualServer)
+		if _, ok := def.Files.Get(cfg.Health.ProbeFile); !ok {
+			def.Files.Set(tftp.File{Filename: cfg.Health.ProbeFile, Data: probeData, Modified: time.Now()})
+		}
+	}
+
+	if len(cfg.Webhooks.Hooks) > 0 {
+		hooks, options := cfg.Webhooks.webhooks()
+		options.Logger = logger
+		webhooks := tftp.NewWebhookDispatcher(hooks, options)
+		go webhooks.Run(ctx)
+		handler.Subscribe(webhooks.Notify)
+	}
+
+	go dumpStatus(ctx, handler, os.Stderr)
+	go func() {
+		sigs := make(chan os.Signal, 1)
+		signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+		select {
+		case <-ctx.Done():
+			return
+		case <-sigs:
+		}
+		drain(handler, cfg.DrainTimeout, sigs)
+		done()
+	}()
+
+	if cfg.MetricsAddress != "" {
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", handler.Metrics)
+		if err := serveHTTP(ctx, cfg.MetricsAddress, mux); err != nil {
+			panic(err)
+		}
+	}
 
-	if err := udpserver.Server(ctx, *address, tftp.NewTFTPProtocolHandler(int32(*minPort), int32(*maxPort))); err != nil {
+	if cfg.AdminAddress != "" {
+		if err := serveHTTP(ctx, cfg.AdminAddress, tftp.NewAdminHandler(handler, cfg.AdminToken)); err != nil {
+			panic(err)
+		}
+	}
+
+	health := &udpserver.Health{}
+	if cfg.Health.Address != "" {
+		if err := serveHTTP(ctx, cfg.Health.Address, tftp.NewHealthHandler(handler, health)); err != nil {
+			panic(err)
+		}
+	}
+
+	if err := udpserver.ServeWithHealth(ctx, listeners, health, udpserver.WithLogger(logger)); err != nil {
 		panic(err)
 	}
 }
+
+//runHealthcheck reads the probe file from the server, returning the exit code for tftpd -healthcheck
+func runHealthcheck(cfg Config) int {
+	if cfg.Health.ProbeFile == "" {
+		fmt.Fprintln(os.Stderr, "health.probeFile is required for -healthcheck")
+		return 2
+	}
+	address, err := cfg.probeAddress()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	size, err := healthcheck(address, cfg.Health.ProbeFile, cfg.Health.ProbeTimeout)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "unhealthy: reading %s from %s: %s\n", cfg.Health.ProbeFile, address, err)
+		return 1
+	}
+	fmt.Printf("healthy: read %d bytes of %s from %s\n", size, cfg.Health.ProbeFile, address)
+	return 0
+}
+
+//drain stops new transfers and waits up to timeout for the running ones to finish, or for another signal
+func drain(handler *tftp.TFTPProtocolHandler, timeout time.Duration, sigs <-chan os.Signal) {
+	handler.Drain()
+	log.WithFields(log.Fields{
+		"transfers": len(handler.Transfers.List()),
+		"timeout":   timeout.String(),
+	}).Info("draining")
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+	tick := time.NewTicker(time.Millisecond * 100)
+	defer tick.Stop()
+	for len(handler.Transfers.List()) > 0 {
+		select {
+		case <-deadline.C:
+			log.WithFields(log.Fields{
+				"transfers": len(handler.Transfers.List()),
+			}).Warn("drain timed out, stopping anyway")
+			return
+		case <-sigs:
+			log.Warn("signalled again, stopping without waiting for transfers")
+			return
+		case <-tick.C:
+		}
+	}
+}
+
+//dumpStatus writes the handler's status to w whenever one of statusSignals is received, until ctx is done
+func dumpStatus(ctx context.Context, handler *tftp.TFTPProtocolHandler, w io.Writer) {
+	if len(statusSignals) == 0 {
+		return
+	}
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, statusSignals...)
+	defer signal.Stop(sigs)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-sigs:
+			fmt.Fprintf(w, "tftpd status at %s\n", time.Now().Format(time.RFC3339))
+			handler.WriteStatus(w)
+		}
+	}
+}
+
+//reopenLogs reopens files on the reopenSignals, after they've been moved aside by something like logrotate
+func reopenLogs(ctx context.Context, files []*tftp.RotatingFile) {
+	if len(reopenSignals) == 0 {
+		return
+	}
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, reopenSignals...)
+	defer signal.Stop(sigs)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-sigs:
+			for _, f := range files {
+				if err := f.Reopen(); err != nil {
+					fmt.Fprintf(os.Stderr, "couldn't reopen %s: %s\n", f.Filename, err.Error())
+				}
+			}
+		}
+	}
+}
+
+//buildServers sets up a virtual server on handler for each server in the config, returning
+//the listeners that serve them
+func buildServers(cfg Config, handler *tftp.TFTPProtocolHandler) ([]udpserver.Listener, error) {
+	listeners := []udpserver.Listener{}
+
+	acl, err := cfg.ACL.acl()
+	if err != nil {
+		return nil, err
+	}
+	handler.ACL = acl
+
+	def, _ := handler.VirtualServer(tftp.DefaultVirtualServer)
+	if err := cfg.ServerConfig.apply(def); err != nil {
+		return nil, err
+	}
+	for _, a := range cfg.Address {
+		listeners = append(listeners, udpserver.Listener{Address: a, Handler: def})
+	}
+
+	for _, sc := range cfg.Servers {
+		v, err := handler.NewVirtualServer(sc.Name)
+		if err != nil {
+			return nil, err
+		}
+		if err := sc.apply(v); err != nil {
+			return nil, err
+		}
+		if v.ACL, err = sc.ACL.acl(); err != nil {
+			return nil, err
+		}
+		for _, a := range sc.Address {
+			listeners = append(listeners, udpserver.Listener{Address: a, Handler: v})
+		}
+	}
+	return listeners, nil
+}
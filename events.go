@@ -0,0 +1,130 @@
+package tftp
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/lienmeat/tftp/clock"
+)
+
+//EventType says what happened to a transfer
+type EventType string
+
+//Transfer events, in the order a transfer goes through them
+const (
+	//EventRequest is a RRQ or WRQ received, before it's checked against ACLs and the server's files
+	EventRequest EventType = "request"
+	//EventOptionsNegotiated is options agreed with the client, in Options
+	EventOptionsNegotiated EventType = "options_negotiated"
+	//EventStarted is a request accepted, the transfer is under way
+	EventStarted EventType = "started"
+	//EventProgress is sent as blocks are moved, at most once per progress interval
+	EventProgress EventType = "progress"
+	//EventWriteCommitted is an uploaded file stored, it's now served to other clients
+	EventWriteCommitted EventType = "write_committed"
+	//EventCompleted is a transfer that finished successfully
+	EventCompleted EventType = "completed"
+	//EventFailed is a transfer that didn't finish, Outcome says why and Code is the TFTP error code sent or received
+	EventFailed EventType = "failed"
+)
+
+//allEventTypes are all the EventTypes
+var allEventTypes = []EventType{EventRequest, EventOptionsNegotiated, EventStarted, EventProgress, EventWriteCommitted, EventCompleted, EventFailed}
+
+//ParseEventType returns the EventType named s
+func ParseEventType(s string) (EventType, error) {
+	for _, t := range allEventTypes {
+		if string(t) == s {
+			return t, nil
+		}
+	}
+	return "", fmt.Errorf("unknown event type %s", s)
+}
+
+//defaultProgressInterval is how often EventProgress is sent for a transfer
+const defaultProgressInterval = time.Second
+
+//Event is something that happened to a transfer
+type Event struct {
+	Type EventType `json:"type"`
+	Time time.Time `json:"time"`
+	//TransferID matches the ID in the TransferRegistry
+	TransferID uint64 `json:"transfer_id"`
+	Server     string `json:"server"`
+	Peer       string `json:"peer"`
+	//Op is get or put
+	Op       string `json:"op"`
+	Filename string `json:"filename"`
+	//Options are the requested options for EventRequest, and the negotiated ones for EventOptionsNegotiated
+	Options map[string]string `json:"options,omitempty"`
+	//Block is the block the transfer is on
+	Block uint `json:"block,omitempty"`
+	//Bytes is how much of the file has been moved
+	Bytes int64 `json:"bytes"`
+	//Size is the size of the file, as far as it's known
+	Size int64 `json:"size"`
+	//Duration is how long the transfer ran, for EventCompleted and EventFailed
+	Duration time.Duration `json:"duration,omitempty"`
+	//Outcome and Code are set for EventFailed
+	Outcome string `json:"outcome,omitempty"`
+	Code    uint16 `json:"code,omitempty"`
+}
+
+//eventHub passes events to subscribers
+type eventHub struct {
+	next        int
+	subscribers map[int]func(Event)
+	//clock stamps events with the time
+	clock clock.Clock
+	sync.RWMutex
+}
+
+func newEventHub() *eventHub {
+	return &eventHub{subscribers: map[int]func(Event){}, clock: clock.Real}
+}
+
+func (e *eventHub) subscribe(callback func(Event)) (unsubscribe func()) {
+	e.Lock()
+	defer e.Unlock()
+	e.next++
+	id := e.next
+	e.subscribers[id] = callback
+	return func() {
+		e.Lock()
+		defer e.Unlock()
+		delete(e.subscribers, id)
+	}
+}
+
+func (e *eventHub) emit(event Event) {
+	e.RLock()
+	defer e.RUnlock()
+	if len(e.subscribers) == 0 {
+		return
+	}
+	if event.Time.IsZero() {
+		event.Time = e.clock.Now()
+	}
+	for _, callback := range e.subscribers {
+		callback(event)
+	}
+}
+
+//Subscribe calls callback with every transfer event, until unsubscribe is called.  It's called from the
+//goroutine running the transfer, so it must be quick; hand slow work off, or use Events.
+func (h *TFTPProtocolHandler) Subscribe(callback func(Event)) (unsubscribe func()) {
+	return h.events.subscribe(callback)
+}
+
+//Events sends every transfer event to the returned channel, until unsubscribe is called.  Events are
+//dropped rather than slowing down transfers if the channel's buffer is full.
+func (h *TFTPProtocolHandler) Events(buffer int) (events <-chan Event, unsubscribe func()) {
+	ch := make(chan Event, buffer)
+	return ch, h.events.subscribe(func(e Event) {
+		select {
+		case ch <- e:
+		default:
+		}
+	})
+}
@@ -0,0 +1,130 @@
+package tftp
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/lienmeat/tftp/udpserver"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTFTPProtocolHandler_Subscribe(t *testing.T) {
+	h := NewTFTPProtocolHandler(6000, 6100)
+	var got []Event
+	unsubscribe := h.Subscribe(func(e Event) {
+		got = append(got, e)
+	})
+	h.events.emit(Event{Type: EventStarted})
+	unsubscribe()
+	h.events.emit(Event{Type: EventCompleted})
+	if assert.Len(t, got, 1) {
+		assert.Equal(t, EventStarted, got[0].Type)
+		assert.False(t, got[0].Time.IsZero())
+	}
+
+	//a full channel drops events instead of blocking the transfer
+	events, unsubscribe := h.Events(1)
+	defer unsubscribe()
+	h.events.emit(Event{Type: EventStarted})
+	h.events.emit(Event{Type: EventProgress})
+	assert.Equal(t, EventStarted, (<-events).Type)
+	select {
+	case e := <-events:
+		t.Errorf("got %s, should have been dropped", e.Type)
+	default:
+	}
+}
+
+//eventTypes collects the types of the events in events until a transfer ends
+func eventTypes(t *testing.T, events <-chan Event) (types []EventType, last Event) {
+	for {
+		select {
+		case e := <-events:
+			types = append(types, e.Type)
+			if e.Type == EventCompleted || e.Type == EventFailed {
+				return types, e
+			}
+		case <-time.After(time.Second):
+			t.Fatal("transfer didn't end")
+			return
+		}
+	}
+}
+
+func TestTransferWorker_events(t *testing.T) {
+	client := &net.UDPAddr{IP: net.ParseIP("10.0.0.1"), Port: 5000}
+	tests := []struct {
+		name    string
+		packets []Packet
+		want    []EventType
+		check   func(t *testing.T, last Event)
+	}{
+		{
+			name: "get with options",
+			packets: []Packet{
+				&PacketRequest{Op: OpRRQ, Filename: "kernel", Mode: "octet", Options: map[string]string{"blksize": "512"}},
+				&PacketAck{BlockNum: 0},
+				&PacketAck{BlockNum: 1},
+				&PacketAck{BlockNum: 2},
+			},
+			want: []EventType{EventRequest, EventOptionsNegotiated, EventStarted, EventProgress, EventProgress, EventCompleted},
+			check: func(t *testing.T, last Event) {
+				assert.Equal(t, "kernel", last.Filename)
+				assert.Equal(t, "get", last.Op)
+				assert.Equal(t, "10.0.0.1:5000", last.Peer)
+				assert.Equal(t, int64(1024), last.Bytes)
+				assert.Equal(t, uint64(1), last.TransferID)
+			},
+		},
+		{
+			name: "put",
+			packets: []Packet{
+				&PacketRequest{Op: OpWRQ, Filename: "config", Mode: "octet"},
+				&PacketData{BlockNum: 1, Data: []byte("hostname switch1")},
+			},
+			want: []EventType{EventRequest, EventStarted, EventWriteCommitted, EventCompleted},
+			check: func(t *testing.T, last Event) {
+				assert.Equal(t, "put", last.Op)
+				assert.Equal(t, int64(16), last.Size)
+			},
+		},
+		{
+			name:    "missing file",
+			packets: []Packet{&PacketRequest{Op: OpRRQ, Filename: "missing", Mode: "octet"}},
+			want:    []EventType{EventRequest, EventFailed},
+			check: func(t *testing.T, last Event) {
+				assert.Equal(t, "failed", last.Outcome)
+				assert.Equal(t, uint16(1), last.Code)
+				assert.Equal(t, "missing", last.Filename)
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := NewTFTPProtocolHandler(6000, 6100)
+			h.progressInterval = 0
+			h.Files.Set(File{Filename: "kernel", Data: make([]byte, 1024)})
+			events, unsubscribe := h.Events(20)
+			defer unsubscribe()
+
+			//responses fit in out's buffer, so they don't need to be read
+			in, _, done := startTestWorker(h)
+			for _, p := range tt.packets {
+				in <- udpserver.NewUDPPacket(client, p.Serialize())
+			}
+			<-done
+			types, last := eventTypes(t, events)
+			assert.Equal(t, tt.want, types)
+			tt.check(t, last)
+		})
+	}
+}
+
+func TestParseEventType(t *testing.T) {
+	e, err := ParseEventType("write_committed")
+	assert.NoError(t, err)
+	assert.Equal(t, EventWriteCommitted, e)
+	_, err = ParseEventType("finished")
+	assert.EqualError(t, err, "unknown event type finished")
+}
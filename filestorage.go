@@ -2,7 +2,12 @@ package tftp
 
 import (
 	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
 	"sync"
+	"time"
 )
 
 const BlockSize uint = 512
@@ -10,6 +15,10 @@ const BlockSize uint = 512
 type File struct {
 	Filename string
 	Data     []byte
+	//IP of the client that uploaded the file, empty if it didn't come from a client
+	Owner string
+	//when the file was stored, or modified on disk for files loaded from a directory
+	Modified time.Time
 }
 
 func NewFile(filename string) File {
@@ -17,11 +26,16 @@ func NewFile(filename string) File {
 }
 
 func (f *File) WriteBlock(n uint, block []byte) (size uint, err error) {
+	return f.WriteSizedBlock(n, BlockSize, block)
+}
+
+//WriteSizedBlock appends block n of a file being transferred with a negotiated block size
+func (f *File) WriteSizedBlock(n uint, blockSize uint, block []byte) (size uint, err error) {
 	l := uint(len(f.Data))
-	if uint(len(block)) > BlockSize {
-		return l, fmt.Errorf("a block can be a maximum of %d bytes long", BlockSize)
+	if uint(len(block)) > blockSize {
+		return l, fmt.Errorf("a block can be a maximum of %d bytes long", blockSize)
 	}
-	if l/BlockSize != n-1 {
+	if l/blockSize != n-1 {
 		//only allow adding blocks to the end of the file, never write to the middle
 		return l, fmt.Errorf("can't write block to %d", n)
 	} else {
@@ -32,13 +46,18 @@ func (f *File) WriteBlock(n uint, block []byte) (size uint, err error) {
 }
 
 func (f *File) ReadBlock(n uint) (block []byte, ok bool) {
+	return f.ReadSizedBlock(n, BlockSize)
+}
+
+//ReadSizedBlock reads block n of a file being transferred with a negotiated block size
+func (f *File) ReadSizedBlock(n uint, blockSize uint) (block []byte, ok bool) {
 	block = []byte{}
 	if f.Data == nil {
 		return block, false
 	}
 	l := uint(len(f.Data))
-	start := (n - 1) * BlockSize
-	end := start + BlockSize
+	start := (n - 1) * blockSize
+	end := start + blockSize
 	if l == 0 && start == 0 {
 		return f.Data, true
 	} else if l > start {
@@ -75,3 +94,61 @@ func (r *FileRepo) Get(filename string) (file File, ok bool) {
 	file, ok = r.ff[filename]
 	return file, ok
 }
+
+//Delete removes a file, returning false if there was no such file
+func (r *FileRepo) Delete(filename string) bool {
+	r.Lock()
+	defer r.Unlock()
+	_, ok := r.ff[filename]
+	delete(r.ff, filename)
+	return ok
+}
+
+//List returns every file, sorted by name
+func (r *FileRepo) List() []File {
+	r.RLock()
+	defer r.RUnlock()
+	ff := make([]File, 0, len(r.ff))
+	for _, f := range r.ff {
+		ff = append(ff, f)
+	}
+	sort.Slice(ff, func(i, j int) bool { return ff[i].Filename < ff[j].Filename })
+	return ff
+}
+
+//Usage adds up the size of every file that match returns true for
+func (r *FileRepo) Usage(match func(f File) bool) (bytes int64) {
+	r.RLock()
+	defer r.RUnlock()
+	for _, f := range r.ff {
+		if match(f) {
+			bytes += int64(len(f.Data))
+		}
+	}
+	return bytes
+}
+
+//LoadDir adds every regular file under dir to the repo, named by its slash separated path relative to dir.
+//Returns the number of files loaded.
+func (r *FileRepo) LoadDir(dir string) (n int, err error) {
+	err = filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		r.Set(File{Filename: filepath.ToSlash(rel), Data: data, Modified: info.ModTime()})
+		n++
+		return nil
+	})
+	return n, err
+}
@@ -2,7 +2,10 @@ package tftp
 
 import (
 	"bytes"
+	"io/ioutil"
 	"math"
+	"os"
+	"path/filepath"
 	"testing"
 
 	log "github.com/sirupsen/logrus"
@@ -248,3 +251,62 @@ func TestFile_ReadBlock(t *testing.T) {
 		})
 	}
 }
+
+func TestFile_SizedBlocks(t *testing.T) {
+	f := NewFile("test")
+	_, err := f.WriteSizedBlock(1, 1024, bytes.Repeat([]byte("a"), 1024))
+	assert.NoError(t, err)
+	_, err = f.WriteSizedBlock(2, 1024, bytes.Repeat([]byte("b"), 1025))
+	assert.Error(t, err)
+	size, err := f.WriteSizedBlock(2, 1024, bytes.Repeat([]byte("b"), 10))
+	assert.NoError(t, err)
+	assert.Equal(t, uint(1034), size)
+
+	block, ok := f.ReadSizedBlock(1, 1024)
+	assert.True(t, ok)
+	assert.Equal(t, bytes.Repeat([]byte("a"), 1024), block)
+	block, ok = f.ReadSizedBlock(2, 1024)
+	assert.True(t, ok)
+	assert.Equal(t, bytes.Repeat([]byte("b"), 10), block)
+	_, ok = f.ReadSizedBlock(3, 1024)
+	assert.False(t, ok)
+}
+
+func TestFileRepo_LoadDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tftp-loaddir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	os.MkdirAll(filepath.Join(dir, "pxelinux.cfg"), 0755)
+	ioutil.WriteFile(filepath.Join(dir, "kernel"), []byte("kernel"), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "pxelinux.cfg", "default"), []byte("default"), 0644)
+
+	r := NewFileRepo()
+	n, err := r.LoadDir(dir)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, n)
+
+	f, ok := r.Get("kernel")
+	assert.True(t, ok)
+	assert.Equal(t, []byte("kernel"), f.Data)
+	info, _ := os.Stat(filepath.Join(dir, "kernel"))
+	assert.Equal(t, info.ModTime(), f.Modified)
+	f, ok = r.Get("pxelinux.cfg/default")
+	assert.True(t, ok)
+	assert.Equal(t, []byte("default"), f.Data)
+
+	_, err = r.LoadDir(filepath.Join(dir, "missing"))
+	assert.Error(t, err)
+}
+
+func TestFileRepo_ListDelete(t *testing.T) {
+	r := NewFileRepo()
+	r.Set(File{Filename: "b", Data: []byte("b")})
+	r.Set(File{Filename: "a", Data: []byte("a")})
+
+	assert.Equal(t, []File{{Filename: "a", Data: []byte("a")}, {Filename: "b", Data: []byte("b")}}, r.List())
+	assert.True(t, r.Delete("a"))
+	assert.False(t, r.Delete("a"))
+	assert.Equal(t, []File{{Filename: "b", Data: []byte("b")}}, r.List())
+}
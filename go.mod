@@ -1,8 +1,14 @@
 module github.com/lienmeat/tftp
 
+go 1.13
+
 require (
 	github.com/sirupsen/logrus v1.2.0
 	github.com/stretchr/testify v1.2.2
+	gopkg.in/yaml.v3 v3.0.1
+)
+
+require (
 	golang.org/x/crypto v0.0.0-20181203042331-505ab145d0a9 // indirect
 	golang.org/x/sys v0.0.0-20181221143128-b4a75ba826a6 // indirect
 )
@@ -0,0 +1,73 @@
+package tftp
+
+import (
+	"errors"
+	"net/http"
+	"sync/atomic"
+
+	"github.com/lienmeat/tftp/udpserver"
+)
+
+var (
+	errDraining   = limitError("server is draining")
+	errNoTIDs     = errors.New("no free transfer ports (TIDs)")
+	errNoFiles    = errors.New("virtual server has no file store")
+	errClientBusy = limitError("a transfer from this port is already running")
+)
+
+//Drain stops the handler from starting new transfers, so it can be shut down once the running ones finish
+func (h *TFTPProtocolHandler) Drain() {
+	atomic.StoreInt32(&h.draining, 1)
+}
+
+//Draining checks if Drain was called
+func (h *TFTPProtocolHandler) Draining() bool {
+	return atomic.LoadInt32(&h.draining) == 1
+}
+
+//Ready checks the handler can take new transfers: it isn't draining, and there's a free TID to run a
+//transfer on, or the kernel can pick one.  Files are kept in memory, so there's no storage to reach; it
+//only catches a VirtualServer whose Files was left nil, which couldn't serve anything.
+func (h *TFTPProtocolHandler) Ready() error {
+	if h.Draining() {
+		return errDraining
+	}
+	for _, v := range h.VirtualServers() {
+		if v.Files == nil {
+			return errors.New(v.Name + ": " + errNoFiles.Error())
+		}
+	}
+	if used, size := h.TIDs.Usage(); used >= size && !h.ephemeralPorts {
+		return errNoTIDs
+	}
+	return nil
+}
+
+//NewHealthHandler serves liveness and readiness checks for a handler served by udpserver.ServeWithHealth.
+//
+//	GET /healthz    200 while the listeners are running
+//	GET /readyz     200 while the listeners are running and the handler is Ready
+//
+//Failed checks get a 503 saying why.
+func NewHealthHandler(handler *TFTPProtocolHandler, listeners *udpserver.Health) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		if !listeners.Alive() {
+			http.Error(w, "listeners are not running", http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte("ok\n"))
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		if !listeners.Alive() {
+			http.Error(w, "listeners are not running", http.StatusServiceUnavailable)
+			return
+		}
+		if err := handler.Ready(); err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte("ok\n"))
+	})
+	return mux
+}
@@ -0,0 +1,85 @@
+package tftp
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/lienmeat/tftp/udpserver"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTFTPProtocolHandler_Ready(t *testing.T) {
+	h := NewTFTPProtocolHandler(6000, 6002)
+	assert.NoError(t, h.Ready())
+
+	h.TIDs.New()
+	h.TIDs.New()
+	assert.Equal(t, errNoTIDs, h.Ready())
+	//unless the kernel can pick ports
+	h = NewTFTPProtocolHandler(6000, 6001, WithEphemeralPorts())
+	h.TIDs.New()
+	assert.NoError(t, h.Ready())
+
+	h = NewTFTPProtocolHandler(6000, 6100)
+	v, _ := h.NewVirtualServer("lab")
+	v.Files = nil
+	assert.EqualError(t, h.Ready(), "lab: virtual server has no file store")
+
+	h = NewTFTPProtocolHandler(6000, 6100)
+	assert.False(t, h.Draining())
+	h.Drain()
+	assert.True(t, h.Draining())
+	assert.Equal(t, errDraining, h.Ready())
+}
+
+func TestTFTPProtocolHandler_drainRefusesRequests(t *testing.T) {
+	h := NewTFTPProtocolHandler(6000, 6100)
+	h.Drain()
+	def, _ := h.VirtualServer(DefaultVirtualServer)
+	responses := make(chan *udpserver.UDPPacket, 1)
+	client := &net.UDPAddr{IP: net.ParseIP("10.0.0.1"), Port: 5000}
+	h.startTransfer(context.Background(), def, udpserver.NewUDPPacket(client, (&PacketRequest{Op: OpRRQ, Filename: "test", Mode: "octet"}).Serialize()), responses)
+	assert.Equal(t, (&PacketError{Code: 0, Msg: "server is draining"}).Serialize(), (<-responses).Data())
+	assert.Empty(t, h.limiter.perClient)
+}
+
+func TestNewHealthHandler(t *testing.T) {
+	h := NewTFTPProtocolHandler(6000, 6100)
+	health := &udpserver.Health{}
+	api := NewHealthHandler(h, health)
+	get := func(path string) (int, string) {
+		w := httptest.NewRecorder()
+		api.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		return w.Code, w.Body.String()
+	}
+
+	code, body := get("/healthz")
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.Equal(t, "listeners are not running\n", body)
+	code, _ = get("/readyz")
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+
+	ctx, done := context.WithCancel(context.Background())
+	defer done()
+	go udpserver.ServeWithHealth(ctx, []udpserver.Listener{{Address: "127.0.0.1:6020", Handler: h}}, health)
+	for i := 0; i < 100 && !health.Alive(); i++ {
+		time.Sleep(time.Millisecond * 10)
+	}
+
+	code, body = get("/healthz")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "ok\n", body)
+	code, _ = get("/readyz")
+	assert.Equal(t, http.StatusOK, code)
+
+	h.Drain()
+	code, body = get("/readyz")
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.Equal(t, "server is draining\n", body)
+	code, _ = get("/healthz")
+	assert.Equal(t, http.StatusOK, code)
+}
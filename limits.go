@@ -0,0 +1,257 @@
+package tftp
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/lienmeat/tftp/clock"
+)
+
+//Limits caps how much of the server clients can use.  Zero values mean no limit.
+type Limits struct {
+	//MaxTransfers is the most transfers that can run at once, across every VirtualServer
+	MaxTransfers int
+	//MaxTransfersPerClient is the most transfers one client IP can run at once
+	MaxTransfersPerClient int
+	//RequestRate is how many new requests per second each client IP may make, in bursts of up to RequestBurst
+	RequestRate  float64
+	RequestBurst int
+	//Queue is how many requests over a transfer limit may wait for a slot, for up to QueueTimeout.
+	//Requests that can't be queued are refused.
+	Queue        int
+	QueueTimeout time.Duration
+	//Drop silently ignores refused requests, instead of replying with an error
+	Drop bool
+	//MaxDuration is the longest a transfer may run, and MaxIdle the longest it may go without moving a block
+	MaxDuration time.Duration
+	MaxIdle     time.Duration
+	//MinThroughput is the fewest bytes per second a transfer may move on average, once it has run for
+	//ThroughputGrace, 10s by default
+	MinThroughput   int64
+	ThroughputGrace time.Duration
+	//MaxBlockRetries is how many times the same block may be resent, 5 by default.  Transfers breaking
+	//any of these limits are aborted with an error sent to the client.
+	MaxBlockRetries int
+}
+
+//limitError says why a request was refused
+type limitError string
+
+func (e limitError) Error() string {
+	return string(e)
+}
+
+const (
+	errRateLimited   = limitError("request rate limit exceeded")
+	errTooManyClient = limitError("too many transfers from client")
+	errTooManyServer = limitError("too many transfers")
+	errQueueFull     = limitError("too many transfers, queue is full")
+	errQueueTimeout  = limitError("too many transfers, timed out waiting in queue")
+
+	errTransferTooLong = limitError("transfer took too long")
+	errTransferIdle    = limitError("transfer idle for too long")
+	errTransferTooSlow = limitError("transfer too slow")
+	errTooManyRetries  = limitError("too many retries, giving up")
+)
+
+const (
+	defaultMaxBlockRetries = 5
+	defaultThroughputGrace = time.Second * 10
+)
+
+//bucketPruneInterval is how often idle clients' token buckets are forgotten
+const bucketPruneInterval = time.Minute
+
+//limiter enforces Limits.  Every slot taken by acquire or wait must be given back with release.
+type limiter struct {
+	limits    Limits
+	active    int
+	perClient map[string]int
+	queued    int
+	//closed and replaced whenever a slot is released, to wake up queued requests
+	released  chan struct{}
+	buckets   map[string]*tokenBucket
+	lastPrune time.Time
+	clock     clock.Clock
+	sync.Mutex
+}
+
+func newLimiter(limits Limits) *limiter {
+	return &limiter{
+		limits:    limits,
+		perClient: map[string]int{},
+		released:  make(chan struct{}),
+		buckets:   map[string]*tokenBucket{},
+		lastPrune: clock.Real.Now(),
+		clock:     clock.Real,
+	}
+}
+
+//useClock makes the limiter tell the time with c
+func (l *limiter) useClock(c clock.Clock) {
+	l.Lock()
+	defer l.Unlock()
+	l.clock = c
+	l.lastPrune = c.Now()
+}
+
+//acquire takes a transfer slot for client if one is free.  If not, and there's room in the queue,
+//the request is queued and wait must be called to get a slot.
+func (l *limiter) acquire(client string) (queued bool, err error) {
+	l.Lock()
+	defer l.Unlock()
+	if !l.allowRequest(client, l.clock.Now()) {
+		return false, errRateLimited
+	}
+	err = l.tryAcquire(client)
+	if err == nil || l.limits.Queue == 0 {
+		return false, err
+	}
+	if l.queued >= l.limits.Queue {
+		return false, errQueueFull
+	}
+	l.queued++
+	return true, nil
+}
+
+//wait waits for a slot for a request queued by acquire
+func (l *limiter) wait(ctx context.Context, client string) error {
+	defer func() {
+		l.Lock()
+		l.queued--
+		l.Unlock()
+	}()
+	timeout := l.clock.NewTimer(l.limits.QueueTimeout)
+	defer timeout.Stop()
+	for {
+		l.Lock()
+		err := l.tryAcquire(client)
+		released := l.released
+		l.Unlock()
+		if err == nil {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-timeout.C():
+			return errQueueTimeout
+		case <-released:
+		}
+	}
+}
+
+//tryAcquire takes a slot if one is free, must hold the lock
+func (l *limiter) tryAcquire(client string) error {
+	if l.limits.MaxTransfers > 0 && l.active >= l.limits.MaxTransfers {
+		return errTooManyServer
+	}
+	if l.limits.MaxTransfersPerClient > 0 && l.perClient[client] >= l.limits.MaxTransfersPerClient {
+		return errTooManyClient
+	}
+	l.active++
+	l.perClient[client]++
+	return nil
+}
+
+//release gives back a slot taken by acquire
+func (l *limiter) release(client string) {
+	l.Lock()
+	defer l.Unlock()
+	l.active--
+	if l.perClient[client]--; l.perClient[client] <= 0 {
+		delete(l.perClient, client)
+	}
+	close(l.released)
+	l.released = make(chan struct{})
+}
+
+//allowRequest takes a token from client's bucket, must hold the lock
+func (l *limiter) allowRequest(client string, now time.Time) bool {
+	if l.limits.RequestRate <= 0 {
+		return true
+	}
+	if now.Sub(l.lastPrune) > bucketPruneInterval {
+		l.pruneBuckets(now)
+	}
+	b, ok := l.buckets[client]
+	if !ok {
+		burst := float64(l.limits.RequestBurst)
+		if burst < 1 {
+			burst = 1
+		}
+		b = &tokenBucket{rate: l.limits.RequestRate, burst: burst, tokens: burst, last: now}
+		l.buckets[client] = b
+	}
+	return b.take(now)
+}
+
+//pruneBuckets forgets clients whose buckets have refilled, so the map doesn't grow forever
+func (l *limiter) pruneBuckets(now time.Time) {
+	for client, b := range l.buckets {
+		if b.full(now) {
+			delete(l.buckets, client)
+		}
+	}
+	l.lastPrune = now
+}
+
+//tokenBucket refills at rate tokens per second, up to burst
+type tokenBucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func (b *tokenBucket) refill(now time.Time) {
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+}
+
+func (b *tokenBucket) take(now time.Time) bool {
+	b.refill(now)
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+func (b *tokenBucket) full(now time.Time) bool {
+	b.refill(now)
+	return b.tokens >= b.burst
+}
+
+//maxBlockRetries is how many times the same block may be resent
+func (l Limits) maxBlockRetries() int {
+	if l.MaxBlockRetries <= 0 {
+		return defaultMaxBlockRetries
+	}
+	return l.MaxBlockRetries
+}
+
+//checkTransfer returns why a transfer that started at started, last moved a block at active and has moved
+//bytes so far has to be aborted now, or nil if it can go on
+func (l Limits) checkTransfer(started time.Time, active time.Time, now time.Time, bytes int64) error {
+	running := now.Sub(started)
+	if l.MaxDuration > 0 && running > l.MaxDuration {
+		return errTransferTooLong
+	}
+	if l.MaxIdle > 0 && now.Sub(active) > l.MaxIdle {
+		return errTransferIdle
+	}
+	grace := l.ThroughputGrace
+	if grace <= 0 {
+		grace = defaultThroughputGrace
+	}
+	if l.MinThroughput > 0 && running >= grace && float64(bytes)/running.Seconds() < float64(l.MinThroughput) {
+		return errTransferTooSlow
+	}
+	return nil
+}
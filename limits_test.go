@@ -0,0 +1,195 @@
+package tftp
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/lienmeat/tftp/clock"
+	"github.com/lienmeat/tftp/udpserver"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_limiter_transfers(t *testing.T) {
+	l := newLimiter(Limits{MaxTransfers: 3, MaxTransfersPerClient: 2})
+
+	for _, c := range []string{"a", "a", "b"} {
+		queued, err := l.acquire(c)
+		assert.NoError(t, err)
+		assert.False(t, queued)
+	}
+	_, err := l.acquire("b")
+	assert.Equal(t, errTooManyServer, err)
+
+	l.release("b")
+	_, err = l.acquire("a")
+	assert.Equal(t, errTooManyClient, err)
+	_, err = l.acquire("c")
+	assert.NoError(t, err)
+}
+
+func Test_limiter_queue(t *testing.T) {
+	ctx := context.Background()
+	l := newLimiter(Limits{MaxTransfers: 1, Queue: 1, QueueTimeout: time.Millisecond * 50})
+
+	_, err := l.acquire("a")
+	assert.NoError(t, err)
+
+	queued, err := l.acquire("b")
+	assert.NoError(t, err)
+	assert.True(t, queued)
+
+	_, err = l.acquire("c")
+	assert.Equal(t, errQueueFull, err)
+
+	//b gets the slot once a releases it
+	waited := make(chan error)
+	go func() { waited <- l.wait(ctx, "b") }()
+	time.Sleep(time.Millisecond * 5)
+	l.release("a")
+	assert.NoError(t, <-waited)
+
+	//c times out waiting, since b never releases
+	fake := clock.NewFake(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+	l.useClock(fake)
+	queued, err = l.acquire("c")
+	assert.NoError(t, err)
+	assert.True(t, queued)
+	go func() { waited <- l.wait(ctx, "c") }()
+	for fake.Pending() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	fake.Advance(time.Millisecond * 49)
+	select {
+	case err := <-waited:
+		t.Fatalf("stopped waiting early: %v", err)
+	case <-time.After(time.Millisecond * 10):
+	}
+	fake.Advance(time.Millisecond)
+	assert.Equal(t, errQueueTimeout, <-waited)
+	assert.Equal(t, 0, l.queued)
+}
+
+func Test_limiter_requestRate(t *testing.T) {
+	l := newLimiter(Limits{RequestRate: 10, RequestBurst: 2})
+	now := time.Now()
+
+	assert.True(t, l.allowRequest("a", now))
+	assert.True(t, l.allowRequest("a", now))
+	assert.False(t, l.allowRequest("a", now))
+	//other clients have their own bucket
+	assert.True(t, l.allowRequest("b", now))
+	//one token every 100ms
+	assert.False(t, l.allowRequest("a", now.Add(time.Millisecond*50)))
+	assert.True(t, l.allowRequest("a", now.Add(time.Millisecond*160)))
+
+	//idle clients are forgotten
+	l.pruneBuckets(now.Add(time.Minute))
+	assert.Empty(t, l.buckets)
+}
+
+func TestTFTPProtocolHandler_refused(t *testing.T) {
+	h := NewTFTPProtocolHandler(6400, 6500, WithLimits(Limits{RequestRate: 1}))
+	v, _ := h.VirtualServer(DefaultVirtualServer)
+	v.Files.Set(File{Filename: "kernel", Data: []byte("kernel")})
+	responses := make(chan *udpserver.UDPPacket, 1)
+	client := &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 1234}
+	request := (&PacketRequest{Op: OpRRQ, Filename: "kernel", Mode: "octet"}).Serialize()
+	ctx, done := context.WithCancel(context.Background())
+	defer done()
+
+	//the rate is per client IP, whatever port it sends from
+	other := &net.UDPAddr{IP: client.IP, Port: 1235}
+	h.startTransfer(ctx, v, udpserver.NewUDPPacket(client, request), responses)
+	h.startTransfer(ctx, v, udpserver.NewUDPPacket(other, request), responses)
+
+	resp := <-responses
+	assert.Equal(t, other, resp.Address())
+	p, err := ParsePacket(resp.Data())
+	assert.NoError(t, err)
+	assert.Equal(t, &PacketError{Code: 0, Msg: "request rate limit exceeded"}, p)
+}
+
+func TestLimits_checkTransfer(t *testing.T) {
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name    string
+		limits  Limits
+		running time.Duration
+		idle    time.Duration
+		bytes   int64
+		want    error
+	}{
+		{"no limits", Limits{}, time.Hour, time.Hour, 0, nil},
+		{"within duration", Limits{MaxDuration: time.Minute}, time.Minute, 0, 0, nil},
+		{"too long", Limits{MaxDuration: time.Minute}, time.Minute + 1, 0, 0, errTransferTooLong},
+		{"within idle", Limits{MaxIdle: time.Second}, time.Minute, time.Second, 0, nil},
+		{"idle", Limits{MaxIdle: time.Second}, time.Minute, time.Second + 1, 0, errTransferIdle},
+		{"slow during the grace period", Limits{MinThroughput: 1000}, time.Second * 9, 0, 0, nil},
+		{"fast enough", Limits{MinThroughput: 1000}, time.Second * 10, 0, 10000, nil},
+		{"too slow", Limits{MinThroughput: 1000}, time.Second * 10, 0, 9999, errTransferTooSlow},
+		{"too slow after a short grace", Limits{MinThroughput: 1000, ThroughputGrace: time.Second}, time.Second, 0, 999, errTransferTooSlow},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			now := start.Add(tt.running)
+			assert.Equal(t, tt.want, tt.limits.checkTransfer(start, now.Add(-tt.idle), now, tt.bytes))
+		})
+	}
+
+	assert.Equal(t, defaultMaxBlockRetries, Limits{}.maxBlockRetries())
+	assert.Equal(t, 2, Limits{MaxBlockRetries: 2}.maxBlockRetries())
+}
+
+func TestTransferWorker_limits(t *testing.T) {
+	data := bytes.Repeat([]byte("x"), 512*100)
+	tests := []struct {
+		name   string
+		limits Limits
+		//stall keeps acking the first block, so the transfer goes nowhere
+		stall bool
+		want  string
+	}{
+		{"too long", Limits{MaxDuration: time.Second * 5}, false, "transfer took too long"},
+		{"idle", Limits{MaxIdle: time.Second}, true, "transfer idle for too long"},
+		{"too slow", Limits{MinThroughput: 2000, ThroughputGrace: time.Second * 2}, false, "transfer too slow"},
+		{"too many retries", Limits{MaxBlockRetries: 1}, true, "too many retries, giving up"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := &net.UDPAddr{IP: net.ParseIP("10.0.0.1"), Port: 5000}
+			fake := clock.NewFake(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+			h := NewTFTPProtocolHandler(6000, 6100, WithClock(fake), WithLimits(tt.limits))
+			h.Files.Set(File{Filename: "test", Data: data})
+			in, out, done := startTestWorker(h)
+			in <- udpserver.NewUDPPacket(client, (&PacketRequest{Op: OpRRQ, Filename: "test", Mode: "octet"}).Serialize())
+
+			//the client acks a block every 500ms, 1024 bytes a second, until the worker gives up on it
+			block := uint16(0)
+			for i := 0; i < 100; i++ {
+				select {
+				case raw := <-out:
+					p, err := ParsePacket(raw.Data())
+					assert.NoError(t, err)
+					switch p := p.(type) {
+					case *PacketData:
+						if !tt.stall || block == 0 {
+							block = p.BlockNum
+						}
+						continue
+					case *PacketError:
+						assert.Equal(t, tt.want, p.Msg)
+						<-done
+						return
+					}
+				case <-time.After(time.Millisecond * 20):
+				}
+				fake.Advance(time.Millisecond * 500)
+				in <- udpserver.NewUDPPacket(client, (&PacketAck{BlockNum: block}).Serialize())
+			}
+			t.Fatal("transfer wasn't aborted")
+		})
+	}
+}
@@ -0,0 +1,51 @@
+package tftp
+
+import (
+	log "github.com/sirupsen/logrus"
+)
+
+// Fields are the structured data attached to a log message
+type Fields = map[string]interface{}
+
+// Logger is where a TFTPProtocolHandler sends its logs, see WithRequestLogger and WithLogger.  It also
+// satisfies udpserver.Logger.  Use LogrusLogger to log to logrus.
+type Logger interface {
+	Debug(msg string, fields Fields)
+	Info(msg string, fields Fields)
+	Warn(msg string, fields Fields)
+	Error(msg string, fields Fields)
+}
+
+// nopLogger logs nothing, it's the default for library users
+type nopLogger struct{}
+
+func (nopLogger) Debug(msg string, fields Fields) {}
+func (nopLogger) Info(msg string, fields Fields)  {}
+func (nopLogger) Warn(msg string, fields Fields)  {}
+func (nopLogger) Error(msg string, fields Fields) {}
+
+// logrusLogger logs to a logrus logger or entry
+type logrusLogger struct {
+	logger log.FieldLogger
+}
+
+// LogrusLogger returns a Logger that logs to logger, a *logrus.Logger or *logrus.Entry
+func LogrusLogger(logger log.FieldLogger) Logger {
+	return logrusLogger{logger: logger}
+}
+
+func (l logrusLogger) Debug(msg string, fields Fields) {
+	l.logger.WithFields(log.Fields(fields)).Debug(msg)
+}
+
+func (l logrusLogger) Info(msg string, fields Fields) {
+	l.logger.WithFields(log.Fields(fields)).Info(msg)
+}
+
+func (l logrusLogger) Warn(msg string, fields Fields) {
+	l.logger.WithFields(log.Fields(fields)).Warn(msg)
+}
+
+func (l logrusLogger) Error(msg string, fields Fields) {
+	l.logger.WithFields(log.Fields(fields)).Error(msg)
+}
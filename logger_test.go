@@ -0,0 +1,73 @@
+package tftp
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/lienmeat/tftp/udpserver"
+	log "github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus/hooks/test"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLogrusLogger(t *testing.T) {
+	logger, hook := test.NewNullLogger()
+	logger.SetLevel(log.DebugLevel)
+	l := LogrusLogger(logger)
+	tests := []struct {
+		name  string
+		log   func(msg string, fields Fields)
+		level log.Level
+	}{
+		{"debug", l.Debug, log.DebugLevel},
+		{"info", l.Info, log.InfoLevel},
+		{"warn", l.Warn, log.WarnLevel},
+		{"error", l.Error, log.ErrorLevel},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.log(tt.name+" message", Fields{"server": "lab"})
+			e := hook.LastEntry()
+			assert.Equal(t, tt.level, e.Level)
+			assert.Equal(t, tt.name+" message", e.Message)
+			assert.Equal(t, "lab", e.Data["server"])
+		})
+	}
+}
+
+func TestTFTPProtocolHandler_loggers(t *testing.T) {
+	requests, requestHook := test.NewNullLogger()
+	debug, debugHook := test.NewNullLogger()
+	debug.SetLevel(log.DebugLevel)
+	untrusted, _ := ParseNetworks([]string{"0.0.0.0/0"})
+	h := NewTFTPProtocolHandler(6000, 6100,
+		WithProtection(Protection{Untrusted: untrusted}),
+		WithRequestLogger(LogrusLogger(requests)),
+		WithLogger(LogrusLogger(debug)))
+	def, _ := h.VirtualServer(DefaultVirtualServer)
+	client := &net.UDPAddr{IP: net.ParseIP("10.0.0.1"), Port: 5000}
+	request := udpserver.NewUDPPacket(client, (&PacketRequest{Op: OpRRQ, Filename: "test", Mode: "octet"}).Serialize())
+	responses := make(chan *udpserver.UDPPacket, 1)
+
+	//dropping a first request is a debug log
+	h.startTransfer(context.Background(), def, request, responses)
+	assert.Len(t, debugHook.AllEntries(), 1)
+	assert.Equal(t, "first request dropped, waiting for a retransmit", debugHook.LastEntry().Message)
+	assert.Empty(t, requestHook.AllEntries())
+
+	//refusing one goes in the request log
+	h.Drain()
+	h.startTransfer(context.Background(), def, request, responses)
+	<-responses
+	assert.Len(t, requestHook.AllEntries(), 1)
+	assert.Equal(t, "request refused", requestHook.LastEntry().Message)
+	assert.Len(t, debugHook.AllEntries(), 1)
+
+	//and the default is to log nothing
+	h = NewTFTPProtocolHandler(6000, 6100)
+	h.Drain()
+	def, _ = h.VirtualServer(DefaultVirtualServer)
+	h.startTransfer(context.Background(), def, request, responses)
+	<-responses
+}
@@ -0,0 +1,404 @@
+//Package memnet is an in-memory stand-in for a udp network, for testing protocols under bad conditions.
+//Packets can be lost, duplicated, reordered, delayed and corrupted, and time is kept by a clock, so tests
+//using a clock.Fake don't have to wait for timeouts.
+package memnet
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/lienmeat/tftp/clock"
+)
+
+//Conditions are what the network does to packets.  Chances are between 0 and 1.
+type Conditions struct {
+	//Loss is the chance a packet is dropped
+	Loss float64
+	//Duplicate is the chance a packet is delivered twice
+	Duplicate float64
+	//Reorder is the chance a packet is held back, so packets sent after it arrive first
+	Reorder float64
+	//Corrupt is the chance a bit of a packet is flipped
+	Corrupt float64
+	//Delay is how long packets take to arrive, plus up to Jitter more
+	Delay  time.Duration
+	Jitter time.Duration
+}
+
+//Stats counts what the network did to packets
+type Stats struct {
+	Sent       int
+	Delivered  int
+	Lost       int
+	Duplicated int
+	Reordered  int
+	Corrupted  int
+	//Undeliverable packets were sent to a port nothing is listening on
+	Undeliverable int
+}
+
+//Host is the IP connections on the network have if they don't listen on a specific one
+var Host = net.IPv4(127, 0, 0, 1)
+
+//firstEphemeralPort is where ports for connections listening on port 0 start
+const firstEphemeralPort = 49152
+
+//Network is a single host's udp network, connections are told apart by port
+type Network struct {
+	//activity counts sends, deliveries and reads, for Drive to tell when the network has gone quiet.  First,
+	//so it's aligned for atomic use on 32 bit platforms.
+	activity   uint64
+	clock      clock.Clock
+	rnd        *rand.Rand
+	conditions Conditions
+	conns      map[int]*conn
+	nextPort   int
+	stats      Stats
+	sync.Mutex
+}
+
+//NewNetwork is a network with conditions, timed by c.  The same seed makes the same choices about which
+//packets are lost, duplicated and so on, for the same packets sent in the same order.
+func NewNetwork(c clock.Clock, seed int64, conditions Conditions) *Network {
+	return &Network{
+		clock:      c,
+		rnd:        rand.New(rand.NewSource(seed)),
+		conditions: conditions,
+		conns:      map[int]*conn{},
+		nextPort:   firstEphemeralPort,
+	}
+}
+
+//SetConditions changes the conditions for packets sent from now on
+func (n *Network) SetConditions(conditions Conditions) {
+	n.Lock()
+	defer n.Unlock()
+	n.conditions = conditions
+}
+
+//Stats is what the network has done so far
+func (n *Network) Stats() Stats {
+	n.Lock()
+	defer n.Unlock()
+	return n.stats
+}
+
+//ListenPacket is net.ListenPacket for the network.  network must be udp, udp4 or udp6, and port 0 in
+//address picks a free port.
+func (n *Network) ListenPacket(network string, address string) (net.PacketConn, error) {
+	switch network {
+	case "udp", "udp4", "udp6":
+	default:
+		return nil, &net.OpError{Op: "listen", Net: network, Err: net.UnknownNetworkError(network)}
+	}
+	host, p, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, &net.OpError{Op: "listen", Net: network, Err: err}
+	}
+	port, err := strconv.Atoi(p)
+	if err != nil || port < 0 || port > 65535 {
+		return nil, &net.OpError{Op: "listen", Net: network, Err: fmt.Errorf("invalid port %q", p)}
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || ip.IsUnspecified() {
+		ip = Host
+	}
+
+	n.Lock()
+	defer n.Unlock()
+	if port == 0 {
+		//like the kernel, don't hand out a port that was just closed, packets for its last owner may be
+		//on their way
+		for tried := 0; ; tried++ {
+			if tried > 65535-firstEphemeralPort {
+				return nil, &net.OpError{Op: "listen", Net: network, Err: errors.New("no free ports")}
+			}
+			port = n.nextPort
+			if n.nextPort++; n.nextPort > 65535 {
+				n.nextPort = firstEphemeralPort
+			}
+			if n.conns[port] == nil {
+				break
+			}
+		}
+	}
+	addr := &net.UDPAddr{IP: ip, Port: port}
+	if n.conns[port] != nil {
+		return nil, &net.OpError{Op: "listen", Net: network, Addr: addr, Err: errors.New("address already in use")}
+	}
+	c := &conn{
+		network: n,
+		addr:    addr,
+		rnd:     rand.New(rand.NewSource(n.rnd.Int63())),
+		wake:    make(chan struct{}),
+	}
+	n.conns[port] = c
+	return c, nil
+}
+
+//ListenUDP listens on address, it can be passed to the udpserver and tftp WithListenPacket options
+func (n *Network) ListenUDP(address string) (net.PacketConn, error) {
+	return n.ListenPacket("udp", address)
+}
+
+//Dial is a connection on a free port, it can be used for a client's ListenPacket
+func (n *Network) Dial() (net.PacketConn, error) {
+	return n.ListenPacket("udp", ":0")
+}
+
+//send puts data from one connection on the network, for whatever is listening on to's port
+func (n *Network) send(from *conn, data []byte, to *net.UDPAddr) {
+	atomic.AddUint64(&n.activity, 1)
+	n.Lock()
+	conditions := n.conditions
+	n.stats.Sent++
+	n.Unlock()
+
+	//each connection has its own random numbers, so what happens to one's packets doesn't depend on
+	//how the others' goroutines were scheduled
+	from.lock.Lock()
+	if from.rnd.Float64() < conditions.Loss {
+		from.lock.Unlock()
+		n.count(func(s *Stats) { s.Lost++ })
+		return
+	}
+	copies := 1
+	if from.rnd.Float64() < conditions.Duplicate {
+		copies = 2
+	}
+	type delivery struct {
+		data  []byte
+		delay time.Duration
+	}
+	deliveries := make([]delivery, copies)
+	var reordered, corrupted int
+	for i := range deliveries {
+		d := delivery{data: append([]byte(nil), data...), delay: conditions.Delay}
+		if conditions.Jitter > 0 {
+			d.delay += time.Duration(from.rnd.Int63n(int64(conditions.Jitter) + 1))
+		}
+		if from.rnd.Float64() < conditions.Reorder {
+			//late enough for anything sent now to overtake it
+			d.delay += conditions.Delay + conditions.Jitter + time.Millisecond
+			reordered++
+		}
+		if len(d.data) > 0 && from.rnd.Float64() < conditions.Corrupt {
+			d.data[from.rnd.Intn(len(d.data))] ^= 1 << uint(from.rnd.Intn(8))
+			corrupted++
+		}
+		deliveries[i] = d
+	}
+	from.lock.Unlock()
+	n.count(func(s *Stats) {
+		s.Duplicated += copies - 1
+		s.Reordered += reordered
+		s.Corrupted += corrupted
+	})
+
+	src := from.LocalAddr().(*net.UDPAddr)
+	for _, d := range deliveries {
+		d := d
+		if d.delay <= 0 {
+			n.deliver(src, d.data, to)
+			continue
+		}
+		n.clock.AfterFunc(d.delay, func() { n.deliver(src, d.data, to) })
+	}
+}
+
+//deliver queues data for the connection listening on to's port, if there is one
+func (n *Network) deliver(from *net.UDPAddr, data []byte, to *net.UDPAddr) {
+	atomic.AddUint64(&n.activity, 1)
+	n.Lock()
+	c := n.conns[to.Port]
+	if c == nil {
+		n.stats.Undeliverable++
+		n.Unlock()
+		return
+	}
+	n.stats.Delivered++
+	n.Unlock()
+	c.enqueue(packet{from: from, data: data})
+}
+
+func (n *Network) count(f func(s *Stats)) {
+	n.Lock()
+	defer n.Unlock()
+	f(&n.stats)
+}
+
+func (n *Network) remove(c *conn) {
+	n.Lock()
+	defer n.Unlock()
+	if n.conns[c.addr.Port] == c {
+		delete(n.conns, c.addr.Port)
+	}
+}
+
+//Drive moves fake's time on to the next timer whenever the network has been quiet for a moment, until done
+//is closed.  That's when everything is waiting for a packet that was delayed or for a timeout, so tests
+//run as if they waited, without waiting.  fake must be the network's clock.
+func (n *Network) Drive(fake *clock.Fake, done <-chan struct{}) {
+	ticker := time.NewTicker(time.Millisecond)
+	defer ticker.Stop()
+	last := atomic.LoadUint64(&n.activity)
+	quiet := 0
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+		if activity := atomic.LoadUint64(&n.activity); activity != last {
+			last = activity
+			quiet = 0
+			continue
+		}
+		//quiet for a couple of ticks, so goroutines that just got a packet have had a chance to answer it
+		if quiet++; quiet < 2 {
+			continue
+		}
+		if next, ok := fake.Next(); ok {
+			fake.Advance(next.Sub(fake.Now()))
+			quiet = 0
+		}
+	}
+}
+
+type packet struct {
+	from *net.UDPAddr
+	data []byte
+}
+
+//conn is a connection on a Network
+type conn struct {
+	network  *Network
+	addr     *net.UDPAddr
+	rnd      *rand.Rand
+	queue    []packet
+	deadline time.Time
+	closed   bool
+	//wake is closed, and replaced, when a packet arrives, the deadline changes or the connection closes
+	wake chan struct{}
+	lock sync.Mutex
+}
+
+//timeoutError is a read past the deadline
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+var errClosed = errors.New("use of closed network connection")
+
+func (c *conn) opError(op string, err error) error {
+	return &net.OpError{Op: op, Net: "udp", Addr: c.addr, Err: err}
+}
+
+//wakeUp tells a waiting ReadFrom something changed, c.lock must be held
+func (c *conn) wakeUp() {
+	close(c.wake)
+	c.wake = make(chan struct{})
+}
+
+func (c *conn) enqueue(p packet) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.closed {
+		return
+	}
+	c.queue = append(c.queue, p)
+	c.wakeUp()
+}
+
+func (c *conn) ReadFrom(b []byte) (int, net.Addr, error) {
+	for {
+		c.lock.Lock()
+		if c.closed {
+			c.lock.Unlock()
+			return 0, nil, c.opError("read", errClosed)
+		}
+		if len(c.queue) > 0 {
+			p := c.queue[0]
+			c.queue = c.queue[1:]
+			c.lock.Unlock()
+			atomic.AddUint64(&c.network.activity, 1)
+			//like udp, what doesn't fit in b is lost
+			return copy(b, p.data), p.from, nil
+		}
+		deadline, wake := c.deadline, c.wake
+		c.lock.Unlock()
+
+		if deadline.IsZero() {
+			<-wake
+			continue
+		}
+		wait := deadline.Sub(c.network.clock.Now())
+		if wait <= 0 {
+			return 0, nil, c.opError("read", timeoutError{})
+		}
+		timer := c.network.clock.NewTimer(wait)
+		select {
+		case <-wake:
+		case <-timer.C():
+		}
+		timer.Stop()
+	}
+}
+
+func (c *conn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	c.lock.Lock()
+	closed := c.closed
+	c.lock.Unlock()
+	if closed {
+		return 0, c.opError("write", errClosed)
+	}
+	to, ok := addr.(*net.UDPAddr)
+	if !ok {
+		return 0, c.opError("write", fmt.Errorf("not a udp address: %v", addr))
+	}
+	c.network.send(c, b, to)
+	return len(b), nil
+}
+
+func (c *conn) Close() error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.closed {
+		return c.opError("close", errClosed)
+	}
+	c.closed = true
+	c.queue = nil
+	c.wakeUp()
+	c.network.remove(c)
+	return nil
+}
+
+func (c *conn) LocalAddr() net.Addr {
+	return c.addr
+}
+
+func (c *conn) SetDeadline(t time.Time) error {
+	return c.SetReadDeadline(t)
+}
+
+func (c *conn) SetReadDeadline(t time.Time) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.deadline = t
+	c.wakeUp()
+	atomic.AddUint64(&c.network.activity, 1)
+	return nil
+}
+
+//SetWriteDeadline does nothing, writes never block
+func (c *conn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
@@ -0,0 +1,202 @@
+package memnet
+
+import (
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/lienmeat/tftp/clock"
+	"github.com/stretchr/testify/assert"
+)
+
+var start = time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+
+func listen(t *testing.T, n *Network, address string) net.PacketConn {
+	c, err := n.ListenPacket("udp", address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+//read reads whatever has arrived at c, without waiting
+func read(c net.PacketConn) []string {
+	got := []string{}
+	buf := make([]byte, 100)
+	for {
+		c.SetReadDeadline(aLongTimeAgo)
+		n, _, err := c.ReadFrom(buf)
+		if err != nil {
+			return got
+		}
+		got = append(got, string(buf[:n]))
+	}
+}
+
+var aLongTimeAgo = time.Unix(1, 0)
+
+func TestNetwork_ListenPacket(t *testing.T) {
+	n := NewNetwork(clock.NewFake(start), 1, Conditions{})
+	a := listen(t, n, "0.0.0.0:69")
+	assert.Equal(t, "127.0.0.1:69", a.LocalAddr().String())
+	b := listen(t, n, ":0")
+	assert.Equal(t, "127.0.0.1:49152", b.LocalAddr().String())
+	c := listen(t, n, "10.0.0.1:0")
+	assert.Equal(t, "10.0.0.1:49153", c.LocalAddr().String())
+
+	_, err := n.ListenPacket("udp", ":69")
+	assert.EqualError(t, err, "listen udp 127.0.0.1:69: address already in use")
+	_, err = n.ListenPacket("tcp", ":70")
+	assert.EqualError(t, err, "listen tcp: unknown network tcp")
+	_, err = n.ListenPacket("udp", ":http")
+	assert.EqualError(t, err, `listen udp: invalid port "http"`)
+
+	//a closed connection's port is free again
+	assert.NoError(t, a.Close())
+	assert.Error(t, a.Close())
+	a = listen(t, n, ":69")
+	assert.NoError(t, b.Close())
+	_, _, err = b.ReadFrom(make([]byte, 10))
+	assert.EqualError(t, err, "read udp 127.0.0.1:49152: use of closed network connection")
+	_, err = b.WriteTo([]byte("x"), a.LocalAddr())
+	assert.EqualError(t, err, "write udp 127.0.0.1:49152: use of closed network connection")
+}
+
+func TestConn_ReadFrom(t *testing.T) {
+	fake := clock.NewFake(start)
+	n := NewNetwork(fake, 1, Conditions{})
+	server := listen(t, n, ":69")
+	client := listen(t, n, ":0")
+
+	_, err := client.WriteTo([]byte("hello"), server.LocalAddr())
+	assert.NoError(t, err)
+	client.WriteTo([]byte("nobody"), &net.UDPAddr{IP: Host, Port: 70})
+	buf := make([]byte, 3)
+	got, from, err := server.ReadFrom(buf)
+	assert.NoError(t, err)
+	//like udp, what doesn't fit is cut off
+	assert.Equal(t, "hel", string(buf[:got]))
+	assert.Equal(t, client.LocalAddr(), from)
+
+	//reads wait until the deadline, by the network's clock
+	server.SetReadDeadline(start.Add(time.Second))
+	read := make(chan error)
+	go func() {
+		_, _, err := server.ReadFrom(buf)
+		read <- err
+	}()
+	for fake.Pending() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	fake.Advance(time.Second)
+	err = <-read
+	if assert.Error(t, err) {
+		assert.True(t, err.(net.Error).Timeout())
+	}
+
+	//and are woken by packets, or closing
+	server.SetReadDeadline(time.Time{})
+	go func() {
+		_, _, err := server.ReadFrom(buf)
+		read <- err
+	}()
+	client.WriteTo([]byte("again"), server.LocalAddr())
+	assert.NoError(t, <-read)
+	go func() {
+		_, _, err := server.ReadFrom(buf)
+		read <- err
+	}()
+	server.Close()
+	assert.Error(t, <-read)
+
+	assert.Equal(t, Stats{Sent: 3, Delivered: 2, Undeliverable: 1}, n.Stats())
+}
+
+func TestNetwork_conditions(t *testing.T) {
+	tests := []struct {
+		name       string
+		conditions Conditions
+		check      func(t *testing.T, got []string, stats Stats)
+	}{
+		{"perfect", Conditions{}, func(t *testing.T, got []string, stats Stats) {
+			assert.Len(t, got, 1000)
+			assert.Equal(t, "0", got[0])
+			assert.Equal(t, "999", got[999])
+		}},
+		{"loss", Conditions{Loss: 0.2}, func(t *testing.T, got []string, stats Stats) {
+			assert.Equal(t, 1000-stats.Lost, len(got))
+			assert.InDelta(t, 200, stats.Lost, 50)
+		}},
+		{"duplicate", Conditions{Duplicate: 0.2}, func(t *testing.T, got []string, stats Stats) {
+			assert.Equal(t, 1000+stats.Duplicated, len(got))
+			assert.InDelta(t, 200, stats.Duplicated, 50)
+		}},
+		{"reorder", Conditions{Reorder: 0.2}, func(t *testing.T, got []string, stats Stats) {
+			assert.Len(t, got, 1000)
+			assert.InDelta(t, 200, stats.Reordered, 50)
+			//held back packets arrive after all the others
+			assert.Equal(t, "0", got[0][:1])
+			assert.NotEqual(t, "999", got[999])
+		}},
+		{"corrupt", Conditions{Corrupt: 0.2}, func(t *testing.T, got []string, stats Stats) {
+			assert.Len(t, got, 1000)
+			assert.InDelta(t, 200, stats.Corrupted, 50)
+		}},
+		{"delay", Conditions{Delay: time.Second, Jitter: time.Millisecond * 100}, func(t *testing.T, got []string, stats Stats) {
+			assert.Len(t, got, 1000)
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := clock.NewFake(start)
+			n := NewNetwork(fake, 1, tt.conditions)
+			a := listen(t, n, ":0")
+			b := listen(t, n, ":0")
+			for i := 0; i < 1000; i++ {
+				a.WriteTo([]byte(strconv.Itoa(i)), b.LocalAddr())
+			}
+			if tt.conditions.Delay > 0 {
+				assert.Empty(t, read(b))
+				fake.Advance(tt.conditions.Delay - time.Nanosecond)
+				assert.Empty(t, read(b))
+			}
+			fake.Advance(time.Minute)
+			tt.check(t, read(b), n.Stats())
+
+			//the same seed does the same things to the same packets
+			fake = clock.NewFake(start)
+			again := NewNetwork(fake, 1, tt.conditions)
+			a = listen(t, again, ":0")
+			b = listen(t, again, ":0")
+			for i := 0; i < 1000; i++ {
+				a.WriteTo([]byte(strconv.Itoa(i)), b.LocalAddr())
+			}
+			fake.Advance(time.Minute)
+			assert.Equal(t, n.Stats(), again.Stats())
+		})
+	}
+}
+
+func TestNetwork_Drive(t *testing.T) {
+	fake := clock.NewFake(start)
+	n := NewNetwork(fake, 1, Conditions{Delay: time.Second})
+	a := listen(t, n, ":0")
+	b := listen(t, n, ":0")
+	done := make(chan struct{})
+	defer close(done)
+	go n.Drive(fake, done)
+
+	//a packet a second away arrives without waiting a second
+	a.WriteTo([]byte("ping"), b.LocalAddr())
+	buf := make([]byte, 10)
+	got, _, err := b.ReadFrom(buf)
+	assert.NoError(t, err)
+	assert.Equal(t, "ping", string(buf[:got]))
+
+	//and so do timeouts
+	b.SetReadDeadline(fake.Now().Add(time.Hour))
+	_, _, err = b.ReadFrom(buf)
+	assert.Error(t, err)
+	assert.Equal(t, start.Add(time.Second+time.Hour), fake.Now())
+}
@@ -0,0 +1,205 @@
+package tftp
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+//failedNoError is the code label of failed transfers that ended without an ERROR packet being sent or received
+const failedNoError = "none"
+
+//durationBuckets are the upper bounds, in seconds, of the transfer duration histogram
+var durationBuckets = []float64{0.01, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 120, 300}
+
+//Metrics counts what the server is doing, and writes it out in the Prometheus text format
+type Metrics struct {
+	requests      *metric
+	active        *metric
+	completed     *metric
+	failed        *metric
+	bytesSent     *metric
+	bytesReceived *metric
+	retransmits   *metric
+	timeouts      *metric
+	unparseable   *metric
+	duplicates    *metric
+	duration      *histogram
+	tids          *TIDRepo
+}
+
+func newMetrics(tids *TIDRepo) *Metrics {
+	return &Metrics{
+		requests:      newMetric("tftp_requests_total", "counter", "Read and write requests received.", "server", "op"),
+		active:        newMetric("tftp_active_transfers", "gauge", "Transfers running now.", "op"),
+		completed:     newMetric("tftp_transfers_completed_total", "counter", "Transfers that finished successfully.", "op"),
+		failed:        newMetric("tftp_transfers_failed_total", "counter", "Transfers that failed, by the TFTP error code sent or received, or none.", "op", "code"),
+		bytesSent:     newMetric("tftp_sent_bytes_total", "counter", "Bytes sent from transfer ports, retransmits included.", "op"),
+		bytesReceived: newMetric("tftp_received_bytes_total", "counter", "Bytes received on transfer ports.", "op"),
+		retransmits:   newMetric("tftp_retransmits_total", "counter", "Packets resent because the client didn't answer in time.", "op"),
+		timeouts:      newMetric("tftp_timeouts_total", "counter", "Transfers abandoned after running out of retransmits.", "op"),
+		unparseable:   newMetric("tftp_unparseable_packets_total", "counter", "Packets that couldn't be parsed."),
+		duplicates:    newMetric("tftp_duplicate_requests_total", "counter", "Requests resent while their transfer was running, and dropped.", "op"),
+		duration:      newHistogram("tftp_transfer_duration_seconds", "How long successful transfers took.", durationBuckets, "op"),
+		tids:          tids,
+	}
+}
+
+//ServeHTTP serves the metrics to a Prometheus scrape
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	m.Write(w)
+}
+
+//Write writes every metric in the Prometheus text format
+func (m *Metrics) Write(w io.Writer) error {
+	b := bufio.NewWriter(w)
+	for _, c := range []*metric{m.requests, m.active, m.completed, m.failed, m.bytesSent, m.bytesReceived, m.retransmits, m.timeouts, m.unparseable, m.duplicates} {
+		c.write(b)
+	}
+	m.duration.write(b)
+	used, size := m.tids.Usage()
+	writeHeader(b, "tftp_tids_in_use", "gauge", "Transfer ports (TIDs) in use.")
+	fmt.Fprintf(b, "tftp_tids_in_use %d\n", used)
+	writeHeader(b, "tftp_tids_total", "gauge", "Transfer ports (TIDs) in the pool.")
+	fmt.Fprintf(b, "tftp_tids_total %d\n", size)
+	return b.Flush()
+}
+
+//metric is a counter or gauge, with one value for each combination of label values
+type metric struct {
+	name   string
+	kind   string
+	help   string
+	labels []string
+	values map[string]float64
+	sync.Mutex
+}
+
+func newMetric(name string, kind string, help string, labels ...string) *metric {
+	return &metric{name: name, kind: kind, help: help, labels: labels, values: map[string]float64{}}
+}
+
+//add adds v to the value for the label values given, in the same order as the metric's labels
+func (m *metric) add(v float64, labelValues ...string) {
+	m.Lock()
+	defer m.Unlock()
+	m.values[strings.Join(labelValues, "\xff")] += v
+}
+
+//value gets the value for the label values given
+func (m *metric) value(labelValues ...string) float64 {
+	m.Lock()
+	defer m.Unlock()
+	return m.values[strings.Join(labelValues, "\xff")]
+}
+
+func (m *metric) write(w io.Writer) {
+	m.Lock()
+	defer m.Unlock()
+	writeHeader(w, m.name, m.kind, m.help)
+	if len(m.labels) == 0 {
+		fmt.Fprintf(w, "%s %s\n", m.name, formatValue(m.values[""]))
+		return
+	}
+	for _, key := range sortedKeys(m.values) {
+		fmt.Fprintf(w, "%s%s %s\n", m.name, formatLabels(m.labels, key), formatValue(m.values[key]))
+	}
+}
+
+//histogram counts observations into buckets, for each combination of label values
+type histogram struct {
+	name    string
+	help    string
+	labels  []string
+	buckets []float64
+	series  map[string]*histogramSeries
+	sync.Mutex
+}
+
+type histogramSeries struct {
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+func newHistogram(name string, help string, buckets []float64, labels ...string) *histogram {
+	return &histogram{name: name, help: help, labels: labels, buckets: buckets, series: map[string]*histogramSeries{}}
+}
+
+func (h *histogram) observe(v float64, labelValues ...string) {
+	h.Lock()
+	defer h.Unlock()
+	key := strings.Join(labelValues, "\xff")
+	s, ok := h.series[key]
+	if !ok {
+		s = &histogramSeries{counts: make([]uint64, len(h.buckets))}
+		h.series[key] = s
+	}
+	for i, le := range h.buckets {
+		if v <= le {
+			s.counts[i]++
+		}
+	}
+	s.sum += v
+	s.count++
+}
+
+func (h *histogram) write(w io.Writer) {
+	h.Lock()
+	defer h.Unlock()
+	writeHeader(w, h.name, "histogram", h.help)
+	keys := make([]string, 0, len(h.series))
+	for key := range h.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		s := h.series[key]
+		labels := append(append([]string{}, h.labels...), "le")
+		for i, le := range h.buckets {
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatLabels(labels, key+"\xff"+formatValue(le)), s.counts[i])
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatLabels(labels, key+"\xff+Inf"), s.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, formatLabels(h.labels, key), formatValue(s.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, formatLabels(h.labels, key), s.count)
+	}
+}
+
+func writeHeader(w io.Writer, name string, kind string, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+//formatLabels renders label names with the values joined in key, like {op="get",code="1"}
+func formatLabels(names []string, key string) string {
+	values := strings.Split(key, "\xff")
+	pairs := make([]string, len(names))
+	for i, name := range names {
+		v := ""
+		if i < len(values) {
+			v = values[i]
+		}
+		pairs[i] = name + `="` + labelEscaper.Replace(v) + `"`
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func formatValue(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+func sortedKeys(m map[string]float64) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
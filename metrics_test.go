@@ -0,0 +1,124 @@
+package tftp
+
+import (
+	"bytes"
+	"net"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/lienmeat/tftp/udpserver"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMetrics_Write(t *testing.T) {
+	tids := NewTIDRepo(6000, 6010)
+	tids.New()
+	m := newMetrics(tids)
+	m.duration = newHistogram("tftp_transfer_duration_seconds", "How long successful transfers took.", []float64{0.1, 1}, "op")
+
+	m.requests.add(2, "default", "get")
+	m.requests.add(1, "lab", "put")
+	m.failed.add(1, "get", "1")
+	m.failed.add(1, "put", failedNoError)
+	m.bytesSent.add(1536, "get")
+	m.duration.observe(0.5, "get")
+	m.duration.observe(0.05, "get")
+	//label values are escaped
+	m.requests.add(1, "a \"quoted\" name", "get")
+
+	buf := &bytes.Buffer{}
+	assert.NoError(t, m.Write(buf))
+	assert.Equal(t, `# HELP tftp_requests_total Read and write requests received.
+# TYPE tftp_requests_total counter
+tftp_requests_total{server="a \"quoted\" name",op="get"} 1
+tftp_requests_total{server="default",op="get"} 2
+tftp_requests_total{server="lab",op="put"} 1
+# HELP tftp_active_transfers Transfers running now.
+# TYPE tftp_active_transfers gauge
+# HELP tftp_transfers_completed_total Transfers that finished successfully.
+# TYPE tftp_transfers_completed_total counter
+# HELP tftp_transfers_failed_total Transfers that failed, by the TFTP error code sent or received, or none.
+# TYPE tftp_transfers_failed_total counter
+tftp_transfers_failed_total{op="get",code="1"} 1
+tftp_transfers_failed_total{op="put",code="none"} 1
+# HELP tftp_sent_bytes_total Bytes sent from transfer ports, retransmits included.
+# TYPE tftp_sent_bytes_total counter
+tftp_sent_bytes_total{op="get"} 1536
+# HELP tftp_received_bytes_total Bytes received on transfer ports.
+# TYPE tftp_received_bytes_total counter
+# HELP tftp_retransmits_total Packets resent because the client didn't answer in time.
+# TYPE tftp_retransmits_total counter
+# HELP tftp_timeouts_total Transfers abandoned after running out of retransmits.
+# TYPE tftp_timeouts_total counter
+# HELP tftp_unparseable_packets_total Packets that couldn't be parsed.
+# TYPE tftp_unparseable_packets_total counter
+tftp_unparseable_packets_total 0
+# HELP tftp_duplicate_requests_total Requests resent while their transfer was running, and dropped.
+# TYPE tftp_duplicate_requests_total counter
+# HELP tftp_transfer_duration_seconds How long successful transfers took.
+# TYPE tftp_transfer_duration_seconds histogram
+tftp_transfer_duration_seconds_bucket{op="get",le="0.1"} 1
+tftp_transfer_duration_seconds_bucket{op="get",le="1"} 2
+tftp_transfer_duration_seconds_bucket{op="get",le="+Inf"} 2
+tftp_transfer_duration_seconds_sum{op="get"} 0.55
+tftp_transfer_duration_seconds_count{op="get"} 2
+# HELP tftp_tids_in_use Transfer ports (TIDs) in use.
+# TYPE tftp_tids_in_use gauge
+tftp_tids_in_use 1
+# HELP tftp_tids_total Transfer ports (TIDs) in the pool.
+# TYPE tftp_tids_total gauge
+tftp_tids_total 10
+`, buf.String())
+
+	rec := httptest.NewRecorder()
+	m.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	assert.Equal(t, "text/plain; version=0.0.4; charset=utf-8", rec.Header().Get("Content-Type"))
+	assert.Equal(t, buf.String(), rec.Body.String())
+}
+
+func TestTIDRepo_Usage(t *testing.T) {
+	tids := NewTIDRepo(6000, 6010)
+	a := tids.New()
+	tids.New()
+	used, size := tids.Usage()
+	assert.Equal(t, int32(2), used)
+	assert.Equal(t, int32(10), size)
+
+	tids.Del(a)
+	tids.Del(a)
+	used, _ = tids.Usage()
+	assert.Equal(t, int32(1), used)
+}
+
+func TestTransferWorker_metrics(t *testing.T) {
+	client := &net.UDPAddr{IP: net.ParseIP("10.0.0.1"), Port: 5000}
+	h := NewTFTPProtocolHandler(6000, 6100)
+	h.Files.Set(File{Filename: "test", Data: bytes.Repeat([]byte("a"), int(BlockSize))})
+	m := h.Metrics
+
+	in, out, done := startTestWorker(h)
+	in <- udpserver.NewUDPPacket(client, (&PacketRequest{Op: OpRRQ, Filename: "test", Mode: "octet"}).Serialize())
+	<-out
+	assert.Equal(t, float64(1), m.active.value("get"))
+	in <- udpserver.NewUDPPacket(client, (&PacketAck{BlockNum: 1}).Serialize())
+	<-out
+	<-done
+	assert.Equal(t, float64(0), m.active.value("get"))
+	assert.Equal(t, float64(1), m.requests.value(DefaultVirtualServer, "get"))
+	assert.Equal(t, float64(1), m.completed.value("get"))
+	//a full DATA 1, then the empty DATA 2
+	assert.Equal(t, float64(BlockSize+4+4), m.bytesSent.value("get"))
+	assert.Equal(t, float64(len("\x00\x01test\x00octet\x00")+4), m.bytesReceived.value("get"))
+	assert.Equal(t, uint64(1), m.duration.series["get"].count)
+
+	in, out, done = startTestWorker(h)
+	in <- udpserver.NewUDPPacket(client, (&PacketRequest{Op: OpRRQ, Filename: "missing", Mode: "octet"}).Serialize())
+	<-out
+	<-done
+	assert.Equal(t, float64(1), m.failed.value("get", "1"))
+
+	in, _, done = startTestWorker(h)
+	in <- udpserver.NewUDPPacket(client, []byte("garbage"))
+	<-done
+	assert.Equal(t, float64(1), m.unparseable.value())
+}
@@ -0,0 +1,81 @@
+package tftp
+
+import (
+	"strconv"
+	"time"
+)
+
+const (
+	//MaxBlockSize is the largest blksize RFC2348 allows
+	MaxBlockSize uint = 65464
+	//MinBlockSize is the smallest blksize RFC2348 allows
+	MinBlockSize uint = 8
+	//MaxTimeout is the longest timeout, in seconds, RFC2349 allows
+	MaxTimeout uint = 255
+)
+
+//OptionLimits bounds the options (RFC2347) a VirtualServer will negotiate with clients.
+//The zero value allows everything the RFCs allow.
+type OptionLimits struct {
+	//Disabled turns off option negotiation, every request is served as a plain RFC1350 transfer
+	Disabled bool
+	//MaxBlockSize is the largest blksize that will be agreed to, larger requests are negotiated down to it.
+	//0 means MaxBlockSize.
+	MaxBlockSize uint
+	//MaxTimeout is the longest timeout, in seconds, that will be agreed to, larger requests are ignored.
+	//0 means MaxTimeout.
+	MaxTimeout uint
+}
+
+func (l OptionLimits) maxBlockSize() uint {
+	if l.MaxBlockSize == 0 || l.MaxBlockSize > MaxBlockSize {
+		return MaxBlockSize
+	}
+	return l.MaxBlockSize
+}
+
+func (l OptionLimits) maxTimeout() uint {
+	if l.MaxTimeout == 0 || l.MaxTimeout > MaxTimeout {
+		return MaxTimeout
+	}
+	return l.MaxTimeout
+}
+
+//negotiateOptions picks which of the options requested in r will be used, within limits, and applies them
+//to the transfer.  Accepted options end up in transfer.Options to be sent back in an OACK.  Unknown or
+//invalid options are ignored as RFC2347 requires, which leaves transfer.Options nil if none were accepted.
+func negotiateOptions(limits OptionLimits, transfer *Transfer, r *PacketRequest) {
+	if limits.Disabled || len(r.Options) == 0 {
+		return
+	}
+	accepted := map[string]string{}
+	for name, value := range r.Options {
+		n, err := strconv.ParseUint(value, 10, 63)
+		if err != nil {
+			continue
+		}
+		switch name {
+		case "blksize":
+			if n < uint64(MinBlockSize) {
+				continue
+			}
+			if max := uint64(limits.maxBlockSize()); n > max {
+				n = max
+			}
+			transfer.BlkSize = uint(n)
+		case "timeout":
+			if n < 1 || n > uint64(limits.maxTimeout()) {
+				continue
+			}
+			transfer.Timeout = time.Duration(n) * time.Second
+		case "tsize":
+			//for reads the real size is filled in once the file is found, for writes it is echoed back
+		default:
+			continue
+		}
+		accepted[name] = strconv.FormatUint(n, 10)
+	}
+	if len(accepted) > 0 {
+		transfer.Options = accepted
+	}
+}
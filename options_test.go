@@ -0,0 +1,80 @@
+package tftp
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_negotiateOptions(t *testing.T) {
+	tests := []struct {
+		name         string
+		limits       OptionLimits
+		options      map[string]string
+		wantTransfer *Transfer
+	}{
+		{
+			name:         "no options",
+			options:      nil,
+			wantTransfer: &Transfer{},
+		},
+		{
+			name:    "all options",
+			options: map[string]string{"blksize": "1428", "timeout": "5", "tsize": "0"},
+			wantTransfer: &Transfer{
+				BlkSize: 1428,
+				Timeout: time.Second * 5,
+				Options: map[string]string{"blksize": "1428", "timeout": "5", "tsize": "0"},
+			},
+		},
+		{
+			name:         "disabled",
+			limits:       OptionLimits{Disabled: true},
+			options:      map[string]string{"blksize": "1428", "timeout": "5", "tsize": "0"},
+			wantTransfer: &Transfer{},
+		},
+		{
+			name:    "blksize negotiated down",
+			limits:  OptionLimits{MaxBlockSize: 1024},
+			options: map[string]string{"blksize": "8192"},
+			wantTransfer: &Transfer{
+				BlkSize: 1024,
+				Options: map[string]string{"blksize": "1024"},
+			},
+		},
+		{
+			name:    "blksize past rfc max",
+			options: map[string]string{"blksize": "70000"},
+			wantTransfer: &Transfer{
+				BlkSize: MaxBlockSize,
+				Options: map[string]string{"blksize": "65464"},
+			},
+		},
+		{
+			name:         "blksize too small",
+			options:      map[string]string{"blksize": "4"},
+			wantTransfer: &Transfer{},
+		},
+		{
+			name:    "timeout too long",
+			limits:  OptionLimits{MaxTimeout: 10},
+			options: map[string]string{"timeout": "30", "tsize": "100"},
+			wantTransfer: &Transfer{
+				Options: map[string]string{"tsize": "100"},
+			},
+		},
+		{
+			name:         "invalid and unknown options",
+			options:      map[string]string{"blksize": "big", "timeout": "0", "multicast": "1"},
+			wantTransfer: &Transfer{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			transfer := &Transfer{}
+			negotiateOptions(tt.limits, transfer, &PacketRequest{Op: OpRRQ, Filename: "test", Mode: "octet", Options: tt.options})
+			assert.Equal(t, tt.wantTransfer, transfer)
+		})
+	}
+}
@@ -0,0 +1,226 @@
+package tftp
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+//Protection guards against the server being used to flood someone else.  A spoofed request makes the
+//server send data to an address that never asked for it, so until a client proves it can receive our
+//packets, by acking or sending data on its transfer port, it is unverified.  Zero values turn each
+//protection off.
+type Protection struct {
+	//MaxUnverifiedBytes caps the bytes, retransmits included, in flight to one unverified client IP across
+	//all its transfers.  Transfers that would go over it are abandoned.
+	MaxUnverifiedBytes int64
+	//Untrusted clients have their first request dropped, and only get served when they retransmit it.
+	//A client that has verified a transfer is trusted for VerifiedFor afterwards.
+	Untrusted []*net.IPNet
+	//CookieWindow is how long a dropped first request is remembered, waiting for its retransmit
+	CookieWindow time.Duration
+	//VerifiedFor is how long a verified client skips the first request check
+	VerifiedFor time.Duration
+	//AbuseThreshold is how many malformed packets a client IP may send before it is blocked for BlockFor.
+	//Every AbuseDecay one of them is forgiven.
+	AbuseThreshold int
+	AbuseDecay     time.Duration
+	BlockFor       time.Duration
+}
+
+const (
+	defaultCookieWindow = time.Second * 30
+	defaultVerifiedFor  = time.Minute * 10
+	defaultAbuseDecay   = time.Minute
+	defaultBlockFor     = time.Minute * 10
+	//maxCookies bounds the first requests remembered, so a flood of them can't use up memory
+	maxCookies = 65536
+	//guardPruneInterval is how often expired cookies, scores and blocks are forgotten
+	guardPruneInterval = time.Minute
+)
+
+//guard enforces Protection
+type guard struct {
+	protection Protection
+	//bytes in flight to each unverified client IP
+	unverified map[string]int64
+	//client IPs that verified a transfer, until when they are trusted
+	verified map[string]time.Time
+	//first requests dropped, by client address and packet, and when they were seen
+	cookies map[string]time.Time
+	scores  map[string]*abuseScore
+	//blocked client IPs, until when
+	blocked   map[string]time.Time
+	lastPrune time.Time
+	sync.Mutex
+}
+
+func newGuard(p Protection) *guard {
+	if p.CookieWindow == 0 {
+		p.CookieWindow = defaultCookieWindow
+	}
+	if p.VerifiedFor == 0 {
+		p.VerifiedFor = defaultVerifiedFor
+	}
+	if p.AbuseDecay == 0 {
+		p.AbuseDecay = defaultAbuseDecay
+	}
+	if p.BlockFor == 0 {
+		p.BlockFor = defaultBlockFor
+	}
+	return &guard{
+		protection: p,
+		unverified: map[string]int64{},
+		verified:   map[string]time.Time{},
+		cookies:    map[string]time.Time{},
+		scores:     map[string]*abuseScore{},
+		blocked:    map[string]time.Time{},
+		lastPrune:  time.Now(),
+	}
+}
+
+//isBlocked checks if client is blocked for sending malformed packets
+func (g *guard) isBlocked(client string, now time.Time) bool {
+	g.Lock()
+	defer g.Unlock()
+	g.maybePrune(now)
+	until, ok := g.blocked[client]
+	return ok && now.Before(until)
+}
+
+//malformed counts a malformed packet against client, returning true if that got it blocked
+func (g *guard) malformed(client string, now time.Time) bool {
+	if g.protection.AbuseThreshold <= 0 {
+		return false
+	}
+	g.Lock()
+	defer g.Unlock()
+	s, ok := g.scores[client]
+	if !ok {
+		s = &abuseScore{last: now}
+		g.scores[client] = s
+	}
+	if s.add(now, g.protection.AbuseDecay) < g.protection.AbuseThreshold {
+		return false
+	}
+	delete(g.scores, client)
+	g.blocked[client] = now.Add(g.protection.BlockFor)
+	return true
+}
+
+//checkCookie lets a request through if the client doesn't need to be checked, or if this is a retransmit
+//of a request that was dropped before.  Otherwise it remembers the request and returns false.
+func (g *guard) checkCookie(addr *net.UDPAddr, data []byte, now time.Time) bool {
+	if !g.checksRequests(addr.IP) {
+		return true
+	}
+	g.Lock()
+	defer g.Unlock()
+	g.maybePrune(now)
+	if until, ok := g.verified[addr.IP.String()]; ok && now.Before(until) {
+		return true
+	}
+	key := addr.String() + "|" + string(data)
+	if seen, ok := g.cookies[key]; ok && now.Sub(seen) <= g.protection.CookieWindow {
+		delete(g.cookies, key)
+		return true
+	}
+	if len(g.cookies) < maxCookies {
+		g.cookies[key] = now
+	}
+	return false
+}
+
+//checksRequests says whether client has to retransmit its first request
+func (g *guard) checksRequests(client net.IP) bool {
+	return len(g.protection.Untrusted) > 0 && (AccessList{Allow: g.protection.Untrusted}).Allowed(client)
+}
+
+//send reserves n bytes in flight to an unverified client, returning false if that would go over the cap
+func (g *guard) send(client string, n int64) bool {
+	if g.protection.MaxUnverifiedBytes <= 0 {
+		return true
+	}
+	g.Lock()
+	defer g.Unlock()
+	if g.unverified[client]+n > g.protection.MaxUnverifiedBytes {
+		return false
+	}
+	g.unverified[client] += n
+	return true
+}
+
+//release gives back bytes reserved by send, once a transfer is verified or over
+func (g *guard) release(client string, n int64) {
+	if g.protection.MaxUnverifiedBytes <= 0 || n == 0 {
+		return
+	}
+	g.Lock()
+	defer g.Unlock()
+	if g.unverified[client] -= n; g.unverified[client] <= 0 {
+		delete(g.unverified, client)
+	}
+}
+
+//verify marks client as able to receive our packets, releasing the n bytes its transfer had in flight
+func (g *guard) verify(client string, n int64, now time.Time) {
+	g.release(client, n)
+	if len(g.protection.Untrusted) == 0 {
+		return
+	}
+	g.Lock()
+	defer g.Unlock()
+	g.verified[client] = now.Add(g.protection.VerifiedFor)
+}
+
+//maybePrune forgets expired state every guardPruneInterval, must hold the lock
+func (g *guard) maybePrune(now time.Time) {
+	if now.Sub(g.lastPrune) < guardPruneInterval {
+		return
+	}
+	for client, until := range g.verified {
+		if !now.Before(until) {
+			delete(g.verified, client)
+		}
+	}
+	for key, seen := range g.cookies {
+		if now.Sub(seen) > g.protection.CookieWindow {
+			delete(g.cookies, key)
+		}
+	}
+	for client, until := range g.blocked {
+		if !now.Before(until) {
+			delete(g.blocked, client)
+		}
+	}
+	for client, s := range g.scores {
+		if s.decay(now, g.protection.AbuseDecay) == 0 {
+			delete(g.scores, client)
+		}
+	}
+	g.lastPrune = now
+}
+
+//abuseScore counts malformed packets, forgetting one every decay interval
+type abuseScore struct {
+	score int
+	last  time.Time
+}
+
+func (s *abuseScore) decay(now time.Time, interval time.Duration) int {
+	forgiven := int(now.Sub(s.last) / interval)
+	if forgiven >= s.score {
+		s.score = 0
+		s.last = now
+		return 0
+	}
+	s.score -= forgiven
+	s.last = s.last.Add(time.Duration(forgiven) * interval)
+	return s.score
+}
+
+func (s *abuseScore) add(now time.Time, interval time.Duration) int {
+	s.decay(now, interval)
+	s.score++
+	return s.score
+}
@@ -0,0 +1,178 @@
+package tftp
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/lienmeat/tftp/udpserver"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGuard_malformed(t *testing.T) {
+	now := time.Now()
+	g := newGuard(Protection{AbuseThreshold: 3, AbuseDecay: time.Minute, BlockFor: time.Hour})
+
+	assert.False(t, g.malformed("10.0.0.1", now))
+	assert.False(t, g.malformed("10.0.0.1", now))
+	//one was forgiven after a minute
+	assert.False(t, g.malformed("10.0.0.1", now.Add(time.Minute)))
+	assert.False(t, g.isBlocked("10.0.0.1", now.Add(time.Minute)))
+	assert.True(t, g.malformed("10.0.0.1", now.Add(time.Minute)))
+	assert.True(t, g.isBlocked("10.0.0.1", now.Add(time.Minute)))
+	assert.False(t, g.isBlocked("10.0.0.2", now.Add(time.Minute)))
+	assert.False(t, g.isBlocked("10.0.0.1", now.Add(time.Hour+time.Minute)))
+
+	g = newGuard(Protection{})
+	for i := 0; i < 100; i++ {
+		assert.False(t, g.malformed("10.0.0.1", now))
+	}
+}
+
+func TestGuard_checkCookie(t *testing.T) {
+	now := time.Now()
+	untrusted, _ := ParseNetworks([]string{"192.168.0.0/16"})
+	g := newGuard(Protection{Untrusted: untrusted, CookieWindow: time.Second * 10})
+	request := (&PacketRequest{Op: OpRRQ, Filename: "test", Mode: "octet"}).Serialize()
+	client := &net.UDPAddr{IP: net.ParseIP("192.168.1.1"), Port: 5000}
+
+	assert.True(t, g.checkCookie(&net.UDPAddr{IP: net.ParseIP("10.0.0.1"), Port: 5000}, request, now))
+
+	assert.False(t, g.checkCookie(client, request, now))
+	//a different port isn't the same client
+	assert.False(t, g.checkCookie(&net.UDPAddr{IP: client.IP, Port: 5001}, request, now.Add(time.Second)))
+	assert.True(t, g.checkCookie(client, request, now.Add(time.Second)))
+
+	//a retransmit too long after is treated as a new first request
+	assert.False(t, g.checkCookie(client, request, now))
+	assert.False(t, g.checkCookie(client, request, now.Add(time.Second*11)))
+
+	//verified clients are let straight through
+	g.verify(client.IP.String(), 0, now)
+	assert.True(t, g.checkCookie(&net.UDPAddr{IP: client.IP, Port: 5002}, request, now))
+	assert.False(t, g.checkCookie(&net.UDPAddr{IP: client.IP, Port: 5002}, request, now.Add(defaultVerifiedFor)))
+}
+
+func TestGuard_send(t *testing.T) {
+	g := newGuard(Protection{MaxUnverifiedBytes: 1000})
+
+	assert.True(t, g.send("10.0.0.1", 600))
+	assert.False(t, g.send("10.0.0.1", 600))
+	assert.True(t, g.send("10.0.0.2", 600))
+	g.release("10.0.0.1", 600)
+	assert.True(t, g.send("10.0.0.1", 600))
+	g.verify("10.0.0.1", 600, time.Now())
+	assert.Equal(t, map[string]int64{"10.0.0.2": 600}, g.unverified)
+
+	g = newGuard(Protection{})
+	assert.True(t, g.send("10.0.0.1", 1<<40))
+}
+
+//startTestWorker runs a transferWorker fed by the returned channels
+func startTestWorker(h *TFTPProtocolHandler) (in chan *udpserver.UDPPacket, out chan *udpserver.UDPPacket, done chan struct{}) {
+	in = make(chan *udpserver.UDPPacket, 1)
+	out = make(chan *udpserver.UDPPacket, 10)
+	done = make(chan struct{})
+	def, _ := h.VirtualServer(DefaultVirtualServer)
+	go func() {
+		h.transferWorker(context.Background(), def, in, out)
+		close(done)
+	}()
+	return in, out, done
+}
+
+func TestTransferWorker_unverifiedBytes(t *testing.T) {
+	client := &net.UDPAddr{IP: net.ParseIP("10.0.0.1"), Port: 5000}
+	request := &PacketRequest{Op: OpRRQ, Filename: "test", Mode: "octet", Options: map[string]string{"timeout": "1"}}
+	oack := (&PacketOAck{Options: map[string]string{"timeout": "1"}}).Serialize()
+
+	h := NewTFTPProtocolHandler(6000, 6100, WithProtection(Protection{MaxUnverifiedBytes: int64(len(oack)) + 1}))
+	h.Files.Set(File{Filename: "test", Data: []byte("hello")})
+
+	//a spoofed request never gets acked, so the OACK is never retransmitted
+	in, out, done := startTestWorker(h)
+	in <- udpserver.NewUDPPacket(client, request.Serialize())
+	select {
+	case <-done:
+	case <-time.After(time.Second * 3):
+		t.Fatal("worker didn't give up")
+	}
+	assert.Len(t, out, 1)
+	assert.Empty(t, h.guard.unverified)
+
+	//a real client acks, which lets the transfer go on
+	in, out, done = startTestWorker(h)
+	in <- udpserver.NewUDPPacket(client, request.Serialize())
+	assert.Equal(t, oack, (<-out).Data())
+	in <- udpserver.NewUDPPacket(client, (&PacketAck{BlockNum: 0}).Serialize())
+	assert.Equal(t, (&PacketData{BlockNum: 1, Data: []byte("hello")}).Serialize(), (<-out).Data())
+	assert.Empty(t, h.guard.unverified)
+	in <- udpserver.NewUDPPacket(client, (&PacketAck{BlockNum: 1}).Serialize())
+	<-done
+}
+
+func TestTransferWorker_singlePortUnverified(t *testing.T) {
+	client := &net.UDPAddr{IP: net.ParseIP("10.0.0.1"), Port: 5000}
+	request := (&PacketRequest{Op: OpRRQ, Filename: "test", Mode: "octet"}).Serialize()
+	data := bytes.Repeat([]byte("x"), 600)
+	block1 := (&PacketData{BlockNum: 1, Data: data[:512]}).Serialize()
+
+	//anyone can ack to the listen port, so that doesn't verify a client
+	h := NewTFTPProtocolHandler(6000, 6100, WithSinglePort(nil),
+		WithProtection(Protection{MaxUnverifiedBytes: int64(len(block1)) + 1}))
+	h.Files.Set(File{Filename: "test", Data: data})
+	in, out, done := startTestWorker(h)
+	in <- udpserver.NewUDPPacket(client, request)
+	assert.Equal(t, block1, (<-out).Data())
+	in <- udpserver.NewUDPPacket(client, (&PacketAck{BlockNum: 1}).Serialize())
+	<-done
+	assert.Empty(t, out, "a spoofed ack let the transfer go on")
+	assert.Empty(t, h.guard.unverified)
+
+	//unless the client had to retransmit its request to get this far
+	untrusted, _ := ParseNetworks([]string{"10.0.0.0/8"})
+	h = NewTFTPProtocolHandler(6000, 6100, WithSinglePort(nil),
+		WithProtection(Protection{MaxUnverifiedBytes: int64(len(block1)) + 1, Untrusted: untrusted}))
+	h.Files.Set(File{Filename: "test", Data: data})
+	in, out, done = startTestWorker(h)
+	in <- udpserver.NewUDPPacket(client, request)
+	assert.Equal(t, block1, (<-out).Data())
+	in <- udpserver.NewUDPPacket(client, (&PacketAck{BlockNum: 1}).Serialize())
+	assert.Equal(t, (&PacketData{BlockNum: 2, Data: data[512:]}).Serialize(), (<-out).Data())
+	assert.Contains(t, h.guard.verified, "10.0.0.1")
+	in <- udpserver.NewUDPPacket(client, (&PacketAck{BlockNum: 2}).Serialize())
+	<-out
+	in <- udpserver.NewUDPPacket(client, (&PacketAck{BlockNum: 3}).Serialize())
+	<-done
+}
+
+func TestTransferWorker_malformed(t *testing.T) {
+	client := &net.UDPAddr{IP: net.ParseIP("10.0.0.1"), Port: 5000}
+	h := NewTFTPProtocolHandler(6000, 6100, WithProtection(Protection{AbuseThreshold: 2}))
+
+	//stray packets that aren't requests are dropped, but don't count
+	for i := 0; i < 3; i++ {
+		in, out, done := startTestWorker(h)
+		in <- udpserver.NewUDPPacket(client, (&PacketAck{BlockNum: 1}).Serialize())
+		<-done
+		assert.Empty(t, out)
+	}
+	assert.False(t, h.guard.isBlocked("10.0.0.1", time.Now()))
+
+	for i := 0; i < 2; i++ {
+		in, out, done := startTestWorker(h)
+		in <- udpserver.NewUDPPacket(client, []byte("garbage"))
+		<-done
+		assert.Empty(t, out)
+	}
+	assert.True(t, h.guard.isBlocked("10.0.0.1", time.Now()))
+
+	//blocked clients are ignored before a worker is started
+	def, _ := h.VirtualServer(DefaultVirtualServer)
+	responses := make(chan *udpserver.UDPPacket, 1)
+	h.startTransfer(context.Background(), def, udpserver.NewUDPPacket(client, []byte("garbage")), responses)
+	assert.Empty(t, h.limiter.perClient)
+	assert.Empty(t, responses)
+}
@@ -0,0 +1,92 @@
+package tftp
+
+import (
+	"strconv"
+	"strings"
+)
+
+//Quotas limit how much clients can store on a VirtualServer.  Zero values mean no limit.
+type Quotas struct {
+	//PerClient is the most bytes the files uploaded by one client IP can add up to
+	PerClient int64
+	//Paths limit the bytes stored under path prefixes, by any client
+	Paths []PathQuota
+}
+
+//PathQuota limits the bytes stored in files whose names start with Prefix
+type PathQuota struct {
+	Prefix string
+	Bytes  int64
+}
+
+//errAllocationExceeded is sent when an upload is over its size limit or quota
+var errAllocationExceeded = &PacketError{
+	Code: 3,
+	Msg:  "disk full or allocation exceeded",
+}
+
+//uploadAllowance is the most bytes client may upload to filename, given MaxUploadSize and Quotas.
+//The file being replaced doesn't count against quotas.  Returns -1 if there is no limit.
+func (v *VirtualServer) uploadAllowance(client string, filename string) int64 {
+	allowance, limited := int64(0), false
+	limit := func(max int64, used int64) {
+		left := max - used
+		if left < 0 {
+			//already over quota, ex: from files loaded at startup
+			left = 0
+		}
+		if !limited || left < allowance {
+			allowance = left
+			limited = true
+		}
+	}
+	if v.MaxUploadSize > 0 {
+		limit(v.MaxUploadSize, 0)
+	}
+	if v.Quotas.PerClient > 0 {
+		limit(v.Quotas.PerClient, v.Files.Usage(func(f File) bool {
+			return f.Owner == client && f.Filename != filename
+		}))
+	}
+	for _, q := range v.Quotas.Paths {
+		if q.Bytes <= 0 || !strings.HasPrefix(filename, q.Prefix) {
+			continue
+		}
+		limit(q.Bytes, v.Files.Usage(func(f File) bool {
+			return strings.HasPrefix(f.Filename, q.Prefix) && f.Filename != filename
+		}))
+	}
+	if !limited {
+		return -1
+	}
+	return allowance
+}
+
+//checkUploadAllowance refuses a write request up front if the client can't store anything, or announced
+//a size (tsize option) larger than it may store.  Otherwise it caps the size of the transfer.
+func checkUploadAllowance(server *VirtualServer, transfer *Transfer, client string, r *PacketRequest) (ok bool, response Packet) {
+	max := server.uploadAllowance(client, r.Filename)
+	if max < 0 {
+		return true, nil
+	}
+	tsize, err := strconv.ParseInt(r.Options["tsize"], 10, 64)
+	if max == 0 || (err == nil && tsize > max) {
+		transfer.Done = true
+		transfer.Error = true
+		return false, errAllocationExceeded
+	}
+	transfer.MaxSize = max
+	return true, nil
+}
+
+//store saves an uploaded file, unless other uploads have used up the quotas since it started
+func (v *VirtualServer) store(file File) bool {
+	v.storeLock.Lock()
+	defer v.storeLock.Unlock()
+	if max := v.uploadAllowance(file.Owner, file.Filename); max >= 0 && int64(len(file.Data)) > max {
+		return false
+	}
+	file.Modified = v.handler.clock.Now()
+	v.Files.Set(file)
+	return true
+}
@@ -0,0 +1,98 @@
+package tftp
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestVirtualServer_uploadAllowance(t *testing.T) {
+	h := NewTFTPProtocolHandler(6000, 6100)
+	v, _ := h.NewVirtualServer("quota")
+	v.Files.Set(File{Filename: "configs/a", Data: bytes.Repeat([]byte("a"), 300), Owner: "10.0.0.1"})
+	v.Files.Set(File{Filename: "configs/b", Data: bytes.Repeat([]byte("b"), 200), Owner: "10.0.0.2"})
+	v.Files.Set(File{Filename: "images/c", Data: bytes.Repeat([]byte("c"), 400), Owner: "10.0.0.1"})
+
+	assert.Equal(t, int64(-1), v.uploadAllowance("10.0.0.1", "configs/new"))
+
+	v.MaxUploadSize = 1000
+	assert.Equal(t, int64(1000), v.uploadAllowance("10.0.0.1", "configs/new"))
+
+	v.Quotas.PerClient = 1000
+	assert.Equal(t, int64(300), v.uploadAllowance("10.0.0.1", "configs/new"))
+	//replacing a file frees up its space
+	assert.Equal(t, int64(600), v.uploadAllowance("10.0.0.1", "configs/a"))
+	assert.Equal(t, int64(800), v.uploadAllowance("10.0.0.2", "configs/new"))
+
+	v.Quotas.Paths = []PathQuota{{Prefix: "configs/", Bytes: 600}}
+	assert.Equal(t, int64(100), v.uploadAllowance("10.0.0.2", "configs/new"))
+	assert.Equal(t, int64(800), v.uploadAllowance("10.0.0.2", "images/new"))
+
+	v.Quotas.Paths = []PathQuota{{Prefix: "configs/", Bytes: 400}}
+	assert.Equal(t, int64(0), v.uploadAllowance("10.0.0.2", "configs/new"))
+}
+
+func Test_checkUploadAllowance(t *testing.T) {
+	h := NewTFTPProtocolHandler(6000, 6100)
+	v, _ := h.NewVirtualServer("quota")
+	v.MaxUploadSize = 1000
+
+	tests := []struct {
+		name         string
+		options      map[string]string
+		wantOk       bool
+		wantResponse Packet
+		wantTransfer *Transfer
+	}{
+		{
+			name:         "no tsize",
+			wantOk:       true,
+			wantTransfer: &Transfer{MaxSize: 1000},
+		},
+		{
+			name:         "tsize fits",
+			options:      map[string]string{"tsize": "1000"},
+			wantOk:       true,
+			wantTransfer: &Transfer{MaxSize: 1000},
+		},
+		{
+			name:         "tsize too big",
+			options:      map[string]string{"tsize": "1001"},
+			wantResponse: errAllocationExceeded,
+			wantTransfer: &Transfer{Done: true, Error: true},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			transfer := &Transfer{}
+			ok, response := checkUploadAllowance(v, transfer, "10.0.0.1", &PacketRequest{Op: OpWRQ, Filename: "f", Mode: "octet", Options: tt.options})
+			assert.Equal(t, tt.wantOk, ok)
+			assert.Equal(t, tt.wantResponse, response)
+			assert.Equal(t, tt.wantTransfer, transfer)
+		})
+	}
+}
+
+func TestVirtualServer_store(t *testing.T) {
+	h := NewTFTPProtocolHandler(6000, 6100)
+	v, _ := h.NewVirtualServer("quota")
+	v.Quotas.PerClient = 1000
+
+	//two uploads that each fit on their own, but not together
+	assert.True(t, v.store(File{Filename: "a", Data: bytes.Repeat([]byte("a"), 600), Owner: "10.0.0.1"}))
+	assert.False(t, v.store(File{Filename: "b", Data: bytes.Repeat([]byte("b"), 600), Owner: "10.0.0.1"}))
+	_, ok := v.Files.Get("b")
+	assert.False(t, ok)
+}
+
+func Test_processOpData_maxSize(t *testing.T) {
+	transfer := &Transfer{File: NewFile("test"), Op: OpWRQ, Block: 1, MaxSize: 700}
+
+	response := processOpData(transfer, &PacketData{BlockNum: 1, Data: bytes.Repeat([]byte("a"), 512)})
+	assert.Equal(t, &PacketAck{BlockNum: 1}, response)
+
+	response = processOpData(transfer, &PacketData{BlockNum: 2, Data: bytes.Repeat([]byte("a"), 512)})
+	assert.Equal(t, errAllocationExceeded, response)
+	assert.Equal(t, &Transfer{File: File{Filename: "test"}, Op: OpWRQ, Block: 2, MaxSize: 700, Done: true, Error: true}, transfer)
+}
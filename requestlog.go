@@ -0,0 +1,290 @@
+package tftp
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lienmeat/tftp/clock"
+	log "github.com/sirupsen/logrus"
+)
+
+//Request log formats
+const (
+	//RequestLogJSON writes one JSON object per line
+	RequestLogJSON = "json"
+	//RequestLogLogfmt writes key=value pairs, one line per entry
+	RequestLogLogfmt = "logfmt"
+	//RequestLogW3C writes the W3C extended log file format used by web server access logs
+	RequestLogW3C = "w3c"
+)
+
+//OpenRequestLog returns a request log, for WithRequestLogger, writing to filename in format and rotated
+//as configured.  Close the RotatingFile when done.
+func OpenRequestLog(filename string, format string, rotate RotateOptions) (Logger, *RotatingFile, error) {
+	formatter, err := RequestLogFormatter(format)
+	if err != nil {
+		return nil, nil, err
+	}
+	f := &RotatingFile{Filename: filename, RotateOptions: rotate}
+	if format == RequestLogW3C {
+		f.header = w3cHeader
+	}
+	if err := f.open(); err != nil {
+		return nil, nil, err
+	}
+	logger := log.New()
+	logger.SetLevel(log.InfoLevel)
+	logger.SetFormatter(formatter)
+	logger.SetOutput(f)
+	return LogrusLogger(logger), f, nil
+}
+
+//RequestLogFormatter returns the formatter for one of the request log formats
+func RequestLogFormatter(format string) (log.Formatter, error) {
+	switch format {
+	case RequestLogJSON:
+		return &log.JSONFormatter{}, nil
+	case RequestLogLogfmt, "":
+		return &log.TextFormatter{DisableColors: true, FullTimestamp: true}, nil
+	case RequestLogW3C:
+		return &W3CFormatter{}, nil
+	}
+	return nil, fmt.Errorf("unknown request log format %s, must be %s, %s or %s", format, RequestLogJSON, RequestLogLogfmt, RequestLogW3C)
+}
+
+//w3cFields are the columns of the W3C request log, x- fields are specific to tftpd.  date and time are
+//when the transfer started.
+var w3cFields = []string{"date", "time", "s-sitename", "c-ip", "c-port", "cs-method", "cs-uri-stem",
+	"x-outcome", "x-code", "sc-bytes", "time-taken", "x-blksize", "x-retransmits"}
+
+func w3cHeader(now time.Time) []byte {
+	return []byte(fmt.Sprintf("#Software: tftpd\n#Version: 1.0\n#Date: %s\n#Fields: %s\n",
+		now.UTC().Format("2006-01-02 15:04:05"), strings.Join(w3cFields, " ")))
+}
+
+//W3CFormatter formats the request log as a W3C extended log file, with a line per finished transfer.
+//Other entries, like transfer requests, are left out.  The header with the #Fields directive is written
+//by the RotatingFile at the top of each file.
+type W3CFormatter struct{}
+
+func (f *W3CFormatter) Format(entry *log.Entry) ([]byte, error) {
+	if _, ok := entry.Data["outcome"]; !ok {
+		return nil, nil
+	}
+	started := entry.Time
+	if s, ok := entry.Data["started"].(string); ok {
+		if t, err := time.Parse(time.RFC3339Nano, s); err == nil {
+			started = t
+		}
+	}
+	started = started.UTC()
+	ip, port := "-", "-"
+	if host, p, err := net.SplitHostPort(fmt.Sprint(entry.Data["address"])); err == nil {
+		ip, port = host, p
+	}
+	timeTaken := "-"
+	if d, ok := entry.Data["duration"].(float64); ok {
+		timeTaken = strconv.FormatFloat(d, 'f', 3, 64)
+	}
+	values := []string{
+		started.Format("2006-01-02"),
+		started.Format("15:04:05"),
+		w3cValue(entry.Data["server"]),
+		ip,
+		port,
+		w3cValue(entry.Data["op"]),
+		w3cValue(entry.Data["filename"]),
+		w3cValue(entry.Data["outcome"]),
+		w3cValue(entry.Data["code"]),
+		w3cValue(entry.Data["bytes"]),
+		timeTaken,
+		w3cValue(entry.Data["blksize"]),
+		w3cValue(entry.Data["retransmits"]),
+	}
+	b := &bytes.Buffer{}
+	b.WriteString(strings.Join(values, " "))
+	b.WriteByte('\n')
+	return b.Bytes(), nil
+}
+
+//w3cValue renders a field, - if it's missing and quoted if it has spaces
+func w3cValue(v interface{}) string {
+	if v == nil {
+		return "-"
+	}
+	s := fmt.Sprint(v)
+	if s == "" {
+		return "-"
+	}
+	if strings.ContainsAny(s, " \t\"") {
+		return `"` + strings.Replace(s, `"`, `""`, -1) + `"`
+	}
+	return s
+}
+
+//RotateOptions control when a RotatingFile is rotated and how many old files are kept.
+//Zero values turn each off.
+type RotateOptions struct {
+	//MaxSize rotates the file before it grows past this many bytes
+	MaxSize int64
+	//Every rotates the file once it has been open this long
+	Every time.Duration
+	//MaxBackups is how many rotated files to keep
+	MaxBackups int
+	//MaxAge removes rotated files older than this
+	MaxAge time.Duration
+}
+
+//rotatedTimeFormat is appended to the filename of rotated files, it sorts in time order
+const rotatedTimeFormat = "20060102T150405.000000000"
+
+//RotatingFile is an append-only log file that rotates itself by size and age.  Rotated files are renamed
+//to Filename.<timestamp>.  Reopen supports rotation by external tools like logrotate.
+type RotatingFile struct {
+	Filename string
+	RotateOptions
+	//header, if set, is written at the top of every new file
+	header func(now time.Time) []byte
+	file   *os.File
+	size   int64
+	opened time.Time
+	//clock times rotations, clock.Real unless a test sets it
+	clock clock.Clock
+	sync.Mutex
+}
+
+//OpenRotatingFile opens filename for appending, creating it if needed
+func OpenRotatingFile(filename string, rotate RotateOptions) (*RotatingFile, error) {
+	f := &RotatingFile{Filename: filename, RotateOptions: rotate}
+	return f, f.open()
+}
+
+//open opens Filename, must hold the lock
+func (f *RotatingFile) open() error {
+	if f.clock == nil {
+		f.clock = clock.Real
+	}
+	file, err := os.OpenFile(f.Filename, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("err opening %s file: %s", f.Filename, err.Error())
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	f.file = file
+	f.size = info.Size()
+	f.opened = f.clock.Now()
+	if f.size == 0 && f.header != nil {
+		n, err := file.Write(f.header(f.opened))
+		f.size += int64(n)
+		return err
+	}
+	return nil
+}
+
+func (f *RotatingFile) Write(p []byte) (int, error) {
+	f.Lock()
+	defer f.Unlock()
+	if f.file == nil {
+		return 0, os.ErrClosed
+	}
+	if f.needsRotation(int64(len(p)), f.clock.Now()) {
+		if err := f.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+	return n, err
+}
+
+func (f *RotatingFile) needsRotation(n int64, now time.Time) bool {
+	if f.MaxSize > 0 && f.size > 0 && f.size+n > f.MaxSize {
+		return true
+	}
+	return f.Every > 0 && now.Sub(f.opened) >= f.Every
+}
+
+//Rotate moves the current file aside and starts a new one
+func (f *RotatingFile) Rotate() error {
+	f.Lock()
+	defer f.Unlock()
+	return f.rotate()
+}
+
+func (f *RotatingFile) rotate() error {
+	if f.file != nil {
+		f.file.Close()
+		f.file = nil
+	}
+	if err := os.Rename(f.Filename, f.Filename+"."+f.clock.Now().UTC().Format(rotatedTimeFormat)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := f.open(); err != nil {
+		return err
+	}
+	return f.prune(f.clock.Now())
+}
+
+//prune removes rotated files beyond MaxBackups or older than MaxAge
+func (f *RotatingFile) prune(now time.Time) error {
+	if f.MaxBackups <= 0 && f.MaxAge <= 0 {
+		return nil
+	}
+	rotated, err := filepath.Glob(f.Filename + ".*")
+	if err != nil {
+		return err
+	}
+	//newest first
+	sort.Sort(sort.Reverse(sort.StringSlice(rotated)))
+	//kept counts our rotated files, other files that match aren't touched
+	kept := 0
+	for _, name := range rotated {
+		if _, err := time.Parse(rotatedTimeFormat, strings.TrimPrefix(name, f.Filename+".")); err != nil {
+			//not one of ours
+			continue
+		}
+		remove := f.MaxBackups > 0 && kept >= f.MaxBackups
+		if info, err := os.Stat(name); err == nil && f.MaxAge > 0 && now.Sub(info.ModTime()) > f.MaxAge {
+			remove = true
+		}
+		if remove {
+			os.Remove(name)
+			continue
+		}
+		kept++
+	}
+	return nil
+}
+
+//Reopen closes and reopens Filename, for after it was moved by an external tool.  Call it on SIGHUP.
+func (f *RotatingFile) Reopen() error {
+	f.Lock()
+	defer f.Unlock()
+	if f.file != nil {
+		f.file.Close()
+		f.file = nil
+	}
+	return f.open()
+}
+
+func (f *RotatingFile) Close() error {
+	f.Lock()
+	defer f.Unlock()
+	if f.file == nil {
+		return nil
+	}
+	err := f.file.Close()
+	f.file = nil
+	return err
+}
@@ -0,0 +1,206 @@
+package tftp
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lienmeat/tftp/clock"
+	"github.com/lienmeat/tftp/udpserver"
+	log "github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus/hooks/test"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRequestLogFormatter(t *testing.T) {
+	entry := &log.Entry{
+		Logger:  log.New(),
+		Time:    time.Date(2020, 5, 1, 10, 30, 5, 0, time.UTC),
+		Level:   log.InfoLevel,
+		Message: "transfer complete",
+		Data: log.Fields{
+			"server":      "default",
+			"address":     "10.0.0.1:5000",
+			"filename":    "images/boot file.img",
+			"op":          "get",
+			"started":     "2020-05-01T10:30:03.5Z",
+			"duration":    1.5,
+			"bytes":       int64(2048),
+			"blksize":     uint(1024),
+			"retransmits": 1,
+			"outcome":     "complete",
+			"code":        "none",
+		},
+	}
+	tests := []struct {
+		name    string
+		format  string
+		entry   *log.Entry
+		want    string
+		wantErr bool
+	}{
+		{name: "json", format: RequestLogJSON, entry: entry, want: `"outcome":"complete"`},
+		{name: "logfmt", format: RequestLogLogfmt, entry: entry, want: `level=info msg="transfer complete"`},
+		{name: "default is logfmt", format: "", entry: entry, want: `outcome=complete`},
+		{
+			name:   "w3c",
+			format: RequestLogW3C,
+			entry:  entry,
+			want:   "2020-05-01 10:30:03 default 10.0.0.1 5000 get \"images/boot file.img\" complete none 2048 1.500 1024 1\n",
+		},
+		{
+			name:   "w3c leaves out everything but finished transfers",
+			format: RequestLogW3C,
+			entry:  &log.Entry{Logger: log.New(), Message: "get boot.img transfer requested", Data: log.Fields{"op": "get"}},
+			want:   "",
+		},
+		{name: "unknown", format: "xml", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f, err := RequestLogFormatter(tt.format)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			b, err := f.Format(tt.entry)
+			assert.NoError(t, err)
+			if tt.format == RequestLogW3C {
+				assert.Equal(t, tt.want, string(b))
+			} else {
+				assert.Contains(t, string(b), tt.want)
+			}
+		})
+	}
+}
+
+func Test_w3cValue(t *testing.T) {
+	tests := []struct {
+		value interface{}
+		want  string
+	}{
+		{nil, "-"},
+		{"", "-"},
+		{"boot.img", "boot.img"},
+		{3, "3"},
+		{"a file", `"a file"`},
+		{`say "hi"`, `"say ""hi"""`},
+	}
+	for _, tt := range tests {
+		assert.Equal(t, tt.want, w3cValue(tt.value))
+	}
+}
+
+func TestRotatingFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tftp-log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	name := filepath.Join(dir, "requests.log")
+
+	//a file of someone else's that looks like a rotated one doesn't count as a backup
+	ioutil.WriteFile(name+".bak", []byte("bak\n"), 0644)
+	fake := clock.NewFake(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+	f := &RotatingFile{Filename: name, RotateOptions: RotateOptions{MaxSize: 10, MaxBackups: 1}, clock: fake}
+	if !assert.NoError(t, f.open()) {
+		return
+	}
+	defer f.Close()
+	for _, line := range []string{"one\n", "two\n", "three\n", "four\n", "five\n"} {
+		_, err := f.Write([]byte(line))
+		assert.NoError(t, err)
+		//rotated files are told apart by time
+		fake.Advance(time.Second)
+	}
+	data, _ := ioutil.ReadFile(name)
+	assert.Equal(t, "four\nfive\n", string(data))
+	//one\ntwo\n was rotated out first, then pruned when three\n was rotated out
+	rotated, _ := filepath.Glob(name + ".2*")
+	if assert.Equal(t, []string{name + ".20200101T000003.000000000"}, rotated) {
+		data, _ = ioutil.ReadFile(rotated[0])
+		assert.Equal(t, "three\n", string(data))
+	}
+	_, err = os.Stat(name + ".bak")
+	assert.NoError(t, err)
+
+	//reopen after the file was moved away, like logrotate does
+	assert.NoError(t, os.Rename(name, name+".moved"))
+	assert.NoError(t, f.Reopen())
+	f.Write([]byte("six\n"))
+	data, _ = ioutil.ReadFile(name)
+	assert.Equal(t, "six\n", string(data))
+
+	assert.NoError(t, f.Close())
+	_, err = f.Write([]byte("seven\n"))
+	assert.Error(t, err)
+}
+
+func TestRotatingFile_every(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tftp-log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	name := filepath.Join(dir, "requests.log")
+
+	fake := clock.NewFake(time.Now())
+	f := &RotatingFile{Filename: name, RotateOptions: RotateOptions{Every: time.Hour, MaxAge: time.Hour}, header: w3cHeader, clock: fake}
+	assert.NoError(t, f.open())
+	defer f.Close()
+	//an old rotated file, past MaxAge once the clock moves on
+	old := name + "." + fake.Now().Add(-time.Hour*2).UTC().Format(rotatedTimeFormat)
+	ioutil.WriteFile(old, []byte("old\n"), 0644)
+	os.Chtimes(old, fake.Now().Add(-time.Minute), fake.Now().Add(-time.Minute))
+
+	f.Write([]byte("one\n"))
+	fake.Advance(time.Hour)
+	f.Write([]byte("two\n"))
+
+	data, _ := ioutil.ReadFile(name)
+	assert.True(t, strings.HasPrefix(string(data), "#Software: tftpd\n#Version: 1.0\n#Date: "))
+	assert.True(t, strings.HasSuffix(string(data), "\ntwo\n"))
+	rotated, _ := filepath.Glob(name + ".*")
+	if assert.Len(t, rotated, 1) {
+		data, _ = ioutil.ReadFile(rotated[0])
+		assert.True(t, strings.HasSuffix(string(data), "\none\n"))
+	}
+}
+
+func TestTransferWorker_requestLog(t *testing.T) {
+	logger, hook := test.NewNullLogger()
+	client := &net.UDPAddr{IP: net.ParseIP("10.0.0.1"), Port: 5000}
+	h := NewTFTPProtocolHandler(6000, 6100, WithRequestLogger(LogrusLogger(logger)))
+	h.Files.Set(File{Filename: "logged", Data: make([]byte, 512)})
+
+	in, out, done := startTestWorker(h)
+	in <- udpserver.NewUDPPacket(client, (&PacketRequest{Op: OpRRQ, Filename: "logged", Mode: "octet"}).Serialize())
+	<-out
+	in <- udpserver.NewUDPPacket(client, (&PacketAck{BlockNum: 1}).Serialize())
+	<-out
+	in <- udpserver.NewUDPPacket(client, (&PacketAck{BlockNum: 2}).Serialize())
+	<-done
+
+	var finished *log.Entry
+	for _, e := range hook.AllEntries() {
+		if _, ok := e.Data["outcome"]; ok {
+			finished = e
+		}
+	}
+	if assert.NotNil(t, finished) {
+		assert.Equal(t, "transfer complete", finished.Message)
+		assert.Equal(t, "complete", finished.Data["outcome"])
+		assert.Equal(t, "10.0.0.1:5000", finished.Data["address"])
+		assert.Equal(t, "get", finished.Data["op"])
+		assert.Equal(t, int64(512), finished.Data["bytes"])
+		assert.Equal(t, uint(512), finished.Data["blksize"])
+		assert.Equal(t, 0, finished.Data["retransmits"])
+		assert.Equal(t, failedNoError, finished.Data["code"])
+		assert.IsType(t, float64(0), finished.Data["duration"])
+	}
+}
@@ -0,0 +1,73 @@
+package tftp
+
+import "time"
+
+const (
+	//initialRetransmitTimeout is how long to wait for the first response of a transfer, before its round
+	//trip time has been measured
+	initialRetransmitTimeout = time.Second
+	//minRetransmitTimeout keeps a fast network from making us resend before a client could have answered
+	minRetransmitTimeout = time.Millisecond * 200
+	//rttGranularity is the smallest variation allowed for, so a steady round trip time doesn't leave no room
+	rttGranularity = time.Millisecond * 10
+)
+
+//rttEstimator works out how long a transfer should wait for a response before resending, from the round
+//trip times measured so far, the way TCP does (RFC 6298).  Karn's algorithm applies: round trips of packets
+//that were resent aren't measured, since it's unknown which copy was answered.
+type rttEstimator struct {
+	//smoothed round trip time and its variation, once measured
+	srtt     time.Duration
+	rttvar   time.Duration
+	measured bool
+	//backoffs doubles the timeout for each timeout in a row
+	backoffs uint
+}
+
+//sample measures a round trip, ending any backoff
+func (e *rttEstimator) sample(rtt time.Duration) {
+	if rtt < 0 {
+		rtt = 0
+	}
+	if !e.measured {
+		e.srtt = rtt
+		e.rttvar = rtt / 2
+		e.measured = true
+	} else {
+		diff := e.srtt - rtt
+		if diff < 0 {
+			diff = -diff
+		}
+		e.rttvar = (3*e.rttvar + diff) / 4
+		e.srtt = (7*e.srtt + rtt) / 8
+	}
+	e.backoffs = 0
+}
+
+//backoff doubles the timeout after a timeout
+func (e *rttEstimator) backoff() {
+	e.backoffs++
+}
+
+//timeout is how long to wait for a response, never more than max, which is the negotiated timeout option
+//or the default
+func (e *rttEstimator) timeout(max time.Duration) time.Duration {
+	rto := initialRetransmitTimeout
+	if e.measured {
+		variation := 4 * e.rttvar
+		if variation < rttGranularity {
+			variation = rttGranularity
+		}
+		rto = e.srtt + variation
+	}
+	if rto < minRetransmitTimeout {
+		rto = minRetransmitTimeout
+	}
+	for i := uint(0); i < e.backoffs && rto < max; i++ {
+		rto *= 2
+	}
+	if rto > max {
+		rto = max
+	}
+	return rto
+}
@@ -0,0 +1,60 @@
+package tftp
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_rttEstimator(t *testing.T) {
+	ms := time.Millisecond
+	tests := []struct {
+		name     string
+		samples  []time.Duration
+		backoffs int
+		max      time.Duration
+		want     time.Duration
+	}{
+		{"unmeasured", nil, 0, retransmitTimeout, initialRetransmitTimeout},
+		{"unmeasured with a short negotiated timeout", nil, 0, 500 * ms, 500 * ms},
+		{"fast network", []time.Duration{ms, ms, ms}, 0, retransmitTimeout, minRetransmitTimeout},
+		//srtt 400ms, rttvar 200ms
+		{"slow network", []time.Duration{400 * ms}, 0, retransmitTimeout, 1200 * ms},
+		//srtt 425ms, rttvar 200ms
+		{"smoothed", []time.Duration{400 * ms, 600 * ms}, 0, retransmitTimeout, 1225 * ms},
+		//rttvar decays to almost nothing
+		{"steady", repeat(300*ms, 20), 0, retransmitTimeout, 300*ms + rttGranularity},
+		{"backoff", []time.Duration{ms}, 2, retransmitTimeout, 800 * ms},
+		{"backoff is capped", []time.Duration{ms}, 10, retransmitTimeout, retransmitTimeout},
+		{"negotiated timeout caps it", []time.Duration{400 * ms}, 1, 2 * time.Second, 2 * time.Second},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := rttEstimator{}
+			for _, rtt := range tt.samples {
+				e.sample(rtt)
+			}
+			for i := 0; i < tt.backoffs; i++ {
+				e.backoff()
+			}
+			assert.Equal(t, tt.want, e.timeout(tt.max))
+		})
+	}
+
+	//a new measurement ends the backoff
+	e := rttEstimator{}
+	e.sample(time.Millisecond)
+	e.backoff()
+	assert.Equal(t, 400*time.Millisecond, e.timeout(retransmitTimeout))
+	e.sample(time.Millisecond)
+	assert.Equal(t, minRetransmitTimeout, e.timeout(retransmitTimeout))
+}
+
+func repeat(d time.Duration, n int) []time.Duration {
+	ds := make([]time.Duration, n)
+	for i := range ds {
+		ds[i] = d
+	}
+	return ds
+}
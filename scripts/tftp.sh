@@ -4,22 +4,13 @@ IP=$1
 PORT=$2
 FILE=$3
 
+#the client built by `make build`, override with TFTP=/path/to/tftp
+TFTP=${TFTP:-"$(cd "$(dirname "$0")/.." && pwd)/tftp"}
+
 cd /tmp/up/
 
-tftp $IP $PORT << EOF
-  mode octet
-  verbose
-  trace
-  put $FILE
-  quit
-EOF
+"$TFTP" -v put "$IP:$PORT" "$FILE"
 
 cd /tmp/dl/
 
-tftp $IP $PORT << EOF
-  mode octet
-  verbose
-  trace
-  get $FILE
-  quit
-EOF
+"$TFTP" -v get "$IP:$PORT" "$FILE"
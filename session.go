@@ -0,0 +1,194 @@
+package tftp
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/lienmeat/tftp/clock"
+	"github.com/lienmeat/tftp/udpserver"
+)
+
+const (
+	//sessionBuffer is how many packets can wait for a transfer served from a listener, more are dropped
+	sessionBuffer = 4
+	//sessionLinger is how long packets from a client whose transfer just ended are still ignored, so a
+	//resent final data packet or ack isn't taken for a new transfer
+	sessionLinger = time.Second * 10
+	//sessionPruneInterval is how often sessions that stopped lingering are forgotten
+	sessionPruneInterval = time.Minute
+)
+
+//WithSinglePort serves every transfer from the listener its request arrived on, instead of from a new port
+//(TID) of its own, so only the listen ports have to be reachable through NAT and firewalls.  Packets are
+//routed to transfers by the client's address and port.  Clients in tidClients, which won't accept
+//responses from the port they sent their request to, still get a TID.
+func WithSinglePort(tidClients []*net.IPNet) Option {
+	return func(h *TFTPProtocolHandler) {
+		h.singlePort = true
+		h.tidClients = tidClients
+	}
+}
+
+//servesOnListener says whether the transfer a request starts is served from the listener it arrived on
+func (h *TFTPProtocolHandler) servesOnListener(packet *udpserver.UDPPacket) bool {
+	if !h.singlePort {
+		return false
+	}
+	return len(h.tidClients) == 0 || !(AccessList{Allow: h.tidClients}).Allowed(packet.Address().IP)
+}
+
+//serveOnListener runs a transfer fed the packets its listener routes to it, answering on the listener
+func (h *TFTPProtocolHandler) serveOnListener(ctx context.Context, server *VirtualServer, packet *udpserver.UDPPacket, in chan *udpserver.UDPPacket, responses chan<- *udpserver.UDPPacket) {
+	out := make(chan *udpserver.UDPPacket, 1)
+	written := make(chan struct{})
+	go func() {
+		for p := range out {
+			select {
+			case responses <- p:
+			case <-ctx.Done():
+			}
+		}
+		close(written)
+	}()
+	h.transferWorker(ctx, server, in, out)
+	close(out)
+	<-written
+}
+
+//session is a transfer started by a request to a listener, or one that just ended
+type session struct {
+	//in gets the packets for a transfer served from its listener, it's nil for one with a TID
+	in chan *udpserver.UDPPacket
+	//the request that started it
+	op       uint16
+	filename string
+	//ended is when it ended, zero while it's running
+	ended time.Time
+}
+
+//sessions tracks the transfers started by requests to the listeners, by the listener and client address
+//they're between, so a client resending its request doesn't start the same transfer twice.  It also routes
+//the packets a listener receives to the transfers served from it.
+type sessions struct {
+	sessions  map[string]*session
+	clock     clock.Clock
+	lastPrune time.Time
+	//duplicate is called with the op of each resent request dropped
+	duplicate func(op uint16)
+	sync.Mutex
+}
+
+func newSessions(c clock.Clock, duplicate func(op uint16)) *sessions {
+	return &sessions{
+		sessions:  map[string]*session{},
+		clock:     c,
+		lastPrune: c.Now(),
+		duplicate: duplicate,
+	}
+}
+
+//sessionKey identifies the transfer a packet belongs to
+func sessionKey(packet *udpserver.UDPPacket) string {
+	return packet.LocalAddress().String() + " " + packet.Address().String()
+}
+
+//open records the transfer request starts, unless one from the same client address and port is still running,
+//which it returns nil for.  Only requests are recorded, other packets are left for the transfer to drop.
+//If it's served from its listener, the packets between them are routed to the session's in, which holds
+//the request.
+func (s *sessions) open(request *udpserver.UDPPacket, onListener bool) *session {
+	s.Lock()
+	defer s.Unlock()
+	s.maybePrune()
+	key := sessionKey(request)
+	if ss, ok := s.sessions[key]; ok && ss.ended.IsZero() {
+		return nil
+	}
+	ss := &session{}
+	if onListener {
+		ss.in = make(chan *udpserver.UDPPacket, sessionBuffer)
+		ss.in <- request
+	}
+	if p, err := ParsePacket(request.Data()); err == nil {
+		if r, ok := p.(*PacketRequest); ok {
+			ss.op = r.Op
+			ss.filename = r.Filename
+			s.sessions[key] = ss
+		}
+	}
+	return ss
+}
+
+//close records the end of ss's transfer, whose client's stragglers are ignored for a while
+func (s *sessions) close(ss *session) {
+	s.Lock()
+	defer s.Unlock()
+	ss.ended = s.clock.Now()
+}
+
+//route hands packet to the transfer it belongs to, and says whether it did or dropped it.  Packets that
+//aren't for a transfer are left to start one.  While a transfer runs, every packet from its client is its
+//own: the request it was started by is dropped and counted as a duplicate, as the transfer resends its
+//response itself, another request is dropped with an error to refuse it with, and anything else a transfer
+//with a TID should have got there is dropped.  Once it has ended, requests start new transfers, and other
+//packets are ignored until it stopped lingering.
+func (s *sessions) route(packet *udpserver.UDPPacket) (bool, error) {
+	s.Lock()
+	defer s.Unlock()
+	ss, ok := s.sessions[sessionKey(packet)]
+	if !ok {
+		return false, nil
+	}
+	if !ss.ended.IsZero() {
+		if isRequest(packet.Data()) || s.clock.Now().Sub(ss.ended) > sessionLinger {
+			return false, nil
+		}
+		return true, nil
+	}
+	if isRequest(packet.Data()) {
+		p, err := ParsePacket(packet.Data())
+		if err != nil {
+			return true, nil
+		}
+		if r := p.(*PacketRequest); r.Op == ss.op && r.Filename == ss.filename {
+			s.duplicate(r.Op)
+			return true, nil
+		}
+		return true, errClientBusy
+	}
+	if ss.in == nil {
+		return true, nil
+	}
+	select {
+	case ss.in <- packet:
+	default:
+		//like the network, drop what the transfer can't keep up with
+	}
+	return true, nil
+}
+
+//maybePrune forgets sessions that stopped lingering every sessionPruneInterval, must hold the lock
+func (s *sessions) maybePrune() {
+	now := s.clock.Now()
+	if now.Sub(s.lastPrune) < sessionPruneInterval {
+		return
+	}
+	for key, ss := range s.sessions {
+		if !ss.ended.IsZero() && now.Sub(ss.ended) > sessionLinger {
+			delete(s.sessions, key)
+		}
+	}
+	s.lastPrune = now
+}
+
+//isRequest says whether data is a RRQ or WRQ, without parsing it
+func isRequest(data []byte) bool {
+	if len(data) < 2 {
+		return false
+	}
+	op := binary.BigEndian.Uint16(data)
+	return op == OpRRQ || op == OpWRQ
+}
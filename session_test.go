@@ -0,0 +1,248 @@
+package tftp
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/lienmeat/tftp/clock"
+	"github.com/lienmeat/tftp/memnet"
+	"github.com/lienmeat/tftp/udpserver"
+	"github.com/stretchr/testify/assert"
+)
+
+//memnetHandler serves a handler on 127.0.0.1:69 of a simulated network, with a fake clock that only moves
+//when told to.  stop shuts it down.
+func memnetHandler(minPort, maxPort int32, options ...Option) (h *TFTPProtocolHandler, network *memnet.Network, stop func()) {
+	fake := clock.NewFake(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+	network = memnet.NewNetwork(fake, 1, memnet.Conditions{})
+	options = append([]Option{WithListenPacket(network.ListenUDP), WithClock(fake)}, options...)
+	h = NewTFTPProtocolHandler(minPort, maxPort, options...)
+	ctx, cancel := context.WithCancel(context.Background())
+	health := &udpserver.Health{}
+	go udpserver.ServeWithHealth(ctx, []udpserver.Listener{{Address: "127.0.0.1:69", Handler: h}}, health,
+		udpserver.WithListenPacket(network.ListenUDP))
+	for !health.Alive() {
+		time.Sleep(time.Millisecond)
+	}
+	return h, network, cancel
+}
+
+//nextPacket reads the next packet to arrive at c, or nil if none arrives soon
+func nextPacket(t *testing.T, c net.PacketConn) (Packet, net.Addr) {
+	buf := make([]byte, 1024)
+	c.SetReadDeadline(time.Time{})
+	got := make(chan int)
+	var from net.Addr
+	go func() {
+		n, addr, err := c.ReadFrom(buf)
+		if err != nil {
+			n = -1
+		}
+		from = addr
+		got <- n
+	}()
+	select {
+	case n := <-got:
+		if n < 0 {
+			return nil, nil
+		}
+		p, err := ParsePacket(buf[:n])
+		assert.NoError(t, err)
+		return p, from
+	case <-time.After(time.Millisecond * 50):
+		//wake the read up so it doesn't take the next packet
+		c.SetReadDeadline(time.Unix(1, 0))
+		<-got
+		return nil, nil
+	}
+}
+
+func Test_sessions(t *testing.T) {
+	fake := clock.NewFake(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+	duplicates := 0
+	s := newSessions(fake, func(op uint16) {
+		assert.Equal(t, OpRRQ, op)
+		duplicates++
+	})
+	client := &net.UDPAddr{IP: net.ParseIP("10.0.0.1"), Port: 5000}
+	request := udpserver.NewUDPPacket(client, (&PacketRequest{Op: OpRRQ, Filename: "test", Mode: "octet"}).Serialize())
+	another := udpserver.NewUDPPacket(client, (&PacketRequest{Op: OpRRQ, Filename: "other", Mode: "octet"}).Serialize())
+	ack := udpserver.NewUDPPacket(client, (&PacketAck{BlockNum: 1}).Serialize())
+	other := udpserver.NewUDPPacket(&net.UDPAddr{IP: net.ParseIP("10.0.0.1"), Port: 5001}, ack.Data())
+
+	route := func(p *udpserver.UDPPacket) bool {
+		routed, err := s.route(p)
+		assert.NoError(t, err)
+		return routed
+	}
+
+	//a transfer with a TID has every packet from its client dropped, resent requests counted, others refused
+	tid := s.open(request, false)
+	assert.Nil(t, tid.in)
+	assert.True(t, route(request))
+	routed, err := s.route(another)
+	assert.True(t, routed)
+	assert.Equal(t, errClientBusy, err)
+	assert.Equal(t, 1, duplicates)
+	assert.True(t, route(ack))
+	assert.False(t, route(other))
+	//and can't be replaced while it runs
+	assert.Nil(t, s.open(another, false))
+	assert.True(t, route(request))
+	assert.Equal(t, 2, duplicates)
+
+	//once it ends, requests start new transfers, stragglers are ignored for a while
+	s.close(tid)
+	assert.False(t, route(request))
+	assert.False(t, route(another))
+	assert.True(t, route(ack))
+	fake.Advance(sessionLinger + 1)
+	assert.False(t, route(ack))
+
+	//one served from its listener gets the packets from its client, other ports' don't
+	listener := s.open(request, true)
+	in := listener.in
+	assert.Equal(t, request, <-in)
+	assert.True(t, route(ack))
+	assert.Equal(t, ack, <-in)
+	assert.False(t, route(other))
+	assert.True(t, route(request))
+	assert.Empty(t, in)
+	assert.Equal(t, 3, duplicates)
+	routed, err = s.route(another)
+	assert.True(t, routed)
+	assert.Equal(t, errClientBusy, err)
+	assert.Empty(t, in)
+	//packets the transfer can't keep up with are dropped
+	for i := 0; i < sessionBuffer+1; i++ {
+		assert.True(t, route(ack))
+	}
+	assert.Len(t, in, sessionBuffer)
+
+	//once the transfer ends, stragglers are ignored for a while, but new requests start a transfer
+	s.close(listener)
+	assert.True(t, route(ack))
+	assert.False(t, route(request))
+	fake.Advance(sessionLinger + 1)
+	assert.False(t, route(ack))
+
+	//packets that aren't requests aren't recorded
+	assert.NotNil(t, s.open(other, true))
+	assert.NotContains(t, s.sessions, sessionKey(other))
+
+	//and ended sessions are forgotten
+	fake.Advance(sessionPruneInterval)
+	s.open(another, true)
+	assert.Len(t, s.sessions, 1)
+}
+
+func TestTFTPProtocolHandler_duplicateRequests(t *testing.T) {
+	h, network, stop := memnetHandler(1000, 1100)
+	defer stop()
+	h.Files.Set(File{Filename: "test", Data: bytes.Repeat([]byte("x"), 600)})
+	c, _ := network.ListenPacket("udp", "10.0.0.1:0")
+	rrq := (&PacketRequest{Op: OpRRQ, Filename: "test", Mode: "octet"}).Serialize()
+
+	//a slow client resends its request before the first block arrives, which only starts one transfer
+	for i := 0; i < 3; i++ {
+		c.WriteTo(rrq, &net.UDPAddr{IP: memnet.Host, Port: 69})
+	}
+	for h.Metrics.duplicates.value("get") < 2 {
+		time.Sleep(time.Millisecond)
+	}
+	assert.Len(t, h.Transfers.List(), 1)
+	assert.Equal(t, float64(1), h.Metrics.requests.value(DefaultVirtualServer, "get"))
+
+	//a stray ack to the listen port doesn't replace the running transfer, so resends are still caught
+	c.WriteTo((&PacketAck{BlockNum: 1}).Serialize(), &net.UDPAddr{IP: memnet.Host, Port: 69})
+	c.WriteTo(rrq, &net.UDPAddr{IP: memnet.Host, Port: 69})
+	for h.Metrics.duplicates.value("get") < 3 {
+		time.Sleep(time.Millisecond)
+	}
+	assert.Len(t, h.Transfers.List(), 1)
+
+	//a client asking again as soon as its transfer ended, like one that aborted a tsize probe, is served
+	h.Files.Set(File{Filename: "small", Data: []byte("small")})
+	small, _ := network.ListenPacket("udp", "10.0.0.2:0")
+	rrq = (&PacketRequest{Op: OpRRQ, Filename: "small", Mode: "octet"}).Serialize()
+	small.WriteTo(rrq, &net.UDPAddr{IP: memnet.Host, Port: 69})
+	p, tid := nextPacket(t, small)
+	assert.Equal(t, &PacketData{BlockNum: 1, Data: []byte("small")}, p)
+	small.WriteTo((&PacketError{Code: 0, Msg: "tsize probe"}).Serialize(), tid)
+	for len(h.Transfers.List()) > 1 {
+		time.Sleep(time.Millisecond)
+	}
+	small.WriteTo(rrq, &net.UDPAddr{IP: memnet.Host, Port: 69})
+	p, _ = nextPacket(t, small)
+	assert.Equal(t, &PacketData{BlockNum: 1, Data: []byte("small")}, p)
+	assert.Equal(t, float64(3), h.Metrics.duplicates.value("get"))
+}
+
+func TestTFTPProtocolHandler_singlePort(t *testing.T) {
+	tidClients, _ := ParseNetworks([]string{"10.0.0.2"})
+	h, network, stop := memnetHandler(1000, 1100, WithSinglePort(tidClients))
+	defer stop()
+	data := bytes.Repeat([]byte("x"), 600)
+	h.Files.Set(File{Filename: "test", Data: data})
+	h.Files.Set(File{Filename: "other", Data: []byte("other")})
+	server := &net.UDPAddr{IP: memnet.Host, Port: 69}
+	listen := func(ip string) net.PacketConn {
+		c, err := network.ListenPacket("udp", ip+":0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return c
+	}
+	next := func(c net.PacketConn) (Packet, net.Addr) {
+		return nextPacket(t, c)
+	}
+	rrq := (&PacketRequest{Op: OpRRQ, Filename: "test", Mode: "octet"}).Serialize()
+	other := (&PacketRequest{Op: OpRRQ, Filename: "other", Mode: "octet"}).Serialize()
+
+	//the whole transfer is served from the listen port
+	c := listen("10.0.0.1")
+	c.WriteTo(rrq, server)
+	p, from := next(c)
+	assert.Equal(t, &PacketData{BlockNum: 1, Data: data[:512]}, p)
+	assert.Equal(t, server.String(), from.String())
+	c.WriteTo(rrq, server)
+	p, _ = next(c)
+	assert.Nil(t, p, "resent request started another transfer")
+	c.WriteTo(other, server)
+	p, _ = next(c)
+	assert.Equal(t, &PacketError{Code: 0, Msg: errClientBusy.Error()}, p)
+	c.WriteTo((&PacketAck{BlockNum: 1}).Serialize(), server)
+	p, from = next(c)
+	assert.Equal(t, &PacketData{BlockNum: 2, Data: data[512:]}, p)
+	assert.Equal(t, server.String(), from.String())
+	c.WriteTo((&PacketAck{BlockNum: 2}).Serialize(), server)
+	p, _ = next(c)
+	assert.Equal(t, &PacketData{BlockNum: 3, Data: []byte{}}, p)
+	for len(h.Transfers.List()) > 0 {
+		time.Sleep(time.Millisecond)
+	}
+	//a resent final ack is ignored, a new request from the same port is served
+	c.WriteTo((&PacketAck{BlockNum: 2}).Serialize(), server)
+	p, _ = next(c)
+	assert.Nil(t, p)
+	c.WriteTo(rrq, server)
+	p, _ = next(c)
+	assert.Equal(t, &PacketData{BlockNum: 1, Data: data[:512]}, p)
+	c.WriteTo((&PacketError{Code: 0, Msg: "done"}).Serialize(), server)
+	for len(h.Transfers.List()) > 0 {
+		time.Sleep(time.Millisecond)
+	}
+	c.WriteTo(other, server)
+	p, _ = next(c)
+	assert.Equal(t, &PacketData{BlockNum: 1, Data: []byte("other")}, p)
+
+	//clients that need a TID get one
+	tid := listen("10.0.0.2")
+	tid.WriteTo(rrq, server)
+	p, from = next(tid)
+	assert.Equal(t, &PacketData{BlockNum: 1, Data: data[:512]}, p)
+	assert.NotEqual(t, server.String(), from.String())
+}
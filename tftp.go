@@ -2,29 +2,20 @@ package tftp
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"math/rand"
-	"os"
+	"net"
 	"strconv"
 	"sync"
 	"time"
 
+	"github.com/lienmeat/tftp/clock"
 	"github.com/lienmeat/tftp/udpserver"
-	log "github.com/sirupsen/logrus"
 )
 
-var RequestLog = log.New()
-
-func SetupRequestLog(filename string) (*os.File, error) {
-	RequestLog.SetLevel(log.InfoLevel)
-	rl, err := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0775)
-	if err == nil {
-		RequestLog.SetOutput(rl)
-	} else {
-		return rl, fmt.Errorf("err opening %s file: %s", filename, err.Error())
-	}
-	return rl, nil
-}
+//retransmitTimeout is how long to wait for a response before resending, unless a timeout option was negotiated
+const retransmitTimeout = time.Second * 3
 
 //Transfer keeps track of the data associated with a file in transfer
 type Transfer struct {
@@ -38,6 +29,16 @@ type Transfer struct {
 	Done bool
 	//error on transfer?
 	Error bool
+	//negotiated block size, 0 if BlockSize is used
+	BlkSize uint
+	//negotiated retransmit timeout, 0 if the default is used
+	Timeout time.Duration
+	//options agreed to for this transfer, sent to the client in an OACK
+	Options map[string]string
+	//most bytes that may be written, 0 if there's no limit
+	MaxSize int64
+	//id in the TransferRegistry, for events
+	id uint64
 }
 
 func (t Transfer) OpString() string {
@@ -47,126 +48,697 @@ func (t Transfer) OpString() string {
 	return "get"
 }
 
+//bytesMoved is how much of the file has been sent or received so far
+func (t Transfer) bytesMoved() int64 {
+	size := int64(len(t.File.Data))
+	if t.Op != OpRRQ {
+		return size
+	}
+	if t.Block == 0 {
+		return 0
+	}
+	//every block before the next one to send has been sent
+	sent := int64(t.Block-1) * int64(t.blockSize())
+	if sent > size {
+		return size
+	}
+	return sent
+}
+
+func (t Transfer) blockSize() uint {
+	if t.BlkSize == 0 {
+		return BlockSize
+	}
+	return t.BlkSize
+}
+
+func (t Transfer) timeout() time.Duration {
+	if t.Timeout == 0 {
+		return retransmitTimeout
+	}
+	return t.Timeout
+}
+
 //TFTProtocolHandler handles UDPPackets to implement the TFTP business logic
 type TFTPProtocolHandler struct {
-	Files          *FileRepo
-	TIDs           *TIDRepo
-	writeTransfers *WriteTransferRepo
+	//Files served by the default VirtualServer
+	Files *FileRepo
+	TIDs  *TIDRepo
+	//ACL applies to requests to every VirtualServer, nil allows everyone
+	ACL *ACL
+	//Metrics counts requests, transfers and traffic
+	Metrics *Metrics
+	//Transfers lists the transfers running on every VirtualServer
+	Transfers *TransferRegistry
+	servers   map[string]*VirtualServer
+	limiter   *limiter
+	guard     *guard
+	//set by Drain
+	draining int32
+	//requestLog records requests and transfers, logger gets debug logs.  Both log nothing by default.
+	requestLog Logger
+	logger     Logger
+	//events go to subscribers, with progress events at most once per progressInterval per transfer
+	events           *eventHub
+	progressInterval time.Duration
+	//listenPacket opens transfer connections, clock times their retransmits
+	listenPacket func(address string) (net.PacketConn, error)
+	clock        clock.Clock
+	//in single port mode transfers are served from their listener, except to tidClients.  sessions tracks
+	//the transfers requests started, routing packets to those served from their listener.
+	singlePort bool
+	tidClients []*net.IPNet
+	sessions   *sessions
+	//ephemeralPorts lets the kernel pick transfer ports when no TID can be used
+	ephemeralPorts bool
+	sync.RWMutex
 }
 
-func NewTFTPProtocolHandler(minPort int32, maxPort int32) *TFTPProtocolHandler {
-	return &TFTPProtocolHandler{
-		TIDs:           NewTIDRepo(minPort, maxPort),
-		Files:          NewFileRepo(),
-		writeTransfers: NewWriteTransferRepo(),
+//Option configures optional behaviour of a TFTPProtocolHandler
+type Option func(h *TFTPProtocolHandler)
+
+//WithLimits caps how many transfers clients can run and how fast they can make requests
+func WithLimits(limits Limits) Option {
+	return func(h *TFTPProtocolHandler) {
+		h.limiter = newLimiter(limits)
 	}
 }
 
-func (h *TFTPProtocolHandler) HandlePackets(ctx context.Context, incoming chan *udpserver.UDPPacket, responses chan *udpserver.UDPPacket) {
-	for {
-		select {
-		case <-ctx.Done():
+//WithProtection guards against the server being used for reflection attacks, and blocks abusive clients
+func WithProtection(protection Protection) Option {
+	return func(h *TFTPProtocolHandler) {
+		h.guard = newGuard(protection)
+	}
+}
+
+//WithRequestLogger sends the request log, a record of every request and transfer, to logger
+func WithRequestLogger(logger Logger) Option {
+	return func(h *TFTPProtocolHandler) {
+		h.requestLog = logger
+	}
+}
+
+//WithLogger sends debug logs, which aren't about any one request, to logger
+func WithLogger(logger Logger) Option {
+	return func(h *TFTPProtocolHandler) {
+		h.logger = logger
+	}
+}
+
+//WithListenPacket opens transfer connections with listenPacket instead of on real udp sockets, so transfers
+//can run over a simulated network.  Use the same function for the listeners, with udpserver.WithListenPacket.
+func WithListenPacket(listenPacket func(address string) (net.PacketConn, error)) Option {
+	return func(h *TFTPProtocolHandler) {
+		h.listenPacket = listenPacket
+	}
+}
+
+//WithEphemeralPorts serves transfers from a port picked by the kernel when every TID between minPort and
+//maxPort is in use or can't be bound, instead of refusing them
+func WithEphemeralPorts() Option {
+	return func(h *TFTPProtocolHandler) {
+		h.ephemeralPorts = true
+	}
+}
+
+//WithClock makes the handler tell the time with c instead of the system clock: for retransmits, rate
+//limits, transfer timings, events and logs, and seeding the choice of transfer ports
+func WithClock(c clock.Clock) Option {
+	return func(h *TFTPProtocolHandler) {
+		h.clock = c
+	}
+}
+
+func NewTFTPProtocolHandler(minPort int32, maxPort int32, options ...Option) *TFTPProtocolHandler {
+	tids := NewTIDRepo(minPort, maxPort)
+	h := &TFTPProtocolHandler{
+		TIDs:             tids,
+		Metrics:          newMetrics(tids),
+		Transfers:        NewTransferRegistry(),
+		servers:          map[string]*VirtualServer{},
+		limiter:          newLimiter(Limits{}),
+		guard:            newGuard(Protection{}),
+		requestLog:       nopLogger{},
+		logger:           nopLogger{},
+		events:           newEventHub(),
+		progressInterval: defaultProgressInterval,
+		listenPacket:     listenUDP,
+		clock:            clock.Real,
+	}
+	for _, o := range options {
+		o(h)
+	}
+	//limits and protection may have been set up before the clock was
+	h.limiter.useClock(h.clock)
+	h.guard.lastPrune = h.clock.Now()
+	h.events.clock = h.clock
+	h.Transfers.clock = h.clock
+	h.TIDs.Seed(h.clock.Now().UnixNano())
+	h.sessions = newSessions(h.clock, func(op uint16) {
+		h.Metrics.duplicates.add(1, Transfer{Op: op}.OpString())
+	})
+	def, _ := h.NewVirtualServer(DefaultVirtualServer)
+	h.Files = def.Files
+	return h
+}
+
+//startTransfer starts a worker for a request received on one of server's listeners, if limits allow it.
+//Refused requests are answered on the listener's responses channel.
+func (h *TFTPProtocolHandler) startTransfer(ctx context.Context, server *VirtualServer, packet *udpserver.UDPPacket, responses chan<- *udpserver.UDPPacket) {
+	client := packet.Address().IP.String()
+	now := h.clock.Now()
+	if h.guard.isBlocked(client, now) {
+		return
+	}
+	if h.Draining() {
+		h.refuse(server, packet, responses, errDraining)
+		return
+	}
+	if !h.guard.checkCookie(packet.Address(), packet.Data(), now) {
+		h.logger.Debug("first request dropped, waiting for a retransmit", Fields{
+			"server":  server.Name,
+			"address": packet.Address(),
+		})
+		return
+	}
+	//sessions are opened right away, so packets that arrive while the transfer is queued or starting
+	//aren't taken for new transfers
+	session := h.sessions.open(packet, h.servesOnListener(packet))
+	if session == nil {
+		return
+	}
+	queued, err := h.limiter.acquire(client)
+	if err != nil {
+		h.sessions.close(session)
+		h.refuse(server, packet, responses, err)
+		return
+	}
+	go func() {
+		defer h.sessions.close(session)
+		if queued {
+			if err := h.limiter.wait(ctx, client); err != nil {
+				h.refuse(server, packet, responses, err)
+				return
+			}
+		}
+		defer h.limiter.release(client)
+		if session.in != nil {
+			h.serveOnListener(ctx, server, packet, session.in, responses)
 			return
-		case p := <-incoming:
-			go h.newWorker(ctx, p)
 		}
+		h.newWorker(ctx, server, packet, responses)
+	}()
+}
+
+//refuse logs a request refused because of limits or draining, and tells the client unless refusals are dropped
+func (h *TFTPProtocolHandler) refuse(server *VirtualServer, packet *udpserver.UDPPacket, responses chan<- *udpserver.UDPPacket, err error) {
+	h.requestLog.Warn("request refused", Fields{
+		"server":  server.Name,
+		"address": packet.Address(),
+		"reason":  err.Error(),
+		"dropped": h.limiter.limits.Drop,
+	})
+	if h.limiter.limits.Drop {
+		return
+	}
+	resp := &PacketError{Code: 0, Msg: err.Error()}
+	select {
+	case responses <- udpserver.NewUDPPacket(packet.Address(), resp.Serialize()):
+	default:
+		//don't hold up the listener if the responder is backed up
 	}
 }
 
-func (h *TFTPProtocolHandler) newWorker(ctx context.Context, packet *udpserver.UDPPacket) {
-	iTid := h.TIDs.New()
-	addr := "0.0.0.0:" + strconv.Itoa(int(iTid))
-	connection, err := udpserver.Connect(addr)
-	if err != nil {
-		log.WithFields(log.Fields{
-			"addr": addr,
-		}).Error("could not connect")
+//HandlePackets serves requests from the default VirtualServer
+func (h *TFTPProtocolHandler) HandlePackets(ctx context.Context, incoming chan *udpserver.UDPPacket, responses chan *udpserver.UDPPacket) {
+	def, _ := h.VirtualServer(DefaultVirtualServer)
+	def.HandlePackets(ctx, incoming, responses)
+}
+
+//newWorker runs a transfer on a port of its own, a TID if one is free and can be bound.  Requests that can't
+//get a port are refused on responses.
+func (h *TFTPProtocolHandler) newWorker(ctx context.Context, server *VirtualServer, packet *udpserver.UDPPacket, responses chan<- *udpserver.UDPPacket) {
+	connection, tid := h.listenTransfer(packet.LocalAddress())
+	if connection == nil {
+		h.refuse(server, packet, responses, errNoTIDs)
+		return
 	}
 	defer func() {
 		connection.Close()
-		h.TIDs.Del(iTid)
+		h.TIDs.Del(tid)
 	}()
 
-	in := udpserver.DispatchListeners(ctx, connection, 2)
-	out := udpserver.DispatchResponseWriters(ctx, connection, 1)
+	in := udpserver.DispatchListeners(ctx, connection, 2, udpserver.WithLogger(h.logger))
+	out := make(chan *udpserver.UDPPacket, 1)
+	written := make(chan struct{})
+	go func() {
+		//write responses until the transfer is over, so the final response isn't lost when the connection closes
+		for p := range out {
+			connection.WriteTo(p.Data(), p.Address())
+		}
+		close(written)
+	}()
 	in <- packet
-	h.transferWorker(ctx, in, out)
+	h.transferWorker(ctx, server, in, out)
+	close(out)
+	<-written
+}
+
+//listenTransfer opens a connection for a transfer on the listener at local, and returns it with the TID it
+//uses.  A TID another process has bound is skipped, up to maxBindAttempts of them.  Without a TID that
+//can be bound, the kernel picks the port if WithEphemeralPorts allows it, returning a TID of -1, or there's
+//no connection.
+func (h *TFTPProtocolHandler) listenTransfer(local *net.UDPAddr) (net.PacketConn, int32) {
+	var unbindable []int32
+	defer func() {
+		for _, tid := range unbindable {
+			h.TIDs.Del(tid)
+		}
+	}()
+	for i := 0; i < maxBindAttempts; i++ {
+		tid := h.TIDs.New()
+		if tid < 0 {
+			break
+		}
+		addr := transferAddress(local, tid)
+		connection, err := h.listenPacket(addr)
+		if err == nil {
+			return connection, tid
+		}
+		h.logger.Error("could not connect", Fields{
+			"addr":  addr,
+			"error": err.Error(),
+		})
+		//held on to until we're done, so it isn't picked again
+		unbindable = append(unbindable, tid)
+	}
+	if !h.ephemeralPorts {
+		return nil, -1
+	}
+	addr := transferAddress(local, 0)
+	connection, err := h.listenPacket(addr)
+	if err != nil {
+		h.logger.Error("could not connect", Fields{
+			"addr":  addr,
+			"error": err.Error(),
+		})
+		return nil, -1
+	}
+	return connection, -1
+}
+
+func listenUDP(address string) (net.PacketConn, error) {
+	connection, err := udpserver.Connect(address)
+	if err != nil {
+		return nil, err
+	}
+	return connection, nil
+}
+
+//transferAddress is the address to bind a transfer's socket to.  Replies have to come from the same IP
+//the request was sent to, so this uses the IP (and so the address family) of the listener the request
+//arrived on.  Listeners bound to a wildcard address get a wildcard of the same family.
+func transferAddress(local *net.UDPAddr, tid int32) string {
+	if local == nil {
+		return ":" + strconv.Itoa(int(tid))
+	}
+	return (&net.UDPAddr{IP: local.IP, Port: int(tid), Zone: local.Zone}).String()
 }
 
 //transferWorker runs until it has handled one complete transfer, receiving UDPPackets for it's TID/port
 //via a channel and sending response packets out on another
-func (h *TFTPProtocolHandler) transferWorker(ctx context.Context, in <-chan *udpserver.UDPPacket, out chan<- *udpserver.UDPPacket) {
+func (h *TFTPProtocolHandler) transferWorker(ctx context.Context, server *VirtualServer, in <-chan *udpserver.UDPPacket, out chan<- *udpserver.UDPPacket) {
 
 	transfer := Transfer{
 		File: NewFile(""),
 	}
+	//cancelled through the TransferRegistry, or when ctx is done
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var id uint64
+	//the client, and whether it has shown it can receive our packets by acking or sending data
+	var peer *net.UDPAddr
+	var client string
+	var verified bool
+	//served from the listener the request arrived on, whose port any spoofer knows
+	var onListener bool
+	var inFlight int64
+	//metrics: the transfer's op label once a request arrived, when, and the code it failed with
+	var op string
+	var started time.Time
+	var ended bool
+	failCode := failedNoError
+	//request log: what was asked for, how it ended and how often we had to resend
+	var filename, outcome string
+	var retransmits int
+	//event is an event for the transfer, filled in with what it knows so far
+	event := func(t EventType) Event {
+		return Event{
+			Type:       t,
+			TransferID: id,
+			Server:     server.Name,
+			Peer:       peer.String(),
+			Op:         op,
+			Filename:   filename,
+			Block:      transfer.Block,
+			Bytes:      transfer.bytesMoved(),
+			Size:       int64(len(transfer.File.Data)),
+		}
+	}
+	//events: whether the request was accepted, and when progress was last sent
+	var transferStarted bool
+	var lastProgress time.Time
+	defer func() {
+		if id != 0 {
+			h.Transfers.remove(id)
+		}
+		if op != "" {
+			if outcome == "" {
+				outcome = "failed"
+			}
+			e := event(EventFailed)
+			e.Duration = h.clock.Since(started)
+			if outcome == "complete" {
+				e.Type = EventCompleted
+			} else {
+				e.Outcome = outcome
+				code, _ := strconv.Atoi(failCode)
+				e.Code = uint16(code)
+			}
+			h.events.emit(e)
+			h.requestLog.Info("transfer "+outcome, Fields{
+				"server":      server.Name,
+				"address":     peer.String(),
+				"filename":    filename,
+				"op":          op,
+				"size":        len(transfer.File.Data),
+				"started":     started.Format(time.RFC3339Nano),
+				"duration":    h.clock.Since(started).Seconds(),
+				"bytes":       transfer.bytesMoved(),
+				"blksize":     transfer.blockSize(),
+				"retransmits": retransmits,
+				"outcome":     outcome,
+				"code":        failCode,
+			})
+		}
+		if op != "" {
+			h.Metrics.active.add(-1, op)
+			if !ended {
+				h.Metrics.failed.add(1, op, failCode)
+			}
+		}
+		//let the next write to this file go ahead, whether this one worked or not
+		if transfer.Op == OpWRQ {
+			server.writeTransfers.Del(transfer.File.Filename)
+		}
+		if !verified {
+			h.guard.release(client, inFlight)
+		}
+	}()
+	//send sends a response, unless it would put too many bytes in flight to an unverified client
+	send := func(p *udpserver.UDPPacket) bool {
+		if !verified {
+			if !h.guard.send(client, int64(len(p.Data()))) {
+				h.requestLog.Warn("transfer abandoned, too many bytes in flight to an unverified client", Fields{
+					"server":   server.Name,
+					"address":  p.Address(),
+					"filename": transfer.File.Filename,
+					"op":       transfer.OpString(),
+				})
+				outcome = "abandoned"
+				return false
+			}
+			inFlight += int64(len(p.Data()))
+		}
+		if op != "" {
+			h.Metrics.bytesSent.add(float64(len(p.Data())), op)
+		}
+		out <- p
+		return true
+	}
 
-	var retries = 5
+	limits := h.limiter.limits
+	//retries counts resends of the last response, active is when the transfer last moved a block
+	var retries int
+	var active time.Time
 	var lastResponse *udpserver.UDPPacket
-	for retries > 0 {
+	//the retransmit timeout adapts to the round trip times measured from when a response was sent until it
+	//was answered, unless it had to be resent
+	var rtt rttEstimator
+	var sentAt time.Time
+	var resent bool
+	timer := h.clock.NewTimer(rtt.timeout(transfer.timeout()))
+	defer timer.Stop()
+	//restart waits the whole timeout again after a response, dropping a timeout that fired while handling
+	//the packet.  Packets that get no response, like a client resending something we already answered,
+	//don't restart it, or a client with a shorter timeout would keep us from ever resending what it missed.
+	restart := func() {
+		if !timer.Stop() {
+			select {
+			case <-timer.C():
+			default:
+			}
+		}
+		timer.Reset(rtt.timeout(transfer.timeout()))
+	}
+	//abort ends the transfer for breaking a limit, telling the client why
+	abort := func(reason error) {
+		h.requestLog.Warn("transfer aborted", Fields{
+			"server":   server.Name,
+			"address":  peer,
+			"filename": filename,
+			"op":       op,
+			"reason":   reason.Error(),
+		})
+		send(udpserver.NewUDPPacket(peer, (&PacketError{Code: 0, Msg: reason.Error()}).Serialize()))
+	}
+	for {
+		//limits are checked whenever a packet arrives or a timeout fires
+		if !started.IsZero() {
+			if err := limits.checkTransfer(started, active, h.clock.Now(), transfer.bytesMoved()); err != nil {
+				failCode = "0"
+				outcome = "aborted"
+				abort(err)
+				return
+			}
+		}
 		select {
 		case <-ctx.Done():
+			outcome = "interrupted"
+			if id != 0 && h.Transfers.wasCancelled(id) {
+				resp := &PacketError{Code: 0, Msg: "transfer cancelled"}
+				failCode = strconv.Itoa(int(resp.Code))
+				send(udpserver.NewUDPPacket(peer, resp.Serialize()))
+				outcome = "cancelled"
+			}
 			return
 		case p := <-in:
-			retries = 5
+			if peer == nil {
+				peer = p.Address()
+				client = peer.IP.String()
+				onListener = h.servesOnListener(p)
+			}
 			parsed, err := ParsePacket(p.Data())
+			if _, ok := parsed.(*PacketRequest); err == nil && !ok && transfer.Op == 0 && transfer.Block == 0 {
+				err = errNotRequest
+			}
 			if err != nil {
-				RequestLog.WithFields(log.Fields{
+				if err != errNotRequest {
+					h.Metrics.unparseable.add(1)
+				}
+				h.requestLog.Error("unknown request", Fields{
 					"address": p.Address(),
 					"packet":  string(p.Data()),
-				}).Errorf("unknown request")
+					"reason":  err.Error(),
+				})
+				//a stray ack or data packet, like one resent to the listen port after its transfer ended,
+				//isn't abuse
+				if err != errNotRequest && h.guard.malformed(p.Address().IP.String(), h.clock.Now()) {
+					h.requestLog.Warn("client blocked for sending malformed packets", Fields{
+						"address": p.Address(),
+						"for":     h.guard.protection.BlockFor.String(),
+					})
+				}
 				return
 			}
-			resp := processPacket(h.Files, &transfer, h.writeTransfers, p, parsed)
+			if r, ok := parsed.(*PacketRequest); ok && op == "" {
+				op = Transfer{Op: r.Op}.OpString()
+				filename = r.Filename
+				started = h.clock.Now()
+				h.Metrics.active.add(1, op)
+				id = h.Transfers.add(server.Name, peer, r, cancel)
+				transfer.id = id
+			}
+			if op != "" {
+				h.Metrics.bytesReceived.add(float64(len(p.Data())), op)
+			}
+			if e, ok := parsed.(*PacketError); ok {
+				failCode = strconv.Itoa(int(e.Code))
+			}
+			resp := processPacket(server, &transfer, p, parsed)
+			if id != 0 {
+				h.Transfers.update(id, &transfer)
+			}
+			if !verified && resp != nil {
+				switch parsed.(type) {
+				case *PacketAck, *PacketData:
+					//only the real client can know our transfer port, so it has received what we sent.  The
+					//listen port is no secret, so there it only counts for a client that had to retransmit
+					//its request.
+					if !onListener || h.guard.checksRequests(peer.IP) {
+						h.guard.verify(client, inFlight, h.clock.Now())
+						verified = true
+					}
+				}
+			}
+			if transfer.Done && !transfer.Error && transfer.Op == OpWRQ {
+				//store before the final ack goes out, so the client isn't told an upload over quota succeeded
+				if !server.store(transfer.File) {
+					transfer.File.Data = nil
+					transfer.Error = true
+					resp = errAllocationExceeded
+				} else {
+					h.events.emit(event(EventWriteCommitted))
+				}
+			}
+			if e, ok := resp.(*PacketError); ok {
+				failCode = strconv.Itoa(int(e.Code))
+			}
+			switch parsed.(type) {
+			case *PacketRequest:
+				if _, refused := resp.(*PacketError); !transferStarted && !refused && !transfer.Error {
+					transferStarted = true
+					lastProgress = h.clock.Now()
+					if len(transfer.Options) > 0 {
+						e := event(EventOptionsNegotiated)
+						e.Options = transfer.Options
+						h.events.emit(e)
+					}
+					h.events.emit(event(EventStarted))
+				}
+			case *PacketAck, *PacketData:
+				if transferStarted && !transfer.Done && h.clock.Since(lastProgress) >= h.progressInterval {
+					lastProgress = h.clock.Now()
+					h.events.emit(event(EventProgress))
+				}
+			}
 			if resp != nil {
+				now := h.clock.Now()
+				if lastResponse != nil && !resent {
+					rtt.sample(now.Sub(sentAt))
+				}
 				lastResponse = udpserver.NewUDPPacket(p.Address(), resp.Serialize())
-				out <- lastResponse
+				sentAt = now
+				resent = false
+				retries = 0
+				active = now
+				restart()
+				if !send(lastResponse) {
+					return
+				}
 			}
-			if transfer.Done && !transfer.Error {
-				if transfer.Op == OpWRQ {
-					h.Files.Set(transfer.File)
+			if transfer.Done {
+				ended = true
+				if transfer.Error {
+					h.Metrics.failed.add(1, op, failCode)
+					outcome = "failed"
+				} else {
+					h.Metrics.completed.add(1, op)
+					h.Metrics.duration.observe(h.clock.Since(started).Seconds(), op)
+					outcome = "complete"
 				}
-				RequestLog.WithFields(log.Fields{
-					"address":  p.Address(),
-					"filename": transfer.File.Filename,
-					"size":     len(transfer.File.Data),
-					"op":       transfer.OpString(),
-				}).Info("transfer complete")
 				return
 			}
-		case <-time.After(time.Second * 3):
-			//replay the last sent packet if we haven't gotten a response after 3 seconds
-			if len(lastResponse.Data()) > 0 {
-				out <- lastResponse
-				retries--
+		case <-timer.C():
+			//replay the last sent packet if we haven't gotten a response in time
+			if lastResponse != nil && len(lastResponse.Data()) > 0 {
+				if retries >= limits.maxBlockRetries() {
+					h.Metrics.timeouts.add(1, op)
+					failCode = "0"
+					outcome = "timeout"
+					abort(errTooManyRetries)
+					return
+				}
+				if !send(lastResponse) {
+					return
+				}
+				h.Metrics.retransmits.add(1, op)
+				h.Transfers.retransmitted(id)
+				retransmits++
+				retries++
+				resent = true
+				rtt.backoff()
 			}
+			timer.Reset(rtt.timeout(transfer.timeout()))
 		}
 	}
-	if retries == 0 {
-		return
-	}
 }
 
+//errNotRequest is why a transfer that doesn't start with a RRQ or WRQ is dropped
+var errNotRequest = errors.New("transfer must start with a request")
+
 //processPacket returns the correct response if any for a given packet, and modifies
 //the transfer state
-func processPacket(files *FileRepo, transfer *Transfer, writeTransfers *WriteTransferRepo, raw *udpserver.UDPPacket, p Packet) (response Packet) {
+func processPacket(server *VirtualServer, transfer *Transfer, raw *udpserver.UDPPacket, p Packet) (response Packet) {
 	switch p.(type) {
 	case *PacketRequest:
 		r := p.(*PacketRequest)
+		server.handler.Metrics.requests.add(1, server.Name, Transfer{Op: r.Op}.OpString())
+		server.handler.events.emit(Event{
+			Type:       EventRequest,
+			TransferID: transfer.id,
+			Server:     server.Name,
+			Peer:       raw.Address().String(),
+			Op:         Transfer{Op: r.Op}.OpString(),
+			Filename:   r.Filename,
+			Options:    r.Options,
+		})
+		if ok, response := checkACLs(server, transfer, raw, r); !ok {
+			return response
+		}
+		if transfer.Op == 0 && transfer.Block == 0 {
+			negotiateOptions(server.Options, transfer, r)
+		}
 		if r.Op == OpRRQ {
-			RequestLog.WithFields(log.Fields{
+			server.handler.requestLog.Info(fmt.Sprintf("get %s transfer requested", r.Filename), Fields{
+				"server":   server.Name,
 				"filename": r.Filename,
 				"address":  raw.Address(),
 				"op":       "get",
-			}).Infof("get %s transfer requested", r.Filename)
-			return processOpRRQ(files, transfer, r)
+			})
+			return processOpRRQ(server.Files, transfer, r)
 		}
-		RequestLog.WithFields(log.Fields{
+		server.handler.requestLog.Info(fmt.Sprintf("put %s transfer requested", r.Filename), Fields{
+			"server":   server.Name,
 			"filename": r.Filename,
 			"address":  raw.Address(),
 			"op":       "put",
-		}).Infof("put %s transfer requested", r.Filename)
-		return processOpWRQ(transfer, writeTransfers, r)
+		})
+		if server.ReadOnly {
+			server.handler.requestLog.Warn(fmt.Sprintf("put %s denied, server is read-only", r.Filename), Fields{
+				"server":   server.Name,
+				"filename": r.Filename,
+				"address":  raw.Address(),
+				"op":       "put",
+			})
+			transfer.Done = true
+			transfer.Error = true
+			return &PacketError{
+				Code: 2,
+				Msg:  "access violation",
+			}
+		}
+		if ok, response := checkUploadAllowance(server, transfer, raw.Address().IP.String(), r); !ok {
+			server.handler.requestLog.Warn(fmt.Sprintf("put %s denied, over size limit or quota", r.Filename), Fields{
+				"server":   server.Name,
+				"filename": r.Filename,
+				"address":  raw.Address(),
+				"op":       "put",
+			})
+			return response
+		}
+		transfer.File.Owner = raw.Address().IP.String()
+		return processOpWRQ(transfer, server.writeTransfers, r)
 	case *PacketAck:
 		return processOpAck(transfer, p.(*PacketAck))
 	case *PacketData:
@@ -179,6 +751,35 @@ func processPacket(files *FileRepo, transfer *Transfer, writeTransfers *WriteTra
 	return nil
 }
 
+//checkACLs checks the request against the handler's and server's ACLs.  Denied requests end the transfer,
+//and get an access violation response unless the denying ACL drops them.
+func checkACLs(server *VirtualServer, transfer *Transfer, raw *udpserver.UDPPacket, r *PacketRequest) (ok bool, response Packet) {
+	for _, acl := range []*ACL{server.handler.ACL, server.ACL} {
+		allowed, reason := acl.Allowed(raw.Address().IP, r.Op, r.Filename)
+		if allowed {
+			continue
+		}
+		server.handler.requestLog.Warn(fmt.Sprintf("%s %s denied", Transfer{Op: r.Op}.OpString(), r.Filename), Fields{
+			"server":   server.Name,
+			"filename": r.Filename,
+			"address":  raw.Address(),
+			"op":       Transfer{Op: r.Op}.OpString(),
+			"reason":   reason,
+			"dropped":  acl.Drop,
+		})
+		transfer.Done = true
+		transfer.Error = true
+		if acl.Drop {
+			return false, nil
+		}
+		return false, &PacketError{
+			Code: 2,
+			Msg:  "access violation",
+		}
+	}
+	return true, nil
+}
+
 func processOpRRQ(files *FileRepo, transfer *Transfer, r *PacketRequest) (response Packet) {
 	if transfer.Block != 0 || transfer.Op != 0 {
 		return
@@ -193,7 +794,7 @@ func processOpRRQ(files *FileRepo, transfer *Transfer, r *PacketRequest) (respon
 		transfer.Done = true
 		transfer.Error = true
 	} else {
-		d, ok := file.ReadBlock(1)
+		d, ok := file.ReadSizedBlock(1, transfer.blockSize())
 		if !ok {
 			response = &PacketError{
 				Code: 0,
@@ -201,6 +802,15 @@ func processOpRRQ(files *FileRepo, transfer *Transfer, r *PacketRequest) (respon
 			}
 			transfer.Done = true
 			transfer.Error = true
+		} else if transfer.Options != nil {
+			//options were negotiated, the client acks the OACK with block 0 before we send block 1
+			if _, ok := transfer.Options["tsize"]; ok {
+				transfer.Options["tsize"] = strconv.Itoa(len(file.Data))
+			}
+			transfer.Op = r.Op
+			transfer.File = file
+			transfer.Block = 1
+			response = &PacketOAck{Options: transfer.Options}
 		} else {
 			transfer.Op = r.Op
 			transfer.File = file
@@ -209,7 +819,7 @@ func processOpRRQ(files *FileRepo, transfer *Transfer, r *PacketRequest) (respon
 				BlockNum: 1,
 				Data:     d,
 			}
-			if len(d) < int(BlockSize) {
+			if len(d) < int(transfer.blockSize()) {
 				transfer.Done = true
 			}
 		}
@@ -223,7 +833,11 @@ func processOpWRQ(transfer *Transfer, writeTransfers *WriteTransferRepo, r *Pack
 			transfer.Op = r.Op
 			transfer.File.Filename = r.Filename
 			transfer.Block = 1
-			response = &PacketAck{BlockNum: 0}
+			if transfer.Options != nil {
+				response = &PacketOAck{Options: transfer.Options}
+			} else {
+				response = &PacketAck{BlockNum: 0}
+			}
 		}
 	} else {
 		response = &PacketError{
@@ -240,7 +854,7 @@ func processOpAck(transfer *Transfer, r *PacketAck) (response Packet) {
 	if block-1 != r.BlockNum {
 		return
 	}
-	if d, ok := transfer.File.ReadBlock(transfer.Block); ok {
+	if d, ok := transfer.File.ReadSizedBlock(transfer.Block, transfer.blockSize()); ok {
 		//even if this block is short, clients still send a final ack
 		//so we need to not complete until we receive that next ack
 		transfer.Block++
@@ -249,7 +863,7 @@ func processOpAck(transfer *Transfer, r *PacketAck) (response Packet) {
 			Data:     d,
 		}
 	} else {
-		//catch-all for last-block ack, or if the last block was exactly 512 bytes
+		//catch-all for last-block ack, or if the last block was exactly the block size
 		//block is past the end of the file in either case, return an empty block to stop the transfer
 		transfer.Done = true
 		response = &PacketData{
@@ -266,8 +880,15 @@ func processOpData(transfer *Transfer, r *PacketData) (response Packet) {
 	if block != r.BlockNum {
 		return
 	}
-	if _, err := transfer.File.WriteBlock(transfer.Block, r.Data); err == nil {
-		if len(r.Data) < int(BlockSize) {
+	if _, err := transfer.File.WriteSizedBlock(transfer.Block, transfer.blockSize(), r.Data); err == nil {
+		if transfer.MaxSize > 0 && int64(len(transfer.File.Data)) > transfer.MaxSize {
+			//abort, and discard what was written so far
+			transfer.File.Data = nil
+			transfer.Done = true
+			transfer.Error = true
+			return errAllocationExceeded
+		}
+		if len(r.Data) < int(transfer.blockSize()) {
 			transfer.Done = true
 		} else {
 			transfer.Block++
@@ -277,40 +898,92 @@ func processOpData(transfer *Transfer, r *PacketData) (response Packet) {
 	return
 }
 
+const (
+	//tidRandomPicks is how many TIDs New picks at random before scanning for a free one
+	tidRandomPicks = 16
+	//maxBindAttempts is how many TIDs a transfer tries to bind before giving up on them
+	maxBindAttempts = 3
+)
+
 //TIDRepo is a concurrent-safe storage of TIDs that transfer workers are using to get packets routed to them via
 type TIDRepo struct {
 	min  int32
 	size int32
 	tt   []bool
+	used int32
+	rnd  *rand.Rand
 	sync.RWMutex
 }
 
 func NewTIDRepo(min, max int32) *TIDRepo {
+	if max < min {
+		max = min
+	}
 	return &TIDRepo{
 		min:  min,
 		size: max - min,
 		tt:   make([]bool, max-min),
+		rnd:  rand.New(rand.NewSource(time.Now().UnixNano())),
 	}
 }
 
+//Seed makes the TIDs picked from now on follow from seed, the same seed picks the same TIDs
+func (r *TIDRepo) Seed(seed int64) {
+	r.Lock()
+	defer r.Unlock()
+	r.rnd.Seed(seed)
+}
+
+//New reserves a free TID, or returns -1 if they're all in use.  A few are picked at random, so transfer ports
+//are hard to guess, then the rest are scanned in order from a random one.
 func (r *TIDRepo) New() int32 {
-	rand.Seed(time.Now().UnixNano())
 	r.Lock()
 	defer r.Unlock()
-	for i := 0; i < 100; i++ {
-		n := rand.Int31n(r.size)
+	if r.used >= r.size {
+		return -1
+	}
+	for i := 0; i < tidRandomPicks; i++ {
+		n := r.rnd.Int31n(r.size)
+		if !r.tt[n] {
+			return r.take(n)
+		}
+	}
+	start := r.rnd.Int31n(r.size)
+	for i := int32(0); i < r.size; i++ {
+		n := (start + i) % r.size
 		if !r.tt[n] {
-			r.tt[n] = true
-			return r.min + n
+			return r.take(n)
 		}
 	}
 	return -1
 }
 
+//take reserves the nth TID, must hold the lock
+func (r *TIDRepo) take(n int32) int32 {
+	r.tt[n] = true
+	r.used++
+	return r.min + n
+}
+
+//Del frees a TID, ignoring ones New didn't hand out
 func (r *TIDRepo) Del(tid int32) {
 	r.Lock()
 	defer r.Unlock()
-	r.tt[int(tid-r.min)] = false
+	n := tid - r.min
+	if n < 0 || n >= r.size {
+		return
+	}
+	if r.tt[n] {
+		r.used--
+	}
+	r.tt[n] = false
+}
+
+//Usage says how many TIDs are in use, out of how many
+func (r *TIDRepo) Usage() (used int32, size int32) {
+	r.RLock()
+	defer r.RUnlock()
+	return r.used, r.size
 }
 
 //WriteTransferRepo stores if a file is currently being written to via a transfer
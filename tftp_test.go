@@ -3,9 +3,14 @@ package tftp
 import (
 	"bytes"
 	"math"
+	"net"
 	"reflect"
 	"testing"
+	"time"
 
+	"github.com/lienmeat/tftp/clock"
+	"github.com/lienmeat/tftp/memnet"
+	"github.com/lienmeat/tftp/udpserver"
 	log "github.com/sirupsen/logrus"
 	"github.com/stretchr/testify/assert"
 )
@@ -78,6 +83,16 @@ func TestProcessOpRRQ(t *testing.T) {
 			wantResponse: &PacketData{BlockNum: 1, Data: []byte{}},
 			wantTransfer: &Transfer{File: NewFile("test"), Block: 2, Op: OpRRQ, Done: true, Error: false},
 		},
+		{
+			name: "options negotiated",
+			args: args{
+				file:     File{Filename: "test", Data: bytes.Repeat([]byte("a"), 2000)},
+				transfer: &Transfer{File: NewFile(""), BlkSize: 1024, Options: map[string]string{"blksize": "1024", "tsize": "0"}},
+				packet:   &PacketRequest{Op: OpRRQ, Filename: "test", Mode: "octet", Options: map[string]string{"blksize": "1024", "tsize": "0"}},
+			},
+			wantResponse: &PacketOAck{Options: map[string]string{"blksize": "1024", "tsize": "2000"}},
+			wantTransfer: &Transfer{File: File{Filename: "test", Data: bytes.Repeat([]byte("a"), 2000)}, Block: 1, Op: OpRRQ, BlkSize: 1024, Options: map[string]string{"blksize": "1024", "tsize": "2000"}},
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -114,6 +129,15 @@ func Test_processOpWRQ(t *testing.T) {
 			wantResponse: &PacketAck{BlockNum: 0},
 			wantTransfer: &Transfer{File: NewFile("test"), Block: 1, Op: OpWRQ, Done: false, Error: false},
 		},
+		{
+			name: "options negotiated",
+			args: args{
+				transfer: &Transfer{File: NewFile(""), Options: map[string]string{"tsize": "1000"}},
+				packet:   &PacketRequest{Op: OpWRQ, Filename: "test", Mode: "octet", Options: map[string]string{"tsize": "1000"}},
+			},
+			wantResponse: &PacketOAck{Options: map[string]string{"tsize": "1000"}},
+			wantTransfer: &Transfer{File: NewFile("test"), Block: 1, Op: OpWRQ, Options: map[string]string{"tsize": "1000"}},
+		},
 		{
 			name: "transfer already started",
 			args: args{
@@ -127,7 +151,7 @@ func Test_processOpWRQ(t *testing.T) {
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 
-			response := processOpWRQ(tt.args.transfer, tt.args.packet)
+			response := processOpWRQ(tt.args.transfer, NewWriteTransferRepo(), tt.args.packet)
 
 			assert.Equal(t, tt.wantResponse, response)
 
@@ -352,3 +376,302 @@ func Test_processOpData(t *testing.T) {
 		})
 	}
 }
+
+func Test_transferAddress(t *testing.T) {
+	tests := []struct {
+		name  string
+		local *net.UDPAddr
+		want  string
+	}{
+		{
+			name:  "no listener",
+			local: nil,
+			want:  ":6000",
+		},
+		{
+			name:  "ipv4 wildcard",
+			local: &net.UDPAddr{IP: net.IPv4zero, Port: 69},
+			want:  "0.0.0.0:6000",
+		},
+		{
+			name:  "ipv6 wildcard",
+			local: &net.UDPAddr{IP: net.IPv6unspecified, Port: 69},
+			want:  "[::]:6000",
+		},
+		{
+			name:  "ipv4",
+			local: &net.UDPAddr{IP: net.ParseIP("10.1.2.3"), Port: 69},
+			want:  "10.1.2.3:6000",
+		},
+		{
+			name:  "ipv6 link local",
+			local: &net.UDPAddr{IP: net.ParseIP("fe80::1"), Port: 69, Zone: "eth0"},
+			want:  "[fe80::1%eth0]:6000",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, transferAddress(tt.local, 6000))
+		})
+	}
+}
+
+func Test_processPacket_readOnly(t *testing.T) {
+	h := NewTFTPProtocolHandler(6000, 6100)
+	v, _ := h.NewVirtualServer("ro")
+	v.ReadOnly = true
+
+	transfer := &Transfer{File: NewFile("")}
+	raw := udpserver.NewUDPPacket(&net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 1234}, nil)
+	response := processPacket(v, transfer, raw, &PacketRequest{Op: OpWRQ, Filename: "test", Mode: "octet"})
+
+	assert.Equal(t, &PacketError{Code: 2, Msg: "access violation"}, response)
+	assert.True(t, transfer.Done)
+	assert.True(t, transfer.Error)
+}
+
+func Test_processOpAck_blockSize(t *testing.T) {
+	data := bytes.Repeat([]byte("abcdefgh"), 300)
+	transfer := &Transfer{File: File{Filename: "test", Data: data}, Op: OpRRQ, Block: 1, BlkSize: 1024}
+
+	response := processOpAck(transfer, &PacketAck{BlockNum: 0})
+	assert.Equal(t, &PacketData{BlockNum: 1, Data: data[:1024]}, response)
+
+	response = processOpAck(transfer, &PacketAck{BlockNum: 1})
+	assert.Equal(t, &PacketData{BlockNum: 2, Data: data[1024:2048]}, response)
+
+	response = processOpAck(transfer, &PacketAck{BlockNum: 2})
+	assert.Equal(t, &PacketData{BlockNum: 3, Data: data[2048:]}, response)
+}
+
+func Test_processPacket_acl(t *testing.T) {
+	h := NewTFTPProtocolHandler(6000, 6100)
+	h.ACL = &ACL{AccessList: AccessList{Allow: mustParseNetworks("10.0.0.0/8")}}
+	v, _ := h.NewVirtualServer("pxe")
+	v.ACL = &ACL{Write: AccessList{Allow: mustParseNetworks("10.1.0.0/16")}, Drop: true}
+	v.Files.Set(File{Filename: "kernel", Data: []byte("kernel")})
+
+	tests := []struct {
+		name         string
+		ip           string
+		op           uint16
+		wantResponse Packet
+		wantDone     bool
+	}{
+		{name: "allowed", ip: "10.0.0.1", op: OpRRQ, wantResponse: &PacketData{BlockNum: 1, Data: []byte("kernel")}, wantDone: true},
+		{name: "denied by handler", ip: "192.168.0.1", op: OpRRQ, wantResponse: &PacketError{Code: 2, Msg: "access violation"}, wantDone: true},
+		{name: "dropped by server", ip: "10.0.0.1", op: OpWRQ, wantResponse: nil, wantDone: true},
+		{name: "write allowed", ip: "10.1.0.1", op: OpWRQ, wantResponse: &PacketAck{BlockNum: 0}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			transfer := &Transfer{File: NewFile("")}
+			raw := udpserver.NewUDPPacket(&net.UDPAddr{IP: net.ParseIP(tt.ip), Port: 1234}, nil)
+			response := processPacket(v, transfer, raw, &PacketRequest{Op: tt.op, Filename: "kernel", Mode: "octet"})
+			assert.Equal(t, tt.wantResponse, response)
+			assert.Equal(t, tt.wantDone, transfer.Done)
+		})
+	}
+}
+
+func TestTransferWorker_retransmit(t *testing.T) {
+	client := &net.UDPAddr{IP: net.ParseIP("10.0.0.1"), Port: 5000}
+	fake := clock.NewFake(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+	h := NewTFTPProtocolHandler(6000, 6100, WithClock(fake))
+	events, unsubscribe := h.Events(100)
+	defer unsubscribe()
+	data := bytes.Repeat([]byte("x"), 600)
+	h.Files.Set(File{Filename: "test", Data: data})
+	in, out, done := startTestWorker(h)
+	next := func() []byte {
+		select {
+		case p := <-out:
+			return p.Data()
+		case <-time.After(time.Millisecond * 100):
+			return nil
+		}
+	}
+	block2 := (&PacketData{BlockNum: 2, Data: data[512:]}).Serialize()
+
+	in <- udpserver.NewUDPPacket(client, (&PacketRequest{Op: OpRRQ, Filename: "test", Mode: "octet"}).Serialize())
+	assert.Equal(t, (&PacketData{BlockNum: 1, Data: data[:512]}).Serialize(), next())
+	//a quick round trip, so the timeout drops to the minimum
+	fake.Advance(time.Millisecond * 50)
+	in <- udpserver.NewUDPPacket(client, (&PacketAck{BlockNum: 1}).Serialize())
+	assert.Equal(t, block2, next())
+
+	//block 2 is lost, the client times out first and resends its ack, which doesn't put off our resend
+	fake.Advance(time.Millisecond * 100)
+	in <- udpserver.NewUDPPacket(client, (&PacketAck{BlockNum: 1}).Serialize())
+	in <- udpserver.NewUDPPacket(client, (&PacketAck{BlockNum: 1}).Serialize())
+	assert.Nil(t, next())
+	fake.Advance(time.Millisecond * 100)
+	assert.Equal(t, block2, next())
+
+	//it's resent five times in all, backing off up to the default timeout, then the worker gives up
+	for _, wait := range []time.Duration{400, 800, 1600, 3000} {
+		fake.Advance(wait*time.Millisecond - 1)
+		assert.Nil(t, next(), "resent before %dms", wait)
+		fake.Advance(1)
+		assert.Equal(t, block2, next())
+	}
+	fake.Advance(retransmitTimeout)
+	assert.Equal(t, (&PacketError{Code: 0, Msg: "too many retries, giving up"}).Serialize(), next())
+	<-done
+	//the metrics and events give the code of the error sent
+	assert.Equal(t, float64(1), h.Metrics.failed.value("get", "0"))
+	for e := range events {
+		if e.Type == EventFailed {
+			assert.Equal(t, "timeout", e.Outcome)
+			assert.Equal(t, uint16(0), e.Code)
+			break
+		}
+	}
+}
+
+func TestTransferWorker_retransmitKarn(t *testing.T) {
+	client := &net.UDPAddr{IP: net.ParseIP("10.0.0.1"), Port: 5000}
+	fake := clock.NewFake(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+	h := NewTFTPProtocolHandler(6000, 6100, WithClock(fake))
+	h.Files.Set(File{Filename: "test", Data: make([]byte, 1200)})
+	in, out, done := startTestWorker(h)
+	next := func() []byte {
+		select {
+		case p := <-out:
+			return p.Data()
+		case <-time.After(time.Millisecond * 100):
+			return nil
+		}
+	}
+
+	//nothing's been measured, so the first block waits the initial timeout
+	in <- udpserver.NewUDPPacket(client, (&PacketRequest{Op: OpRRQ, Filename: "test", Mode: "octet"}).Serialize())
+	assert.NotNil(t, next())
+	fake.Advance(initialRetransmitTimeout)
+	assert.NotNil(t, next())
+
+	//the ack could be for either copy, so it isn't measured and the backed off timeout stays
+	fake.Advance(time.Millisecond * 100)
+	in <- udpserver.NewUDPPacket(client, (&PacketAck{BlockNum: 1}).Serialize())
+	assert.NotNil(t, next())
+	fake.Advance(initialRetransmitTimeout*2 - 1)
+	assert.Nil(t, next())
+	fake.Advance(1)
+	assert.NotNil(t, next())
+	in <- udpserver.NewUDPPacket(client, (&PacketError{Code: 0, Msg: "bye"}).Serialize())
+	<-done
+}
+
+func TestWithClock(t *testing.T) {
+	client := &net.UDPAddr{IP: net.ParseIP("10.0.0.1"), Port: 5000}
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	fake := clock.NewFake(start)
+	h := NewTFTPProtocolHandler(6000, 6100, WithClock(fake))
+
+	//the same clock picks the same transfer ports
+	again := NewTFTPProtocolHandler(6000, 6100, WithClock(clock.NewFake(start)))
+	for i := 0; i < 10; i++ {
+		assert.Equal(t, h.TIDs.New(), again.TIDs.New())
+	}
+
+	//and times transfers
+	events, unsubscribe := h.Events(10)
+	defer unsubscribe()
+	h.Files.Set(File{Filename: "test", Data: make([]byte, 600)})
+	in, out, done := startTestWorker(h)
+	in <- udpserver.NewUDPPacket(client, (&PacketRequest{Op: OpRRQ, Filename: "test", Mode: "octet"}).Serialize())
+	<-out
+	fake.Advance(time.Millisecond * 1500)
+	in <- udpserver.NewUDPPacket(client, (&PacketAck{BlockNum: 1}).Serialize())
+	<-out
+	in <- udpserver.NewUDPPacket(client, (&PacketAck{BlockNum: 2}).Serialize())
+	<-done
+	var last Event
+	for len(events) > 0 {
+		e := <-events
+		if e.Type == EventRequest {
+			assert.Equal(t, start, e.Time)
+		}
+		last = e
+	}
+	assert.Equal(t, EventCompleted, last.Type)
+	assert.Equal(t, start.Add(time.Millisecond*1500), last.Time)
+	assert.Equal(t, time.Millisecond*1500, last.Duration)
+}
+
+func TestTIDRepo_New(t *testing.T) {
+	tids := NewTIDRepo(6000, 6003)
+	got := map[int32]bool{}
+	for i := 0; i < 3; i++ {
+		tid := tids.New()
+		assert.True(t, tid >= 6000 && tid < 6003, "tid %d out of range", tid)
+		got[tid] = true
+	}
+	assert.Len(t, got, 3)
+	//exhausted
+	assert.Equal(t, int32(-1), tids.New())
+	tids.Del(-1)
+	tids.Del(7000)
+	used, _ := tids.Usage()
+	assert.Equal(t, int32(3), used)
+	tids.Del(6001)
+	assert.Equal(t, int32(6001), tids.New())
+
+	//the last free one is found even when random picks keep missing it
+	tids = NewTIDRepo(6000, 7000)
+	for i := 0; i < 999; i++ {
+		tids.New()
+	}
+	last := tids.New()
+	assert.NotEqual(t, int32(-1), last)
+	assert.Equal(t, int32(-1), tids.New())
+
+	assert.Equal(t, int32(-1), NewTIDRepo(6000, 6000).New())
+	assert.Equal(t, int32(-1), NewTIDRepo(6000, 5000).New())
+}
+
+func TestTFTPProtocolHandler_noTIDs(t *testing.T) {
+	rrq := (&PacketRequest{Op: OpRRQ, Filename: "test", Mode: "octet"}).Serialize()
+	server := &net.UDPAddr{IP: memnet.Host, Port: 69}
+	tests := []struct {
+		name    string
+		options []Option
+		//taken uses up the only TID, bound has another process bind its port
+		taken, bound bool
+		want         Packet
+	}{
+		{"free", nil, false, false, &PacketData{BlockNum: 1, Data: []byte("hello")}},
+		{"exhausted", nil, true, false, &PacketError{Code: 0, Msg: "no free transfer ports (TIDs)"}},
+		{"port in use", nil, false, true, &PacketError{Code: 0, Msg: "no free transfer ports (TIDs)"}},
+		{"exhausted, kernel picks", []Option{WithEphemeralPorts()}, true, false, &PacketData{BlockNum: 1, Data: []byte("hello")}},
+		{"port in use, kernel picks", []Option{WithEphemeralPorts()}, false, true, &PacketData{BlockNum: 1, Data: []byte("hello")}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h, network, stop := memnetHandler(1000, 1001, tt.options...)
+			defer stop()
+			h.Files.Set(File{Filename: "test", Data: []byte("hello")})
+			if tt.taken {
+				h.TIDs.New()
+			}
+			if tt.bound {
+				network.ListenPacket("udp", "127.0.0.1:1000")
+			}
+			c, _ := network.ListenPacket("udp", "10.0.0.1:0")
+			c.WriteTo(rrq, server)
+			p, from := nextPacket(t, c)
+			assert.Equal(t, tt.want, p)
+			if _, ok := p.(*PacketData); ok && (tt.taken || tt.bound) {
+				assert.True(t, from.(*net.UDPAddr).Port >= 49152, "served from %s", from)
+			}
+			//TIDs are given back, ones that couldn't be bound too
+			for len(h.Transfers.List()) > 0 {
+				time.Sleep(time.Millisecond)
+			}
+			if !tt.taken {
+				used, _ := h.TIDs.Usage()
+				assert.Equal(t, int32(0), used)
+			}
+		})
+	}
+}
@@ -0,0 +1,167 @@
+package tftp
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/lienmeat/tftp/clock"
+)
+
+//TransferInfo describes a running transfer and how far it has got
+type TransferInfo struct {
+	ID       uint64    `json:"id"`
+	Server   string    `json:"server"`
+	Peer     string    `json:"peer"`
+	Filename string    `json:"filename"`
+	Op       string    `json:"op"`
+	Started  time.Time `json:"started"`
+	//Block is the block being sent or expected next
+	Block uint `json:"block"`
+	//Bytes of the file sent or received so far
+	Bytes        int64     `json:"bytes"`
+	LastActivity time.Time `json:"lastActivity"`
+	Retransmits  int       `json:"retransmits"`
+}
+
+//TransferRegistry keeps track of running transfers, so they can be listed and cancelled
+type TransferRegistry struct {
+	next    uint64
+	running map[uint64]*runningTransfer
+	//clock times when transfers started and were last active
+	clock clock.Clock
+	sync.RWMutex
+}
+
+type runningTransfer struct {
+	info   TransferInfo
+	cancel context.CancelFunc
+	//set when the transfer was cancelled through the registry, rather than by the server shutting down
+	cancelled bool
+}
+
+func NewTransferRegistry() *TransferRegistry {
+	return &TransferRegistry{
+		running: map[uint64]*runningTransfer{},
+		clock:   clock.Real,
+	}
+}
+
+//add registers a transfer started by a request, cancel stops its worker
+func (r *TransferRegistry) add(server string, peer *net.UDPAddr, req *PacketRequest, cancel context.CancelFunc) uint64 {
+	r.Lock()
+	defer r.Unlock()
+	r.next++
+	now := r.clock.Now()
+	r.running[r.next] = &runningTransfer{
+		info: TransferInfo{
+			ID:           r.next,
+			Server:       server,
+			Peer:         peer.String(),
+			Filename:     req.Filename,
+			Op:           Transfer{Op: req.Op}.OpString(),
+			Started:      now,
+			LastActivity: now,
+		},
+		cancel: cancel,
+	}
+	return r.next
+}
+
+//update records the progress of a transfer after it handled a packet
+func (r *TransferRegistry) update(id uint64, transfer *Transfer) {
+	r.Lock()
+	defer r.Unlock()
+	t, ok := r.running[id]
+	if !ok {
+		return
+	}
+	t.info.Block = transfer.Block
+	t.info.Bytes = transfer.bytesMoved()
+	t.info.LastActivity = r.clock.Now()
+}
+
+//retransmitted counts a packet resent by a transfer
+func (r *TransferRegistry) retransmitted(id uint64) {
+	r.Lock()
+	defer r.Unlock()
+	if t, ok := r.running[id]; ok {
+		t.info.Retransmits++
+	}
+}
+
+func (r *TransferRegistry) remove(id uint64) {
+	r.Lock()
+	defer r.Unlock()
+	delete(r.running, id)
+}
+
+//wasCancelled checks if the transfer was cancelled through the registry
+func (r *TransferRegistry) wasCancelled(id uint64) bool {
+	r.RLock()
+	defer r.RUnlock()
+	t, ok := r.running[id]
+	return ok && t.cancelled
+}
+
+//Get looks up a running transfer
+func (r *TransferRegistry) Get(id uint64) (info TransferInfo, ok bool) {
+	r.RLock()
+	defer r.RUnlock()
+	t, ok := r.running[id]
+	if !ok {
+		return info, false
+	}
+	return t.info, true
+}
+
+//List returns every running transfer, oldest first
+func (r *TransferRegistry) List() []TransferInfo {
+	r.RLock()
+	defer r.RUnlock()
+	tt := make([]TransferInfo, 0, len(r.running))
+	for _, t := range r.running {
+		tt = append(tt, t.info)
+	}
+	sort.Slice(tt, func(i, j int) bool { return tt[i].ID < tt[j].ID })
+	return tt
+}
+
+//Cancel stops a running transfer, the client is sent an error.  Returns false if there's no such transfer.
+func (r *TransferRegistry) Cancel(id uint64) bool {
+	r.Lock()
+	defer r.Unlock()
+	t, ok := r.running[id]
+	if !ok {
+		return false
+	}
+	t.cancelled = true
+	t.cancel()
+	return true
+}
+
+//WriteStatus writes a human readable summary of the server and a table of its running transfers
+func (h *TFTPProtocolHandler) WriteStatus(w io.Writer) error {
+	return h.writeStatus(w, h.clock.Now())
+}
+
+func (h *TFTPProtocolHandler) writeStatus(w io.Writer, now time.Time) error {
+	transfers := h.Transfers.List()
+	used, size := h.TIDs.Usage()
+	fmt.Fprintf(w, "%d transfers running, %d/%d TIDs in use\n", len(transfers), used, size)
+	if len(transfers) == 0 {
+		return nil
+	}
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tSERVER\tPEER\tOP\tFILENAME\tBLOCK\tBYTES\tRUNNING\tIDLE\tRETRANSMITS")
+	for _, t := range transfers {
+		fmt.Fprintf(tw, "%d\t%s\t%s\t%s\t%s\t%d\t%d\t%s\t%s\t%d\n", t.ID, t.Server, t.Peer, t.Op, t.Filename,
+			t.Block, t.Bytes, now.Sub(t.Started).Round(time.Second), now.Sub(t.LastActivity).Round(time.Second), t.Retransmits)
+	}
+	return tw.Flush()
+}
@@ -0,0 +1,127 @@
+package tftp
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/lienmeat/tftp/clock"
+	"github.com/lienmeat/tftp/udpserver"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTransferRegistry(t *testing.T) {
+	r := NewTransferRegistry()
+	peer := &net.UDPAddr{IP: net.ParseIP("10.0.0.1"), Port: 5000}
+	ctx, cancel := context.WithCancel(context.Background())
+
+	a := r.add("default", peer, &PacketRequest{Op: OpRRQ, Filename: "boot.img"}, cancel)
+	b := r.add("lab", peer, &PacketRequest{Op: OpWRQ, Filename: "upload"}, func() {})
+	assert.NotEqual(t, a, b)
+
+	r.update(a, &Transfer{Op: OpRRQ, Block: 3, File: File{Data: make([]byte, 2000)}})
+	r.retransmitted(a)
+	r.retransmitted(a)
+	info, ok := r.Get(a)
+	assert.True(t, ok)
+	assert.Equal(t, "default", info.Server)
+	assert.Equal(t, "10.0.0.1:5000", info.Peer)
+	assert.Equal(t, "boot.img", info.Filename)
+	assert.Equal(t, "get", info.Op)
+	assert.Equal(t, uint(3), info.Block)
+	assert.Equal(t, int64(1024), info.Bytes)
+	assert.Equal(t, 2, info.Retransmits)
+	assert.False(t, info.LastActivity.Before(info.Started))
+
+	list := r.List()
+	assert.Len(t, list, 2)
+	assert.Equal(t, a, list[0].ID)
+
+	assert.True(t, r.Cancel(a))
+	assert.Error(t, ctx.Err())
+	assert.True(t, r.wasCancelled(a))
+	assert.False(t, r.wasCancelled(b))
+
+	r.remove(a)
+	_, ok = r.Get(a)
+	assert.False(t, ok)
+	assert.False(t, r.Cancel(a))
+	//updates for transfers that are gone are ignored
+	r.update(a, &Transfer{})
+	r.retransmitted(a)
+	assert.Len(t, r.List(), 1)
+}
+
+func TestTransfer_bytesMoved(t *testing.T) {
+	data := make([]byte, 1200)
+	tests := []struct {
+		name     string
+		transfer Transfer
+		want     int64
+	}{
+		{"get not started", Transfer{Op: OpRRQ, File: File{Data: data}}, 0},
+		{"get oack sent", Transfer{Op: OpRRQ, Block: 1, File: File{Data: data}}, 0},
+		{"get first block sent", Transfer{Op: OpRRQ, Block: 2, File: File{Data: data}}, 512},
+		{"get last block sent", Transfer{Op: OpRRQ, Block: 4, File: File{Data: data}}, 1200},
+		{"get past the end", Transfer{Op: OpRRQ, Block: 5, File: File{Data: data}}, 1200},
+		{"get negotiated block size", Transfer{Op: OpRRQ, Block: 2, BlkSize: 1024, File: File{Data: data}}, 1024},
+		{"put", Transfer{Op: OpWRQ, Block: 3, File: File{Data: data}}, 1200},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, tt.transfer.bytesMoved())
+		})
+	}
+}
+
+func TestTFTPProtocolHandler_writeStatus(t *testing.T) {
+	h := NewTFTPProtocolHandler(6000, 6100)
+	buf := &bytes.Buffer{}
+	assert.NoError(t, h.WriteStatus(buf))
+	assert.Equal(t, "0 transfers running, 0/100 TIDs in use\n", buf.String())
+
+	h.TIDs.New()
+	id := h.Transfers.add("default", &net.UDPAddr{IP: net.ParseIP("10.0.0.1"), Port: 5000}, &PacketRequest{Op: OpRRQ, Filename: "boot.img"}, func() {})
+	h.Transfers.update(id, &Transfer{Op: OpRRQ, Block: 3, File: File{Data: make([]byte, 2000)}})
+	info, _ := h.Transfers.Get(id)
+
+	buf.Reset()
+	assert.NoError(t, h.writeStatus(buf, info.Started.Add(time.Second*90)))
+	assert.Equal(t, `1 transfers running, 1/100 TIDs in use
+ID  SERVER   PEER           OP   FILENAME  BLOCK  BYTES  RUNNING  IDLE   RETRANSMITS
+1   default  10.0.0.1:5000  get  boot.img  3      1024   1m30s    1m30s  0
+`, buf.String())
+}
+
+func TestTransferWorker_progress(t *testing.T) {
+	client := &net.UDPAddr{IP: net.ParseIP("10.0.0.1"), Port: 5000}
+	fake := clock.NewFake(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+	h := NewTFTPProtocolHandler(6000, 6100, WithClock(fake))
+	h.Files.Set(File{Filename: "test", Data: make([]byte, 2000)})
+
+	in, out, done := startTestWorker(h)
+	in <- udpserver.NewUDPPacket(client, (&PacketRequest{Op: OpRRQ, Filename: "test", Mode: "octet", Options: map[string]string{"timeout": "1"}}).Serialize())
+	<-out
+	in <- udpserver.NewUDPPacket(client, (&PacketAck{BlockNum: 0}).Serialize())
+	<-out
+	in <- udpserver.NewUDPPacket(client, (&PacketAck{BlockNum: 1}).Serialize())
+	<-out
+	//don't ack block 2, so it's resent
+	fake.Advance(time.Second)
+	<-out
+
+	list := h.Transfers.List()
+	if assert.Len(t, list, 1) {
+		assert.Equal(t, "test", list[0].Filename)
+		assert.Equal(t, uint(3), list[0].Block)
+		assert.Equal(t, int64(1024), list[0].Bytes)
+		assert.Equal(t, 1, list[0].Retransmits)
+		assert.Equal(t, time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC), list[0].Started)
+		assert.Equal(t, time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC), list[0].LastActivity)
+	}
+	h.Transfers.Cancel(list[0].ID)
+	<-done
+	assert.Empty(t, h.Transfers.List())
+}
@@ -0,0 +1,15 @@
+package udpserver
+
+import "sync/atomic"
+
+//Health tracks whether the listeners started by ServeWithHealth are still reading packets
+type Health struct {
+	listeners int32
+	running   int32
+}
+
+//Alive is true once every listener is running, until one of them stops
+func (h *Health) Alive() bool {
+	listeners := atomic.LoadInt32(&h.listeners)
+	return listeners > 0 && atomic.LoadInt32(&h.running) == listeners
+}
@@ -0,0 +1,59 @@
+package udpserver
+
+import "net"
+
+//Logger is where udpserver sends its logs.  tftp.Logger implementations, like tftp.LogrusLogger, satisfy it.
+type Logger interface {
+	Debug(msg string, fields map[string]interface{})
+	Info(msg string, fields map[string]interface{})
+	Warn(msg string, fields map[string]interface{})
+	Error(msg string, fields map[string]interface{})
+}
+
+//nopLogger logs nothing, it's the default
+type nopLogger struct{}
+
+func (nopLogger) Debug(msg string, fields map[string]interface{}) {}
+func (nopLogger) Info(msg string, fields map[string]interface{})  {}
+func (nopLogger) Warn(msg string, fields map[string]interface{})  {}
+func (nopLogger) Error(msg string, fields map[string]interface{}) {}
+
+//Option configures optional behaviour of the udpserver functions
+type Option func(o *options)
+
+type options struct {
+	logger       Logger
+	listenPacket func(address string) (net.PacketConn, error)
+}
+
+func newOptions(opts []Option) options {
+	o := options{logger: nopLogger{}, listenPacket: listenUDP}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return o
+}
+
+//WithLogger sends udpserver's logs to logger, they're discarded by default
+func WithLogger(logger Logger) Option {
+	return func(o *options) {
+		o.logger = logger
+	}
+}
+
+//WithListenPacket makes servers listen with listenPacket instead of on real udp sockets, so they can be run
+//over a simulated network
+func WithListenPacket(listenPacket func(address string) (net.PacketConn, error)) Option {
+	return func(o *options) {
+		o.listenPacket = listenPacket
+	}
+}
+
+func listenUDP(address string) (net.PacketConn, error) {
+	connection, err := Connect(address)
+	if err != nil {
+		//not a nil *net.UDPConn wrapped in a non-nil interface
+		return nil, err
+	}
+	return connection, nil
+}
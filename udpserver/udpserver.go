@@ -5,20 +5,20 @@ import (
 	"fmt"
 	"net"
 	"runtime"
-
-	log "github.com/sirupsen/logrus"
+	"sync/atomic"
 )
 
 // maxBufferSize specifies the size of the buffers that
 // are used to temporarily hold data from the UDP packets
-// that we receive.
-const maxBufferSize = 1024
+// that we receive.  It fits the largest possible UDP payload.
+const maxBufferSize = 65536
 
 //UDPPacket stores client address/port/tid along with the the packet data
 //which is passed into ProtocolHandlers or around other components of udpserver
 type UDPPacket struct {
-	addr *net.UDPAddr
-	data []byte
+	addr  *net.UDPAddr
+	local *net.UDPAddr
+	data  []byte
 }
 
 func NewUDPPacket(addr *net.UDPAddr, data []byte) *UDPPacket {
@@ -40,59 +40,80 @@ func (p *UDPPacket) Address() *net.UDPAddr {
 	return p.addr
 }
 
+//LocalAddress is the address of the listener the packet was received on, or nil
+//if the packet didn't come from a listener
+func (p *UDPPacket) LocalAddress() *net.UDPAddr {
+	return p.local
+}
+
 //ProtocolHandler is the interface that protocol handlers must implement
 type ProtocolHandler interface {
 	HandlePackets(ctx context.Context, incoming chan *UDPPacket, responses chan *UDPPacket)
 }
 
-func DispatchResponseWriters(ctx context.Context, connection *net.UDPConn, bufferSize int) chan *UDPPacket {
+func DispatchResponseWriters(ctx context.Context, connection net.PacketConn, bufferSize int) chan *UDPPacket {
 	ch := make(chan *UDPPacket, bufferSize)
 	go responder(ctx, connection, ch)
 	return ch
 }
 
-func responder(ctx context.Context, connection *net.UDPConn, ch <-chan *UDPPacket) {
+func responder(ctx context.Context, connection net.PacketConn, ch <-chan *UDPPacket) {
 	for {
 		select {
 		case p := <-ch:
-			connection.WriteToUDP(p.Data(), p.Address())
+			connection.WriteTo(p.Data(), p.Address())
 		case <-ctx.Done():
 			return
 		}
 	}
 }
 
-func DispatchListeners(ctx context.Context, connection *net.UDPConn, bufferSize int) chan *UDPPacket {
+func DispatchListeners(ctx context.Context, connection net.PacketConn, bufferSize int, opts ...Option) chan *UDPPacket {
 	ch := make(chan *UDPPacket, bufferSize)
-	go listener(ctx, connection, ch)
+	go listener(ctx, connection, ch, newOptions(opts).logger)
 	return ch
 }
 
-func listener(ctx context.Context, connection *net.UDPConn, in chan<- *UDPPacket) {
+func listener(ctx context.Context, connection net.PacketConn, in chan<- *UDPPacket, logger Logger) {
+	local, _ := connection.LocalAddr().(*net.UDPAddr)
 	buffer := make([]byte, maxBufferSize)
 	for {
-		log.Debug("waiting for packet")
-		n, addr, err := connection.ReadFromUDP(buffer)
+		logger.Debug("waiting for packet", nil)
+		n, from, err := connection.ReadFrom(buffer)
 		if err == nil {
-			log.Debugf("got packet %s", string(buffer[:n]))
+			addr, ok := from.(*net.UDPAddr)
+			if !ok {
+				logger.Debug("dropping packet from a non-udp address", map[string]interface{}{"address": from.String()})
+				continue
+			}
+			logger.Debug("got packet", map[string]interface{}{"address": addr.String(), "packet": string(buffer[:n])})
+			//copy the packet out so the (large) buffer can be reused
+			data := make([]byte, n)
+			copy(data, buffer[:n])
+			p := NewUDPPacket(addr, data)
+			p.local = local
+			//prefer handing off a packet we already read if someone is waiting for it,
+			//even if the context was cancelled in the meantime
 			select {
-			case <-ctx.Done():
-				return
-			case in <- NewUDPPacket(addr, buffer[:n]):
-				log.Debugf("sent packet %s", string(buffer[:n]))
+			case in <- p:
+				logger.Debug("sent packet", map[string]interface{}{"address": addr.String(), "packet": string(data)})
+			default:
+				select {
+				case <-ctx.Done():
+					return
+				case in <- p:
+					logger.Debug("sent packet", map[string]interface{}{"address": addr.String(), "packet": string(data)})
+				}
 			}
 		} else {
 			//closed connection, exit
-			log.WithFields(
-				log.Fields{
-					"context":    "listener()",
-					"connection": connection,
-					"error":      err,
-				}).Debug("error reading from UDP connection")
+			logger.Debug("error reading from UDP connection", map[string]interface{}{
+				"context":    "listener()",
+				"connection": connection,
+				"error":      err,
+			})
 			return
 		}
-		//clear out buffer
-		buffer = make([]byte, maxBufferSize)
 		select {
 		case <-ctx.Done():
 			return
@@ -102,37 +123,78 @@ func listener(ctx context.Context, connection *net.UDPConn, in chan<- *UDPPacket
 	}
 }
 
+//Connect listens for udp packets on address
 func Connect(address string) (*net.UDPConn, error) {
 	udpAddress, err := net.ResolveUDPAddr("udp", address)
 	if err != nil {
-		msg := fmt.Sprintf("error resolving udp address %s: %s", address, err)
-		log.Error(msg)
-		return nil, fmt.Errorf(msg)
+		return nil, fmt.Errorf("error resolving udp address %s: %s", address, err)
 	}
 
 	connection, err := net.ListenUDP("udp", udpAddress)
 	if err != nil {
-		msg := fmt.Sprintf("error listening on udp address %s: %s", address, err)
-		log.Error(msg)
-		return nil, fmt.Errorf(msg)
+		return nil, fmt.Errorf("error listening on udp address %s: %s", address, err)
 	}
 	return connection, nil
 }
 
-func Server(ctx context.Context, address string, handler ProtocolHandler) (err error) {
-	log.Info("Starting udp server at " + address)
+func Server(ctx context.Context, address string, handler ProtocolHandler, opts ...Option) (err error) {
+	return Servers(ctx, []string{address}, handler, opts...)
+}
 
-	connection, err := Connect(address)
-	if err != nil {
-		return err
+//Servers listens on every address, passing packets from all of them to the same handler.
+//Packets carry the LocalAddress they arrived on so the handler can tell the listeners apart.
+func Servers(ctx context.Context, addresses []string, handler ProtocolHandler, opts ...Option) (err error) {
+	listeners := make([]Listener, len(addresses))
+	for i, address := range addresses {
+		listeners[i] = Listener{Address: address, Handler: handler}
 	}
+	return Serve(ctx, listeners, opts...)
+}
 
-	defer connection.Close()
+//Listener pairs an address to listen on with the handler for packets received on it
+type Listener struct {
+	Address string
+	Handler ProtocolHandler
+}
 
-	incoming := DispatchListeners(ctx, connection, runtime.NumCPU())
-	responses := DispatchResponseWriters(ctx, connection, runtime.NumCPU())
+//Serve listens on every listener's address until ctx is done.  If any address can't be listened on, none are.
+func Serve(ctx context.Context, listeners []Listener, opts ...Option) (err error) {
+	return ServeWithHealth(ctx, listeners, &Health{}, opts...)
+}
 
-	go handler.HandlePackets(ctx, incoming, responses)
+//ServeWithHealth is Serve, keeping health up to date with whether the listeners are running
+func ServeWithHealth(ctx context.Context, listeners []Listener, health *Health, opts ...Option) (err error) {
+	o := newOptions(opts)
+	logger := o.logger
+	connections := make([]net.PacketConn, 0, len(listeners))
+	defer func() {
+		for _, c := range connections {
+			c.Close()
+		}
+	}()
+
+	for _, l := range listeners {
+		logger.Info("Starting udp server at "+l.Address, nil)
+		connection, err := o.listenPacket(l.Address)
+		if err != nil {
+			logger.Error(err.Error(), nil)
+			return err
+		}
+		connections = append(connections, connection)
+	}
+
+	atomic.StoreInt32(&health.listeners, int32(len(connections)))
+	for i, connection := range connections {
+		incoming := make(chan *UDPPacket, runtime.NumCPU())
+		go func(connection net.PacketConn) {
+			atomic.AddInt32(&health.running, 1)
+			defer atomic.AddInt32(&health.running, -1)
+			listener(ctx, connection, incoming, logger)
+		}(connection)
+		responses := DispatchResponseWriters(ctx, connection, runtime.NumCPU())
+
+		go listeners[i].Handler.HandlePackets(ctx, incoming, responses)
+	}
 
 	<-ctx.Done()
 	return
@@ -5,15 +5,37 @@ import (
 	"net"
 	"runtime"
 	"strconv"
+	"sync"
 	"testing"
 	"time"
 
-	log "github.com/sirupsen/logrus"
 	"github.com/stretchr/testify/assert"
 )
 
+//testLogger records the messages logged to it
+type testLogger struct {
+	messages []string
+	sync.Mutex
+}
+
+func (l *testLogger) log(msg string) {
+	l.Lock()
+	defer l.Unlock()
+	l.messages = append(l.messages, msg)
+}
+
+func (l *testLogger) Messages() []string {
+	l.Lock()
+	defer l.Unlock()
+	return append([]string{}, l.messages...)
+}
+
+func (l *testLogger) Debug(msg string, fields map[string]interface{}) { l.log(msg) }
+func (l *testLogger) Info(msg string, fields map[string]interface{})  { l.log(msg) }
+func (l *testLogger) Warn(msg string, fields map[string]interface{})  { l.log(msg) }
+func (l *testLogger) Error(msg string, fields map[string]interface{}) { l.log(msg) }
+
 func Test_listener(t *testing.T) {
-	log.SetLevel(log.DebugLevel)
 	ctx := context.Background()
 	ctx, done := context.WithCancel(ctx)
 
@@ -29,14 +51,17 @@ func Test_listener(t *testing.T) {
 
 	in := make(chan *UDPPacket)
 
-	go listener(ctx, conn, in)
+	logger := &testLogger{}
+	go listener(ctx, conn, in, logger)
 
 	addr := &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 8000}
 	d := []byte("ok")
 	cConn.WriteToUDP(d, addr)
 
+	local := conn.LocalAddr().(*net.UDPAddr)
+
 	out := <-in
-	assert.Equal(t, &UDPPacket{addr: &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 8001}, data: d}, out)
+	assert.Equal(t, &UDPPacket{addr: &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 8001}, local: local, data: d}, out)
 
 	d = []byte("ok2")
 	cConn.WriteToUDP(d, addr)
@@ -44,7 +69,7 @@ func Test_listener(t *testing.T) {
 	done()
 	out = <-in
 
-	assert.Equal(t, &UDPPacket{addr: &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 8001}, data: d}, out)
+	assert.Equal(t, &UDPPacket{addr: &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 8001}, local: local, data: d}, out)
 
 	d = []byte("ok3")
 	cConn.WriteToUDP(d, addr)
@@ -53,12 +78,11 @@ func Test_listener(t *testing.T) {
 	case <-in:
 		t.Error("should not receive on channel, listener didn't exit")
 	case <-time.After(time.Millisecond):
-		return
 	}
+	assert.Contains(t, logger.Messages(), "got packet")
 }
 
 func Test_responder(t *testing.T) {
-	log.SetLevel(log.DebugLevel)
 	ctx := context.Background()
 	ctx, done := context.WithCancel(ctx)
 
@@ -118,7 +142,6 @@ func Test_responder(t *testing.T) {
 }
 
 func Test_connect(t *testing.T) {
-	log.SetLevel(log.DebugLevel)
 	type args struct {
 		address string
 	}
@@ -159,6 +182,86 @@ func Test_connect(t *testing.T) {
 	}
 }
 
+type recordingHandler struct {
+	packets chan *UDPPacket
+}
+
+func (h *recordingHandler) HandlePackets(ctx context.Context, incoming chan *UDPPacket, responses chan *UDPPacket) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case p := <-incoming:
+			h.packets <- p
+		}
+	}
+}
+
+func TestServers(t *testing.T) {
+	ctx, done := context.WithCancel(context.Background())
+	defer done()
+
+	h := &recordingHandler{packets: make(chan *UDPPacket)}
+	go Servers(ctx, []string{"127.0.0.1:8008", "[::1]:8009"}, h)
+	//give the listeners a moment to bind
+	time.Sleep(time.Millisecond * 10)
+
+	for _, addr := range []string{"127.0.0.1:8008", "[::1]:8009"} {
+		c, err := net.Dial("udp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.Write([]byte(addr))
+		c.Close()
+
+		p := <-h.packets
+		assert.Equal(t, addr, string(p.Data()))
+		assert.Equal(t, addr, p.LocalAddress().String())
+	}
+}
+
+func TestServers_listenPacket(t *testing.T) {
+	ctx, done := context.WithCancel(context.Background())
+	defer done()
+
+	//listen on a port picked by the system, rather than the address asked for
+	listened := make(chan net.PacketConn, 1)
+	listen := func(address string) (net.PacketConn, error) {
+		assert.Equal(t, "example.com:69", address)
+		conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+		listened <- conn
+		return conn, err
+	}
+	h := &recordingHandler{packets: make(chan *UDPPacket)}
+	go Servers(ctx, []string{"example.com:69"}, h, WithListenPacket(listen))
+	conn := <-listened
+
+	c, err := net.Dial("udp", conn.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Write([]byte("hello"))
+	c.Close()
+	p := <-h.packets
+	assert.Equal(t, "hello", string(p.Data()))
+	assert.Equal(t, conn.LocalAddr(), p.LocalAddress())
+}
+
+func TestServers_bindFailure(t *testing.T) {
+	ctx, done := context.WithCancel(context.Background())
+	defer done()
+
+	logger := &testLogger{}
+	err := Servers(ctx, []string{"127.0.0.1:8010", "192.0.0.1:8011"}, &recordingHandler{}, WithLogger(logger))
+	assert.Error(t, err)
+	assert.Equal(t, []string{"Starting udp server at 127.0.0.1:8010", "Starting udp server at 192.0.0.1:8011", err.Error()}, logger.Messages())
+
+	//the listener that did bind must have been closed again
+	conn, err := Connect("127.0.0.1:8010")
+	assert.NoError(t, err)
+	conn.Close()
+}
+
 func Benchmark_listenerMany(b *testing.B) {
 	var err error
 	var addr *net.UDPAddr
@@ -199,7 +302,7 @@ func Benchmark_listenerMany(b *testing.B) {
 
 func b_listener(ctx context.Context, listeners int, in chan *UDPPacket, addr *net.UDPAddr, sc *net.UDPConn, cc *net.UDPConn, b *testing.B) {
 	for i := 0; i < listeners; i++ {
-		go listener(ctx, sc, in)
+		go listener(ctx, sc, in, nopLogger{})
 	}
 	go func() {
 		for i := 0; i < 100; i++ {
@@ -261,3 +364,21 @@ func b_responder(ctx context.Context, listeners int, in chan *UDPPacket, addr *n
 	}
 	return
 }
+
+func TestServeWithHealth(t *testing.T) {
+	ctx, done := context.WithCancel(context.Background())
+	health := &Health{}
+	assert.False(t, health.Alive())
+
+	go ServeWithHealth(ctx, []Listener{{Address: "127.0.0.1:8010", Handler: &recordingHandler{}}, {Address: "127.0.0.1:8011", Handler: &recordingHandler{}}}, health)
+	for i := 0; i < 100 && !health.Alive(); i++ {
+		time.Sleep(time.Millisecond * 10)
+	}
+	assert.True(t, health.Alive())
+
+	done()
+	for i := 0; i < 100 && health.Alive(); i++ {
+		time.Sleep(time.Millisecond * 10)
+	}
+	assert.False(t, health.Alive())
+}
@@ -0,0 +1,94 @@
+package tftp
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/lienmeat/tftp/udpserver"
+)
+
+//DefaultVirtualServer is the name of the VirtualServer every TFTPProtocolHandler starts with
+const DefaultVirtualServer = "default"
+
+//VirtualServer is an isolated tree of files with its own policies.  It sits between udpserver and the
+//TFTPProtocolHandler: each listen address is served by one VirtualServer, so one process can serve
+//different trees to different networks, while transfer ports (TIDs) are shared by all of them.
+type VirtualServer struct {
+	Name string
+	//Files served by this server
+	Files *FileRepo
+	//ReadOnly refuses all write requests with an access violation
+	ReadOnly bool
+	//Options limits the options negotiated with clients
+	Options OptionLimits
+	//ACL applies to requests to this server, on top of the handler's ACL.  nil allows everyone.
+	ACL *ACL
+	//MaxUploadSize is the largest file a client may upload, 0 means no limit
+	MaxUploadSize int64
+	//Quotas limit how much clients can store
+	Quotas Quotas
+
+	writeTransfers *WriteTransferRepo
+	handler        *TFTPProtocolHandler
+	//serializes storing uploads, so concurrent uploads can't overrun quotas together
+	storeLock sync.Mutex
+}
+
+//NewVirtualServer adds a VirtualServer with an empty file store to the handler.  Configure it before
+//passing it to udpserver as the ProtocolHandler for its listen addresses.
+func (h *TFTPProtocolHandler) NewVirtualServer(name string) (*VirtualServer, error) {
+	h.Lock()
+	defer h.Unlock()
+	if _, ok := h.servers[name]; ok {
+		return nil, fmt.Errorf("virtual server %s already exists", name)
+	}
+	v := &VirtualServer{
+		Name:           name,
+		Files:          NewFileRepo(),
+		writeTransfers: NewWriteTransferRepo(),
+		handler:        h,
+	}
+	h.servers[name] = v
+	return v, nil
+}
+
+//VirtualServer looks up a VirtualServer by name
+func (h *TFTPProtocolHandler) VirtualServer(name string) (v *VirtualServer, ok bool) {
+	h.RLock()
+	defer h.RUnlock()
+	v, ok = h.servers[name]
+	return v, ok
+}
+
+//VirtualServers lists every VirtualServer, sorted by name
+func (h *TFTPProtocolHandler) VirtualServers() []*VirtualServer {
+	h.RLock()
+	defer h.RUnlock()
+	vv := make([]*VirtualServer, 0, len(h.servers))
+	for _, v := range h.servers {
+		vv = append(vv, v)
+	}
+	sort.Slice(vv, func(i, j int) bool { return vv[i].Name < vv[j].Name })
+	return vv
+}
+
+//HandlePackets implements udpserver.ProtocolHandler, starting a transfer for each new request received
+func (v *VirtualServer) HandlePackets(ctx context.Context, incoming chan *udpserver.UDPPacket, responses chan *udpserver.UDPPacket) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case p := <-incoming:
+			routed, err := v.handler.sessions.route(p)
+			if err != nil {
+				v.handler.refuse(v, p, responses, err)
+			}
+			if routed {
+				continue
+			}
+			v.handler.startTransfer(ctx, v, p, responses)
+		}
+	}
+}
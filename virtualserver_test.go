@@ -0,0 +1,93 @@
+package tftp
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/lienmeat/tftp/udpserver"
+	"github.com/stretchr/testify/assert"
+)
+
+//testRequest sends a request to addr and returns the first response along with the address it came from
+func testRequest(t *testing.T, addr string, request Packet) (Packet, *net.UDPAddr) {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	raddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.WriteToUDP(request.Serialize(), raddr); err != nil {
+		t.Fatal(err)
+	}
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	buf := make([]byte, MaxPacketSize)
+	n, from, err := conn.ReadFromUDP(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := ParsePacket(buf[:n])
+	if err != nil {
+		t.Fatal(err)
+	}
+	//let the server know we're done with the transfer
+	conn.WriteToUDP((&PacketError{Code: 0, Msg: "done"}).Serialize(), from)
+	return p, from
+}
+
+func TestNewVirtualServer(t *testing.T) {
+	h := NewTFTPProtocolHandler(6000, 6100)
+
+	def, ok := h.VirtualServer(DefaultVirtualServer)
+	assert.True(t, ok)
+	assert.True(t, h.Files == def.Files)
+
+	lab, err := h.NewVirtualServer("lab")
+	assert.NoError(t, err)
+	assert.True(t, def.Files != lab.Files)
+
+	_, err = h.NewVirtualServer("lab")
+	assert.Error(t, err)
+
+	assert.Equal(t, []*VirtualServer{def, lab}, h.VirtualServers())
+}
+
+func TestVirtualServer_isolation(t *testing.T) {
+	ctx, done := context.WithCancel(context.Background())
+	defer done()
+
+	h := NewTFTPProtocolHandler(6200, 6300)
+	lab, _ := h.NewVirtualServer("lab")
+	prod, _ := h.NewVirtualServer("prod")
+	prod.ReadOnly = true
+	lab.Files.Set(File{Filename: "kernel", Data: []byte("lab kernel")})
+	prod.Files.Set(File{Filename: "kernel", Data: []byte("prod kernel")})
+
+	go udpserver.Serve(ctx, []udpserver.Listener{
+		{Address: "127.0.0.1:6010", Handler: lab},
+		{Address: "127.0.0.1:6011", Handler: prod},
+	})
+	//give the listeners a moment to bind
+	time.Sleep(time.Millisecond * 10)
+
+	p, from := testRequest(t, "127.0.0.1:6010", &PacketRequest{Op: OpRRQ, Filename: "kernel", Mode: "octet"})
+	assert.Equal(t, &PacketData{BlockNum: 1, Data: []byte("lab kernel")}, p)
+	assert.Equal(t, "127.0.0.1", from.IP.String())
+
+	p, _ = testRequest(t, "127.0.0.1:6011", &PacketRequest{Op: OpRRQ, Filename: "kernel", Mode: "octet"})
+	assert.Equal(t, &PacketData{BlockNum: 1, Data: []byte("prod kernel")}, p)
+
+	p, _ = testRequest(t, "127.0.0.1:6011", &PacketRequest{Op: OpWRQ, Filename: "kernel", Mode: "octet"})
+	assert.Equal(t, &PacketError{Code: 2, Msg: "access violation"}, p)
+
+	p, _ = testRequest(t, "127.0.0.1:6010", &PacketRequest{Op: OpWRQ, Filename: "other", Mode: "octet"})
+	assert.Equal(t, &PacketAck{BlockNum: 0}, p)
+	//the first write was aborted, so the file can be written again
+	time.Sleep(time.Millisecond * 10)
+	p, _ = testRequest(t, "127.0.0.1:6010", &PacketRequest{Op: OpWRQ, Filename: "other", Mode: "octet"})
+	assert.Equal(t, &PacketAck{BlockNum: 0}, p)
+}
@@ -0,0 +1,246 @@
+package tftp
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"path"
+	"sync/atomic"
+	"time"
+
+	"github.com/lienmeat/tftp/clock"
+)
+
+//Webhook is a URL that's sent transfer events
+type Webhook struct {
+	URL string
+	//Events are the event types sent, all of them if empty
+	Events []EventType
+	//Filenames are path.Match patterns, only events for matching files are sent.  All files if empty.
+	Filenames []string
+	//Secret, if set, signs each payload with HMAC-SHA256 in the X-Tftp-Signature header
+	Secret string
+}
+
+//matches is whether e should be sent to the webhook
+func (w Webhook) matches(e Event) bool {
+	if len(w.Events) > 0 {
+		found := false
+		for _, t := range w.Events {
+			if t == e.Type {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if len(w.Filenames) == 0 {
+		return true
+	}
+	for _, pattern := range w.Filenames {
+		if ok, _ := path.Match(pattern, e.Filename); ok {
+			return true
+		}
+	}
+	return false
+}
+
+//WebhookOptions tune delivery, 0 uses the default
+type WebhookOptions struct {
+	//QueueSize is how many events can wait to be sent to each webhook, more are dropped, default 1000
+	QueueSize int
+	//MaxAttempts is how many times an event is sent before giving up, default 5
+	MaxAttempts int
+	//Backoff is the wait before the first retry, doubling for each one up to MaxBackoff.  Defaults 1s and 1m.
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+	//Timeout is how long each request may take, default 10s
+	Timeout time.Duration
+	//Logger gets delivery failures, nothing is logged by default
+	Logger Logger
+	//Clock times the waits between retries, the system clock by default
+	Clock clock.Clock
+}
+
+const (
+	defaultWebhookQueueSize   = 1000
+	defaultWebhookMaxAttempts = 5
+	defaultWebhookBackoff     = time.Second
+	defaultWebhookMaxBackoff  = time.Minute
+	defaultWebhookTimeout     = time.Second * 10
+)
+
+func (o WebhookOptions) withDefaults() WebhookOptions {
+	if o.QueueSize == 0 {
+		o.QueueSize = defaultWebhookQueueSize
+	}
+	if o.MaxAttempts == 0 {
+		o.MaxAttempts = defaultWebhookMaxAttempts
+	}
+	if o.Backoff == 0 {
+		o.Backoff = defaultWebhookBackoff
+	}
+	if o.MaxBackoff == 0 {
+		o.MaxBackoff = defaultWebhookMaxBackoff
+	}
+	if o.Timeout == 0 {
+		o.Timeout = defaultWebhookTimeout
+	}
+	if o.Logger == nil {
+		o.Logger = nopLogger{}
+	}
+	if o.Clock == nil {
+		o.Clock = clock.Real
+	}
+	return o
+}
+
+//WebhookDispatcher POSTs transfer events as JSON to webhooks.  Each webhook has its own bounded queue, so a
+//slow or broken endpoint only delays its own events, and never the transfers.
+//
+//	d := tftp.NewWebhookDispatcher(hooks, tftp.WebhookOptions{})
+//	go d.Run(ctx)
+//	handler.Subscribe(d.Notify)
+type WebhookDispatcher struct {
+	hooks   []Webhook
+	queues  []chan Event
+	options WebhookOptions
+	client  *http.Client
+	dropped uint64
+}
+
+func NewWebhookDispatcher(hooks []Webhook, options WebhookOptions) *WebhookDispatcher {
+	options = options.withDefaults()
+	d := &WebhookDispatcher{
+		hooks:   hooks,
+		queues:  make([]chan Event, len(hooks)),
+		options: options,
+		client:  &http.Client{Timeout: options.Timeout},
+	}
+	for i := range hooks {
+		d.queues[i] = make(chan Event, options.QueueSize)
+	}
+	return d
+}
+
+//Notify queues e for every webhook it matches, dropping it for webhooks whose queue is full
+func (d *WebhookDispatcher) Notify(e Event) {
+	for i, hook := range d.hooks {
+		if !hook.matches(e) {
+			continue
+		}
+		select {
+		case d.queues[i] <- e:
+		default:
+			atomic.AddUint64(&d.dropped, 1)
+			d.options.Logger.Warn("webhook queue full, event dropped", Fields{
+				"url":   hook.URL,
+				"event": string(e.Type),
+			})
+		}
+	}
+}
+
+//Dropped is how many events were dropped because a webhook's queue was full
+func (d *WebhookDispatcher) Dropped() uint64 {
+	return atomic.LoadUint64(&d.dropped)
+}
+
+//Run sends queued events until ctx is done
+func (d *WebhookDispatcher) Run(ctx context.Context) {
+	done := make(chan struct{})
+	for i := range d.hooks {
+		go func(i int) {
+			defer func() { done <- struct{}{} }()
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case e := <-d.queues[i]:
+					d.deliver(ctx, d.hooks[i], e)
+				}
+			}
+		}(i)
+	}
+	for range d.hooks {
+		<-done
+	}
+}
+
+//deliver sends e to hook, retrying with backoff until it's accepted, it's refused, or attempts run out
+func (d *WebhookDispatcher) deliver(ctx context.Context, hook Webhook, e Event) {
+	body, err := json.Marshal(e)
+	if err != nil {
+		return
+	}
+	backoff := d.options.Backoff
+	for attempt := 1; ; attempt++ {
+		retry, err := d.post(ctx, hook, e, body)
+		if err == nil {
+			return
+		}
+		if !retry || attempt >= d.options.MaxAttempts {
+			d.options.Logger.Warn("webhook delivery failed", Fields{
+				"url":      hook.URL,
+				"event":    string(e.Type),
+				"attempts": attempt,
+				"reason":   err.Error(),
+			})
+			return
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-d.options.Clock.After(backoff):
+		}
+		backoff *= 2
+		if backoff > d.options.MaxBackoff {
+			backoff = d.options.MaxBackoff
+		}
+	}
+}
+
+//post makes one attempt at sending e, retry is whether a failure might go away by trying again
+func (d *WebhookDispatcher) post(ctx context.Context, hook Webhook, e Event, body []byte) (retry bool, err error) {
+	req, err := http.NewRequest(http.MethodPost, hook.URL, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Tftp-Event", string(e.Type))
+	if hook.Secret != "" {
+		req.Header.Set("X-Tftp-Signature", "sha256="+SignWebhook(hook.Secret, body))
+	}
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	//drain the body so the connection can be reused
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		return false, nil
+	case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500:
+		return true, fmt.Errorf("webhook answered %s", resp.Status)
+	}
+	return false, fmt.Errorf("webhook answered %s", resp.Status)
+}
+
+//SignWebhook is the hex HMAC-SHA256 of body with secret, as sent in the X-Tftp-Signature header
+//after "sha256="
+func SignWebhook(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,128 @@
+package tftp
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWebhook_matches(t *testing.T) {
+	tests := []struct {
+		name  string
+		hook  Webhook
+		event Event
+		want  bool
+	}{
+		{"everything", Webhook{}, Event{Type: EventStarted, Filename: "boot.img"}, true},
+		{"event type", Webhook{Events: []EventType{EventWriteCommitted}}, Event{Type: EventWriteCommitted}, true},
+		{"other event type", Webhook{Events: []EventType{EventWriteCommitted}}, Event{Type: EventCompleted}, false},
+		{"filename", Webhook{Filenames: []string{"configs/*.cfg"}}, Event{Filename: "configs/switch1.cfg"}, true},
+		{"other filename", Webhook{Filenames: []string{"configs/*.cfg"}}, Event{Filename: "configs/old/switch1.cfg"}, false},
+		{"one of several filenames", Webhook{Filenames: []string{"*.img", "vmlinuz"}}, Event{Filename: "vmlinuz"}, true},
+		{
+			"event type and filename",
+			Webhook{Events: []EventType{EventCompleted}, Filenames: []string{"vmlinuz"}},
+			Event{Type: EventFailed, Filename: "vmlinuz"},
+			false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, tt.hook.matches(tt.event))
+		})
+	}
+}
+
+//webhookServer answers with the status codes in statuses in turn, then 200, sending each request it gets to requests
+func webhookServer(statuses []int, requests chan<- *http.Request, bodies chan<- []byte) *httptest.Server {
+	var calls int32
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		requests <- r
+		bodies <- body
+		if n := int(atomic.AddInt32(&calls, 1)); n <= len(statuses) {
+			w.WriteHeader(statuses[n-1])
+		}
+	}))
+}
+
+func TestWebhookDispatcher(t *testing.T) {
+	requests := make(chan *http.Request, 10)
+	bodies := make(chan []byte, 10)
+	srv := webhookServer([]int{http.StatusServiceUnavailable}, requests, bodies)
+	defer srv.Close()
+
+	d := NewWebhookDispatcher([]Webhook{{URL: srv.URL, Events: []EventType{EventWriteCommitted}, Secret: "s3cret"}},
+		WebhookOptions{Backoff: time.Millisecond})
+	ctx, done := context.WithCancel(context.Background())
+	defer done()
+	go d.Run(ctx)
+
+	d.Notify(Event{Type: EventStarted, Filename: "configs/switch1.cfg"})
+	d.Notify(Event{Type: EventWriteCommitted, Filename: "configs/switch1.cfg", Peer: "10.0.0.5:5000"})
+
+	//the first attempt is retried after a 503
+	for i := 0; i < 2; i++ {
+		select {
+		case r := <-requests:
+			body := <-bodies
+			assert.Equal(t, "application/json", r.Header.Get("Content-Type"))
+			assert.Equal(t, "write_committed", r.Header.Get("X-Tftp-Event"))
+			assert.Equal(t, "sha256="+SignWebhook("s3cret", body), r.Header.Get("X-Tftp-Signature"))
+			var e Event
+			assert.NoError(t, json.Unmarshal(body, &e))
+			assert.Equal(t, EventWriteCommitted, e.Type)
+			assert.Equal(t, "configs/switch1.cfg", e.Filename)
+		case <-time.After(time.Second):
+			t.Fatal("webhook wasn't called")
+		}
+	}
+	select {
+	case <-requests:
+		t.Error("the started event should have been filtered out, and the delivery not retried again")
+	case <-time.After(time.Millisecond * 20):
+	}
+}
+
+func TestWebhookDispatcher_givesUp(t *testing.T) {
+	tests := []struct {
+		name     string
+		statuses []int
+		want     int
+	}{
+		{"retries server errors", []int{500, 502, 503, 504}, 3},
+		{"doesn't retry client errors", []int{400, 400}, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			requests := make(chan *http.Request, 10)
+			bodies := make(chan []byte, 10)
+			srv := webhookServer(tt.statuses, requests, bodies)
+			defer srv.Close()
+
+			d := NewWebhookDispatcher([]Webhook{{URL: srv.URL}}, WebhookOptions{MaxAttempts: 3, Backoff: time.Millisecond})
+			d.deliver(context.Background(), d.hooks[0], Event{Type: EventCompleted})
+			assert.Len(t, requests, tt.want)
+		})
+	}
+}
+
+func TestWebhookDispatcher_queueFull(t *testing.T) {
+	d := NewWebhookDispatcher([]Webhook{{URL: "http://127.0.0.1:1"}}, WebhookOptions{QueueSize: 1})
+	//not running, so nothing is taken off the queue
+	d.Notify(Event{Type: EventStarted})
+	d.Notify(Event{Type: EventCompleted})
+	assert.Equal(t, uint64(1), d.Dropped())
+}
+
+func TestSignWebhook(t *testing.T) {
+	//echo -n '{"type":"completed"}' | openssl dgst -sha256 -hmac key
+	assert.Equal(t, "5580fe4603bcdf92387b08a3df61d859a4f275701dda371a310d1aea96f5e400", SignWebhook("key", []byte(`{"type":"completed"}`)))
+}
@@ -5,6 +5,8 @@ import (
 	"encoding/binary"
 	"errors"
 	"fmt"
+	"sort"
+	"strings"
 )
 
 // larger than a typical mtu (1500), and largest DATA packet (516).
@@ -17,6 +19,7 @@ const (
 	OpData         = 3
 	OpAck          = 4
 	OpError        = 5
+	OpOAck         = 6
 )
 
 // packet is the interface met by all packet structs
@@ -32,6 +35,8 @@ type PacketRequest struct {
 	Op       uint16 // OpRRQ or OpWRQ
 	Filename string
 	Mode     string
+	// Options requested by the client (RFC2347), keyed by lowercased option name. nil if there were none.
+	Options map[string]string
 }
 
 func (p *PacketRequest) Parse(buf []byte) (err error) {
@@ -44,15 +49,18 @@ func (p *PacketRequest) Parse(buf []byte) (err error) {
 	if p.Mode, buf, err = parseString(buf); err != nil {
 		return err
 	}
+	if p.Options, err = parseOptions(buf); err != nil {
+		return err
+	}
 	return nil
 }
 
 func (p *PacketRequest) Serialize() []byte {
-	buf := make([]byte, 2+len(p.Filename)+1+len(p.Mode)+1)
+	buf := make([]byte, 2+len(p.Filename)+1+len(p.Mode)+1, 2+len(p.Filename)+1+len(p.Mode)+1+optionsLen(p.Options))
 	binary.BigEndian.PutUint16(buf, p.Op)
 	copy(buf[2:], p.Filename)
 	copy(buf[2+len(p.Filename)+1:], p.Mode)
-	return buf
+	return appendOptions(buf, p.Options)
 }
 
 // PacketData carries a block of data in a file transmission.
@@ -123,6 +131,73 @@ func (p *PacketError) Serialize() []byte {
 	return buf
 }
 
+// PacketOAck acknowledges the options from a request that the server agreed to (RFC2347)
+type PacketOAck struct {
+	Options map[string]string
+}
+
+func (p *PacketOAck) Parse(buf []byte) (err error) {
+	buf = buf[2:] // skip over op
+	if p.Options, err = parseOptions(buf); err != nil {
+		return err
+	}
+	if len(p.Options) == 0 {
+		// an OACK is only ever sent to acknowledge at least one option
+		return errors.New("oack without options")
+	}
+	return nil
+}
+
+func (p *PacketOAck) Serialize() []byte {
+	buf := make([]byte, 2, 2+optionsLen(p.Options))
+	binary.BigEndian.PutUint16(buf, OpOAck)
+	return appendOptions(buf, p.Options)
+}
+
+// parseOptions reads null-terminated option name/value pairs until the end of buf.
+// Option names are case insensitive, so they are lowercased.  Returns nil if buf is empty.
+func parseOptions(buf []byte) (options map[string]string, err error) {
+	var name, value string
+	for len(buf) > 0 {
+		if name, buf, err = parseString(buf); err != nil {
+			return nil, err
+		}
+		if value, buf, err = parseString(buf); err != nil {
+			return nil, err
+		}
+		if options == nil {
+			options = map[string]string{}
+		}
+		options[strings.ToLower(name)] = value
+	}
+	return options, nil
+}
+
+// optionsLen is the serialized length of options
+func optionsLen(options map[string]string) int {
+	l := 0
+	for name, value := range options {
+		l += len(name) + 1 + len(value) + 1
+	}
+	return l
+}
+
+// appendOptions serializes options onto buf, sorted by name so the output is stable
+func appendOptions(buf []byte, options map[string]string) []byte {
+	names := make([]string, 0, len(options))
+	for name := range options {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		buf = append(buf, name...)
+		buf = append(buf, 0)
+		buf = append(buf, options[name]...)
+		buf = append(buf, 0)
+	}
+	return buf
+}
+
 // parseUint16 reads a big-endian uint16 from the beginning of buf,
 // returning it along with a slice pointing at the next position in the buffer.
 func parseUint16(buf []byte) (uint16, []byte, error) {
@@ -157,6 +232,8 @@ func ParsePacket(buf []byte) (p Packet, err error) {
 		p = &PacketAck{}
 	case OpError:
 		p = &PacketError{}
+	case OpOAck:
+		p = &PacketOAck{}
 	default:
 		err = fmt.Errorf("unexpected opcode %d", opcode)
 		return
@@ -12,11 +12,15 @@ func TestSerializationDeserialization(t *testing.T) {
 	}{
 		{
 			[]byte("\x00\x01foo\x00bar\x00"),
-			&PacketRequest{OpRRQ, "foo", "bar"},
+			&PacketRequest{OpRRQ, "foo", "bar", nil},
 		},
 		{
 			[]byte("\x00\x02foo\x00bar\x00"),
-			&PacketRequest{OpWRQ, "foo", "bar"},
+			&PacketRequest{OpWRQ, "foo", "bar", nil},
+		},
+		{
+			[]byte("\x00\x01foo\x00octet\x00blksize\x001428\x00tsize\x000\x00"),
+			&PacketRequest{OpRRQ, "foo", "octet", map[string]string{"blksize": "1428", "tsize": "0"}},
 		},
 		{
 			[]byte("\x00\x03\x12\x34fnord"),
@@ -34,6 +38,10 @@ func TestSerializationDeserialization(t *testing.T) {
 			[]byte("\x00\x05\xab\xcdparachute failure\x00"),
 			&PacketError{0xabcd, "parachute failure"},
 		},
+		{
+			[]byte("\x00\x06blksize\x001428\x00timeout\x005\x00"),
+			&PacketOAck{map[string]string{"blksize": "1428", "timeout": "5"}},
+		},
 	}
 
 	for _, test := range tests {
@@ -51,6 +59,16 @@ func TestSerializationDeserialization(t *testing.T) {
 	}
 }
 
+func TestParseOptionsCaseInsensitive(t *testing.T) {
+	p, err := ParsePacket([]byte("\x00\x01foo\x00octet\x00BLKSIZE\x001428\x00"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v := p.(*PacketRequest).Options["blksize"]; v != "1428" {
+		t.Errorf("expected blksize option 1428; got %q", v)
+	}
+}
+
 func TestDeserializationInvalid(t *testing.T) {
 	tests := [][]byte{
 		// no opcode
@@ -74,6 +92,12 @@ func TestDeserializationInvalid(t *testing.T) {
 		[]byte("\x00\x02foo\x00"),
 		[]byte("\x00\x02foo\x00bar"),
 
+		// short options
+		[]byte("\x00\x01foo\x00bar\x00blksize"),
+		[]byte("\x00\x01foo\x00bar\x00blksize\x00"),
+		[]byte("\x00\x01foo\x00bar\x00blksize\x001428"),
+		[]byte("\x00\x06blksize\x00"),
+
 		// short data
 		[]byte("\x00\x03"),
 		[]byte("\x00\x03\x01"),